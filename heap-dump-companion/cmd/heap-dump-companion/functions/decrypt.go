@@ -1,7 +1,12 @@
 package functions
 
 import (
+	"bufio"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 
@@ -16,6 +21,8 @@ var output string
 var aesKeyLocation string
 var topic string
 var transitMountPoint string
+var expectedSHA256 string
+var manifestLocation string
 
 var decryptCmd = &cobra.Command{
 	Use:   "decrypt",
@@ -27,7 +34,14 @@ using the transit engine of hashicorp Vault.
 
 Examples:
 
-heap-dump-companion decrypt --input-file test/test.dump.crypted --output-file test/test.dump --key test/test.key -t some-tenant`,
+heap-dump-companion decrypt --input-file test/test.dump.crypted --output-file test/test.dump --key test/test.key -t some-tenant
+
+Use "-" as output file to stream the decrypted heap dump to stdout:
+
+heap-dump-companion decrypt --input-file test/test.dump.crypted --output-file - --key test/test.key -t some-tenant | gzip > test.dump.gz
+
+The decrypted heap dump is verified against the SHA-256 checksum the sidecar recorded in its manifest.
+The manifest is read from <input-file>.manifest.json if it exists, use --manifest or --sha256 to pass it explicitly.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		client, err := vault.GenerateTransitVaultClient()
 		cobra.CheckErr(err)
@@ -39,24 +53,72 @@ heap-dump-companion decrypt --input-file test/test.dump.crypted --output-file te
 		cobra.CheckErr(err)
 		decodedKey, err := base64.StdEncoding.DecodeString(plainTextKey)
 		cobra.CheckErr(err)
-		fullOutputLocation, err := filepath.Abs(output)
-		cobra.CheckErr(err)
 		fullHeapDumpLocation, err := filepath.Abs(heapDumpLocation)
 		cobra.CheckErr(err)
 		dir, file := filepath.Split(fullHeapDumpLocation)
-		err = decrypt.DecryptFile(os.DirFS(dir), decodedKey, file, fullOutputLocation)
+		checksum, err := plaintextChecksum(fullHeapDumpLocation)
+		cobra.CheckErr(err)
+		if checksum == "" {
+			fmt.Fprintln(os.Stderr, "No SHA-256 checksum found, the decrypted heap dump is not verified")
+		}
+		if output == "-" {
+			stdout := bufio.NewWriterSize(os.Stdout, 1024*1024)
+			var dst io.Writer = stdout
+			var verifier *decrypt.Verifier
+			if checksum != "" {
+				verifier, err = decrypt.NewVerifier(stdout, checksum)
+				cobra.CheckErr(err)
+				dst = verifier
+			}
+			err = decrypt.DecryptStream(os.DirFS(dir), decodedKey, file, dst)
+			cobra.CheckErr(err)
+			cobra.CheckErr(stdout.Flush())
+			if verifier != nil {
+				cobra.CheckErr(verifier.Verify())
+			}
+			return
+		}
+		fullOutputLocation, err := filepath.Abs(output)
+		cobra.CheckErr(err)
+		err = decrypt.DecryptFile(os.DirFS(dir), decodedKey, file, fullOutputLocation, checksum)
 		cobra.CheckErr(err)
 	},
 }
 
+// plaintextChecksum returns the checksum the decrypted heap dump is verified
+// against: the one passed with --sha256, the one in the manifest passed with
+// --manifest or the one in the manifest next to the heap dump. Without any of
+// them the heap dump is not verified.
+func plaintextChecksum(fullHeapDumpLocation string) (string, error) {
+	if expectedSHA256 != "" {
+		return expectedSHA256, nil
+	}
+	location := manifestLocation
+	if location == "" {
+		location = fullHeapDumpLocation + ".manifest.json"
+		if _, err := os.Stat(location); errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+	}
+	fullManifestLocation, err := filepath.Abs(location)
+	if err != nil {
+		return "", err
+	}
+	dir, file := filepath.Split(fullManifestLocation)
+	return decrypt.ReadManifestChecksum(os.DirFS(dir), file)
+}
+
 func init() {
 	rootCmd.AddCommand(decryptCmd)
 	decryptCmd.PersistentFlags().StringVarP(&heapDumpLocation, "input-file", "i", "", "Path to the encrypted heap dump")
-	decryptCmd.PersistentFlags().StringVarP(&output, "output-file", "o", "", "Desired output file after decryption")
+	decryptCmd.PersistentFlags().StringVarP(&output, "output-file", "o", "", "Desired output file after decryption, - for stdout")
 	decryptCmd.PersistentFlags().StringVarP(&aesKeyLocation, "key", "k", "", "Path to the encrypted key that should be used for dectyption")
 	decryptCmd.PersistentFlags().StringVarP(&topic, "topic", "t", "", "Topic/Tenant owner of the heap dump to be decrypted")
 	decryptCmd.PersistentFlags().StringVarP(&transitMountPoint, "transit-mount-point", "T", "eaas-heap-dump-service", "Transit engine mount point in vault")
 
+	decryptCmd.PersistentFlags().StringVar(&expectedSHA256, "sha256", "", "Expected SHA-256 checksum of the decrypted heap dump")
+	decryptCmd.PersistentFlags().StringVarP(&manifestLocation, "manifest", "m", "", "Path to the manifest of the heap dump, defaults to <input-file>.manifest.json")
+
 	decryptCmd.MarkFlagRequired("input-file")
 	decryptCmd.MarkFlagRequired("output-file")
 	decryptCmd.MarkFlagRequired("key")
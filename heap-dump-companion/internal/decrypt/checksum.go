@@ -0,0 +1,70 @@
+package decrypt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned if a decrypted heap dump does not match
+// the SHA-256 checksum the sidecar recorded before encrypting it.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// Verifier hashes everything written to dst, so the plaintext can be
+// checked against the expected checksum once the heap dump is decrypted.
+type Verifier struct {
+	dst      io.Writer
+	hash     hash.Hash
+	expected string
+}
+
+// NewVerifier returns a Verifier expecting the hex encoded SHA-256
+// checksum expected.
+func NewVerifier(dst io.Writer, expected string) (*Verifier, error) {
+	expected = strings.ToLower(strings.TrimSpace(expected))
+	if decoded, err := hex.DecodeString(expected); err != nil || len(decoded) != sha256.Size {
+		return nil, errors.New(fmt.Sprintf("Invalid SHA-256 checksum %q", expected))
+	}
+	return &Verifier{dst: dst, hash: sha256.New(), expected: expected}, nil
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	n, err := v.dst.Write(p)
+	v.hash.Write(p[:n])
+	return n, err
+}
+
+// Verify compares the checksum of the data written so far with the
+// expected one.
+func (v *Verifier) Verify() error {
+	got := hex.EncodeToString(v.hash.Sum(nil))
+	if got != v.expected {
+		return fmt.Errorf("%w: expected SHA-256 %s, decrypted heap dump has %s", ErrChecksumMismatch, v.expected, got)
+	}
+	return nil
+}
+
+// ReadManifestChecksum returns the plaintext checksum recorded in the
+// manifest the sidecar uploads next to each heap dump.
+func ReadManifestChecksum(fileSystem fs.FS, manifestLocation string) (string, error) {
+	data, err := fs.ReadFile(fileSystem, manifestLocation)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error reading manifest %s: %s", manifestLocation, err.Error()))
+	}
+	var manifest struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return "", errors.New(fmt.Sprintf("Error parsing manifest %s: %s", manifestLocation, err.Error()))
+	}
+	if manifest.SHA256 == "" {
+		return "", errors.New(fmt.Sprintf("Manifest %s holds no SHA-256 checksum", manifestLocation))
+	}
+	return manifest.SHA256, nil
+}
@@ -0,0 +1,80 @@
+package decrypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVerifier(t *testing.T) {
+	sum := sha256.Sum256([]byte("asdfasdfasdf"))
+	var out bytes.Buffer
+	verifier, err := NewVerifier(&out, hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Failed to create verifier: %v", err)
+	}
+	verifier.Write([]byte("asdf"))
+	verifier.Write([]byte("asdfasdf"))
+	if err := verifier.Verify(); err != nil {
+		t.Errorf("Checksum has to match: %v", err)
+	}
+	if out.String() != "asdfasdfasdf" {
+		t.Errorf("Data has to be passed on, got %s", out.String())
+	}
+	verifier.Write([]byte("x"))
+	if err := verifier.Verify(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+
+	if _, err := NewVerifier(&out, "abc"); err == nil {
+		t.Errorf("Invalid checksums have to be rejected")
+	}
+}
+
+func TestDecryptFileChecksum(t *testing.T) {
+	fs := fstest.MapFS{
+		"test_heap_dump.crypted": {Data: sidecarEnvelope},
+	}
+	testTargetFile := "/tmp/test_heap_dump_checksum"
+	defer cleanup(testTargetFile)
+	sum := sha256.Sum256([]byte("asdfasdfasdf"))
+	if err := DecryptFile(fs, envelopeTestKey, "test_heap_dump.crypted", testTargetFile, hex.EncodeToString(sum[:])); err != nil {
+		t.Errorf("Checksum has to match: %v", err)
+	}
+
+	cleanup(testTargetFile)
+	wrong := sha256.Sum256([]byte("something else"))
+	err := DecryptFile(fs, envelopeTestKey, "test_heap_dump.crypted", testTargetFile, hex.EncodeToString(wrong[:]))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	// a heap dump failing verification is neither renamed nor left behind
+	if _, err := os.Stat(testTargetFile); !os.IsNotExist(err) {
+		t.Errorf("A heap dump failing verification must not be written: %v", err)
+	}
+	if partial, _ := filepath.Glob("/tmp/.test_heap_dump_checksum.partial-*"); len(partial) != 0 {
+		t.Errorf("The temporary file has to be removed, got %v", partial)
+	}
+}
+
+func TestReadManifestChecksum(t *testing.T) {
+	fs := fstest.MapFS{
+		"dump.crypted.manifest.json": {Data: []byte(`{"file-name":"java_pid1.hprof","sha256":"abc"}`)},
+		"empty.manifest.json":        {Data: []byte(`{"file-name":"java_pid1.hprof"}`)},
+		"invalid.manifest.json":      {Data: []byte(`sha256`)},
+	}
+	got, err := ReadManifestChecksum(fs, "dump.crypted.manifest.json")
+	if err != nil || got != "abc" {
+		t.Errorf("got %s, %v, want abc", got, err)
+	}
+	for _, name := range []string{"empty.manifest.json", "invalid.manifest.json", "missing.manifest.json"} {
+		if _, err := ReadManifestChecksum(fs, name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package decrypt
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decompressor returns the decompressed plaintext of src for the
+// compression named in the envelope header.
+func decompressor(src io.Reader, compression byte) (io.ReadCloser, error) {
+	switch compression {
+	case compressionNone:
+		return io.NopCloser(src), nil
+	case compressionGzip:
+		return gzip.NewReader(src)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unsupported compression %d", compression))
+}
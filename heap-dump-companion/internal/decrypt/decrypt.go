@@ -1,20 +1,78 @@
 package decrypt
 
 import (
+	"bufio"
 	"crypto/aes"
 	"crypto/cipher"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
 )
 
-func DecryptFile(fileSystem fs.FS, key []byte, encryptedFileLocation string, desiredOutputFileLocation string) error {
-	// Reading ciphertext file
-	cipherText, err := fs.ReadFile(fileSystem, encryptedFileLocation)
+// DecryptFile decrypts a heap dump into desiredOutputFileLocation. The
+// plaintext is streamed into a temporary file next to the target which is
+// only renamed once the whole dump has been authenticated, so a failed or
+// truncated decryption never leaves a partial heap dump behind.
+//
+// If expectedSHA256 is set, the plaintext is hashed while it is written and
+// verified before the rename. A mismatch is reported as ErrChecksumMismatch
+// and the temporary file is removed, desiredOutputFileLocation is never
+// replaced by a heap dump that failed verification.
+func DecryptFile(fileSystem fs.FS, key []byte, encryptedFileLocation string, desiredOutputFileLocation string, expectedSHA256 string) error {
+	dir, file := filepath.Split(desiredOutputFileLocation)
+	if dir == "" {
+		dir = "."
+	}
+	outputFile, err := os.CreateTemp(dir, fmt.Sprintf(".%s.partial-*", file))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error writing decrypted heap dump: %s", err.Error()))
+	}
+	defer os.Remove(outputFile.Name())
+
+	var dst io.Writer = outputFile
+	var verifier *Verifier
+	if expectedSHA256 != "" {
+		if verifier, err = NewVerifier(outputFile, expectedSHA256); err != nil {
+			outputFile.Close()
+			return err
+		}
+		dst = verifier
+	}
+	err = DecryptStream(fileSystem, key, encryptedFileLocation, dst)
+	if closeErr := outputFile.Close(); err == nil && closeErr != nil {
+		err = errors.New(fmt.Sprintf("Error writing decrypted heap dump: %s", closeErr.Error()))
+	}
+	if err != nil {
+		return err
+	}
+	if verifier != nil {
+		if err := verifier.Verify(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(outputFile.Name(), desiredOutputFileLocation); err != nil {
+		return errors.New(fmt.Sprintf("Error writing decrypted heap dump: %s", err.Error()))
+	}
+	return nil
+}
+
+// DecryptStream decrypts a heap dump into dst. Envelope dumps are processed
+// chunk by chunk with constant memory and every chunk is authenticated
+// before it is written. Dumps the sidecar compressed before encrypting them
+// are decompressed on the fly. On error dst may hold the plaintext of the
+// chunks verified so far, it is up to the caller to discard it.
+func DecryptStream(fileSystem fs.FS, key []byte, encryptedFileLocation string, dst io.Writer) error {
+	// Opening ciphertext file
+	inputFile, err := fileSystem.Open(encryptedFileLocation)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error reading heap dump %s: %s", encryptedFileLocation, err.Error()))
 	}
+	defer inputFile.Close()
+	input := bufio.NewReaderSize(inputFile, 1024*1024)
 
 	// Creating block of algorithm
 	block, err := aes.NewCipher(key)
@@ -28,17 +86,40 @@ func DecryptFile(fileSystem fs.FS, key []byte, encryptedFileLocation string, des
 		return errors.New(fmt.Sprintf("Error in GCM Cipher: %s", err.Error()))
 	}
 
+	if !isEnvelope(input) {
+		return decryptLegacy(dst, input, gcm, encryptedFileLocation)
+	}
+	if len(key) != 32 {
+		return errors.New(fmt.Sprintf("Decrypting file %s failed: AES-256-GCM requires a 32 byte key, got %d", encryptedFileLocation, len(key)))
+	}
+	if err := decryptEnvelope(dst, input, gcm); err != nil {
+		return errors.New(fmt.Sprintf("Decrypting file %s failed: %s", encryptedFileLocation, err.Error()))
+	}
+	return nil
+}
+
+// decryptLegacy handles dumps written before the envelope format was
+// introduced: a single GCM blob prefixed with its nonce. Such a blob can
+// only be authenticated as a whole, so it has to be held in memory.
+func decryptLegacy(dst io.Writer, input io.Reader, gcm cipher.AEAD, encryptedFileLocation string) error {
+	cipherText, err := io.ReadAll(input)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading heap dump %s: %s", encryptedFileLocation, err.Error()))
+	}
+	if len(cipherText) < gcm.NonceSize() {
+		return errors.New(fmt.Sprintf("Decrypting file %s failed: file is too short", encryptedFileLocation))
+	}
+
 	// Deattached nonce and decrypt
 	nonce := cipherText[:gcm.NonceSize()]
 	cipherText = cipherText[gcm.NonceSize():]
-	plainText, err := gcm.Open(nil, nonce, cipherText, nil)
+	plainText, err := gcm.Open(cipherText[:0], nonce, cipherText, nil)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Decrypting file %s failed: %s", encryptedFileLocation, err.Error()))
 	}
 
 	// Writing decryption content
-	err = os.WriteFile(desiredOutputFileLocation, plainText, 0666)
-	if err != nil {
+	if _, err := dst.Write(plainText); err != nil {
 		return errors.New(fmt.Sprintf("Error writing decrypted heap dump: %s", err.Error()))
 	}
 	return nil
@@ -1,7 +1,10 @@
 package decrypt
 
 import (
+	"bytes"
+	"crypto/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"testing/fstest"
@@ -18,7 +21,7 @@ func TestDecrypt(t *testing.T) {
 	test_key := []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49}
 	testTargetFile := "/tmp/test_heap_dump"
 	want := "asdfasdfasdf"
-	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile)
+	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile, "")
 
 	if err != nil {
 		t.Errorf("Failed to encrypt test file: %v", err)
@@ -45,7 +48,7 @@ func TestFileNotFound(t *testing.T) {
 	test_key := []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49}
 	testTargetFile := "/tmp/test_heap_dump"
 	want := "Error reading heap dump"
-	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile)
+	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile, "")
 
 	if err == nil {
 		t.Errorf("Failed to encrypt test file: %v", err)
@@ -63,7 +66,7 @@ func TestBadAESKey(t *testing.T) {
 	test_key := []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60}
 	testTargetFile := "/tmp/test_heap_dump"
 	want := "message authentication failed"
-	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile)
+	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile, "")
 
 	if err == nil {
 		t.Errorf("Failed to encrypt test file: %v", err)
@@ -81,7 +84,7 @@ func TestBadOutputFile(t *testing.T) {
 	test_key := []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49}
 	testTargetFile := "/asdf/test_heap_dump"
 	want := "Error writing decrypted heap dump"
-	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile)
+	err := DecryptFile(fs, test_key, "test_heap_dump.crypted", testTargetFile, "")
 
 	if err == nil {
 		t.Errorf("Failed to encrypt test file: %v", err)
@@ -91,3 +94,44 @@ func TestBadOutputFile(t *testing.T) {
 		t.Errorf("Got %s want: %s", err.Error(), want)
 	}
 }
+
+func TestTruncatedDumpLeavesNoOutput(t *testing.T) {
+	plainText := make([]byte, 1000)
+	envelope := sealEnvelope(t, plainText, 100)
+	fs := fstest.MapFS{
+		"test_heap_dump.crypted": {Data: envelope[:len(envelope)-4-100-16]},
+	}
+	outputDir := t.TempDir()
+	testTargetFile := filepath.Join(outputDir, "test_heap_dump")
+	err := DecryptFile(fs, envelopeTestKey, "test_heap_dump.crypted", testTargetFile, "")
+	if err == nil || !strings.Contains(err.Error(), ErrTruncated.Error()) {
+		t.Errorf("Got %v want: %v", err, ErrTruncated)
+	}
+	entries, _ := os.ReadDir(outputDir)
+	if len(entries) != 0 {
+		t.Errorf("Truncated dump must not leave files behind, found %d", len(entries))
+	}
+}
+
+func TestDecryptStream(t *testing.T) {
+	plainText := make([]byte, 1000)
+	rand.Read(plainText)
+	fs := fstest.MapFS{
+		"test_heap_dump.crypted": {Data: sealEnvelope(t, plainText, 100)},
+		"legacy.crypted":         {Data: []byte{249, 184, 229, 140, 162, 106, 204, 138, 217, 134, 0, 193, 0, 94, 138, 198, 87, 151, 61, 2, 150, 92, 171, 128, 156, 23, 5, 153, 140, 69, 83, 173, 163, 164, 4, 58, 155, 75, 53, 198}},
+	}
+	var out bytes.Buffer
+	if err := DecryptStream(fs, envelopeTestKey, "test_heap_dump.crypted", &out); err != nil {
+		t.Fatalf("Failed to decrypt: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), plainText) {
+		t.Errorf("decrypted data does not match")
+	}
+	out.Reset()
+	if err := DecryptStream(fs, envelopeTestKey, "legacy.crypted", &out); err != nil {
+		t.Fatalf("Failed to decrypt legacy dump: %v", err)
+	}
+	if out.String() != "asdfasdfasdf" {
+		t.Errorf("Unexpected decrypted data: want: %s, got %s", "asdfasdfasdf", out.String())
+	}
+}
@@ -0,0 +1,251 @@
+package decrypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Layout of the envelope written by the notify-sidecar, see
+// docs/envelope-format.md. Any change here has to be mirrored in the
+// sidecar's utils package.
+const (
+	envelopeMagic   = "HDMCRYPT"
+	envelopeVersion = 1
+	// envelopeVersionCompressed names the compression in the flags, which
+	// are reserved in version 1
+	envelopeVersionCompressed = 2
+	envelopeHeaderSize        = 23
+	noncePrefixSize           = 7
+
+	algorithmAES256GCM = 1
+
+	// From version 2 on the low bits of the flags byte name the compression
+	// applied to the plaintext before it was encrypted, all other bits are
+	// reserved.
+	flagCompressionMask = 0x03
+	compressionNone     = 0
+	compressionGzip     = 1
+	compressionZstd     = 2
+
+	// Upper bound for the chunk size announced in a header, so a corrupt
+	// header can not make us allocate arbitrary amounts of memory.
+	maxChunkSize = 16 * 1024 * 1024
+)
+
+var ErrTruncated = errors.New("encrypted heap dump is truncated: final chunk is missing")
+
+type envelopeHeader struct {
+	Version     byte
+	Algorithm   byte
+	Flags       byte
+	ChunkSize   uint32
+	NoncePrefix [noncePrefixSize]byte
+	raw         []byte
+}
+
+// isEnvelope reports whether the stream starts with the envelope magic.
+// Anything else is treated as the legacy nonce-prefixed GCM blob.
+func isEnvelope(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(envelopeMagic))
+	return err == nil && string(magic) == envelopeMagic
+}
+
+func readEnvelopeHeader(r io.Reader) (envelopeHeader, error) {
+	var header envelopeHeader
+	raw := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return header, errors.New(fmt.Sprintf("Error reading envelope header: %s", err.Error()))
+	}
+	if string(raw[:8]) != envelopeMagic {
+		return header, errors.New("Error reading envelope header: invalid magic")
+	}
+	header = envelopeHeader{
+		Version:   raw[8],
+		Algorithm: raw[9],
+		Flags:     raw[10],
+		ChunkSize: binary.BigEndian.Uint32(raw[12:16]),
+		raw:       raw,
+	}
+	copy(header.NoncePrefix[:], raw[16:])
+
+	if header.Version != envelopeVersion && header.Version != envelopeVersionCompressed {
+		return header, errors.New(fmt.Sprintf("Unsupported envelope version %d", header.Version))
+	}
+	if header.Algorithm != algorithmAES256GCM {
+		return header, errors.New(fmt.Sprintf("Unsupported envelope algorithm %d", header.Algorithm))
+	}
+	reserved := byte(0xff &^ flagCompressionMask)
+	if header.Version == envelopeVersion {
+		reserved = 0xff
+	}
+	if header.Flags&reserved != 0 || header.compression() > compressionZstd || raw[11] != 0 {
+		return header, errors.New(fmt.Sprintf("Unsupported envelope flags %d for version %d", header.Flags, header.Version))
+	}
+	if header.ChunkSize == 0 || header.ChunkSize > maxChunkSize {
+		return header, errors.New(fmt.Sprintf("Invalid envelope chunk size %d", header.ChunkSize))
+	}
+	return header, nil
+}
+
+func (h envelopeHeader) compression() byte {
+	return h.Flags & flagCompressionMask
+}
+
+// chunkNonce derives the nonce of a single chunk: the random prefix of the
+// header, the big endian chunk counter and a trailing final-chunk marker.
+func chunkNonce(prefix [noncePrefixSize]byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// decryptEnvelope authenticates and decrypts src chunk by chunk and writes
+// the plaintext of every verified chunk to dst, decompressing it if the
+// header says so. It fails if the stream ends before the final chunk or if
+// data follows it.
+func decryptEnvelope(dst io.Writer, src io.Reader, gcm cipher.AEAD) error {
+	header, err := readEnvelopeHeader(src)
+	if err != nil {
+		return err
+	}
+	if gcm.NonceSize() != noncePrefixSize+5 {
+		return errors.New(fmt.Sprintf("Unexpected nonce size %d", gcm.NonceSize()))
+	}
+
+	chunks := newChunkReader(src, gcm, header)
+	plain, err := decompressor(chunks, header.compression())
+	if err != nil {
+		if chunks.err != nil && chunks.err != io.EOF {
+			return chunks.err
+		}
+		return errors.New(fmt.Sprintf("Error decompressing heap dump: %s", err.Error()))
+	}
+	defer plain.Close()
+
+	out := &trackingWriter{w: dst}
+	_, err = io.Copy(out, plain)
+	// errors of the envelope itself take precedence, the decompressor only
+	// sees their consequences
+	if chunks.err != nil && chunks.err != io.EOF {
+		return chunks.err
+	}
+	if out.err != nil {
+		return errors.New(fmt.Sprintf("Error writing decrypted heap dump: %s", out.err.Error()))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error decompressing heap dump: %s", err.Error()))
+	}
+	// the compressed stream may end before the envelope does
+	if n, _ := io.Copy(io.Discard, chunks); n > 0 {
+		return errors.New("Unexpected data after compressed heap dump")
+	}
+	if chunks.err != io.EOF {
+		return chunks.err
+	}
+	return nil
+}
+
+// chunkReader returns the plaintext of an envelope. Every chunk is
+// authenticated before any of its bytes are returned.
+type chunkReader struct {
+	src     io.Reader
+	gcm     cipher.AEAD
+	header  envelopeHeader
+	counter uint32
+	sealed  []byte
+	plain   []byte
+	pending []byte
+	length  []byte
+	// err is sticky, io.EOF once the final chunk was verified
+	err error
+}
+
+func newChunkReader(src io.Reader, gcm cipher.AEAD, header envelopeHeader) *chunkReader {
+	return &chunkReader{
+		src:    src,
+		gcm:    gcm,
+		header: header,
+		sealed: make([]byte, int(header.ChunkSize)+gcm.Overhead()),
+		plain:  make([]byte, 0, header.ChunkSize),
+		length: make([]byte, 4),
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into pending. It returns io.EOF after the
+// final chunk.
+func (r *chunkReader) next() error {
+	if _, err := io.ReadFull(r.src, r.length); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
+	}
+	n := int(binary.BigEndian.Uint32(r.length))
+	if n < r.gcm.Overhead() || n > len(r.sealed) {
+		return errors.New(fmt.Sprintf("Invalid length %d of chunk %d", n, r.counter))
+	}
+	if _, err := io.ReadFull(r.src, r.sealed[:n]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
+	}
+
+	final := false
+	plain, err := r.gcm.Open(r.plain[:0], chunkNonce(r.header.NoncePrefix, r.counter, false), r.sealed[:n], r.header.raw)
+	if err != nil {
+		plain, err = r.gcm.Open(r.plain[:0], chunkNonce(r.header.NoncePrefix, r.counter, true), r.sealed[:n], r.header.raw)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Decrypting chunk %d failed: %s", r.counter, err.Error()))
+		}
+		final = true
+	}
+	if final {
+		if _, err := io.ReadFull(r.src, r.length[:1]); err != io.EOF {
+			return errors.New("Unexpected data after final chunk")
+		}
+	}
+	r.counter++
+	r.pending = plain
+	if final {
+		// pending is still returned, the error only once it is consumed
+		r.err = io.EOF
+		return io.EOF
+	}
+	return nil
+}
+
+// trackingWriter remembers the first error of w, so write errors can be told
+// apart from read errors after io.Copy.
+type trackingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,228 @@
+package decrypt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var envelopeTestKey = []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49}
+
+// "asdfasdfasdf" encrypted by the notify-sidecar with envelopeTestKey
+var sidecarEnvelope = []byte{72, 68, 77, 67, 82, 89, 80, 84, 1, 1, 0, 0, 0, 1, 0, 0, 110, 166, 126, 254, 104, 140, 36, 0, 0, 0, 28, 153, 233, 200, 69, 154, 140, 195, 44, 118, 54, 76, 224, 214, 169, 82, 136, 127, 47, 210, 183, 129, 247, 19, 163, 29, 232, 246, 11}
+
+// sealEnvelope mirrors the sidecar's encryptStream so tests can build
+// envelopes with an arbitrary number of chunks.
+func sealEnvelope(t *testing.T, plainText []byte, chunkSize int) []byte {
+	t.Helper()
+	return sealEnvelopeWithHeader(t, plainText, chunkSize, envelopeVersion, 0)
+}
+
+// sealEnvelopeWithFlags seals a compressed envelope, which is version 2.
+func sealEnvelopeWithFlags(t *testing.T, plainText []byte, chunkSize int, flags byte) []byte {
+	t.Helper()
+	return sealEnvelopeWithHeader(t, plainText, chunkSize, envelopeVersionCompressed, flags)
+}
+
+func sealEnvelopeWithHeader(t *testing.T, plainText []byte, chunkSize int, version byte, flags byte) []byte {
+	t.Helper()
+	header := make([]byte, envelopeHeaderSize)
+	copy(header, envelopeMagic)
+	header[8] = version
+	header[9] = algorithmAES256GCM
+	header[10] = flags
+	binary.BigEndian.PutUint32(header[12:16], uint32(chunkSize))
+	rand.Read(header[16:])
+	var prefix [noncePrefixSize]byte
+	copy(prefix[:], header[16:])
+
+	block, _ := aes.NewCipher(envelopeTestKey)
+	gcm, _ := cipher.NewGCM(block)
+
+	out := bytes.NewBuffer(header)
+	for counter := uint32(0); ; counter++ {
+		n := min(chunkSize, len(plainText))
+		final := n == len(plainText)
+		sealed := gcm.Seal(nil, chunkNonce(prefix, counter, final), plainText[:n], header)
+		binary.Write(out, binary.BigEndian, uint32(len(sealed)))
+		out.Write(sealed)
+		plainText = plainText[n:]
+		if final {
+			return out.Bytes()
+		}
+	}
+}
+
+func decryptToBuffer(data []byte) ([]byte, error) {
+	block, _ := aes.NewCipher(envelopeTestKey)
+	gcm, _ := cipher.NewGCM(block)
+	var out bytes.Buffer
+	err := decryptEnvelope(&out, bytes.NewReader(data), gcm)
+	return out.Bytes(), err
+}
+
+func TestDecryptSidecarEnvelope(t *testing.T) {
+	fs := fstest.MapFS{
+		"test_heap_dump.crypted": {Data: sidecarEnvelope},
+	}
+	testTargetFile := "/tmp/test_heap_dump_envelope"
+	defer cleanup(testTargetFile)
+	err := DecryptFile(fs, envelopeTestKey, "test_heap_dump.crypted", testTargetFile, "")
+	if err != nil {
+		t.Fatalf("Failed to decrypt envelope: %v", err)
+	}
+	clearText, _ := os.ReadFile(testTargetFile)
+	if string(clearText) != "asdfasdfasdf" {
+		t.Errorf("Unexpected decrypted data: want: %s, got %s", "asdfasdfasdf", string(clearText))
+	}
+}
+
+func TestDecryptEnvelopeChunks(t *testing.T) {
+	plainText := make([]byte, 1000)
+	rand.Read(plainText)
+	for _, size := range []int{0, 1, 99, 100, 101, 1000} {
+		got, err := decryptToBuffer(sealEnvelope(t, plainText[:size], 100))
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plainText[:size]) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestDecryptEnvelopeTruncated(t *testing.T) {
+	plainText := make([]byte, 1000)
+	rand.Read(plainText)
+	envelope := sealEnvelope(t, plainText, 100)
+	// drop the final chunk
+	lastChunk := 4 + 100 + 16
+	_, err := decryptToBuffer(envelope[:len(envelope)-lastChunk])
+	if err != ErrTruncated {
+		t.Errorf("got %v, want %v", err, ErrTruncated)
+	}
+	// cut in the middle of a chunk
+	_, err = decryptToBuffer(envelope[:len(envelope)-10])
+	if err != ErrTruncated {
+		t.Errorf("got %v, want %v", err, ErrTruncated)
+	}
+}
+
+func TestDecryptEnvelopeTampered(t *testing.T) {
+	envelope := bytes.Clone(sidecarEnvelope)
+	envelope[len(envelope)-1] ^= 1
+	_, err := decryptToBuffer(envelope)
+	if err == nil || !strings.Contains(err.Error(), "message authentication failed") {
+		t.Errorf("tampered chunk must not authenticate, got %v", err)
+	}
+
+	envelope = bytes.Clone(sidecarEnvelope)
+	envelope[20] ^= 1
+	_, err = decryptToBuffer(envelope)
+	if err == nil || !strings.Contains(err.Error(), "message authentication failed") {
+		t.Errorf("tampered header must not authenticate, got %v", err)
+	}
+
+	_, err = decryptToBuffer(append(bytes.Clone(sidecarEnvelope), 0))
+	if err == nil || !strings.Contains(err.Error(), "after final chunk") {
+		t.Errorf("trailing data must be rejected, got %v", err)
+	}
+}
+
+func TestDecryptEnvelopeBadHeader(t *testing.T) {
+	envelope := bytes.Clone(sidecarEnvelope)
+	envelope[8] = 3
+	_, err := decryptToBuffer(envelope)
+	if err == nil || !strings.Contains(err.Error(), "Unsupported envelope version 3") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDecryptEnvelopeVersions(t *testing.T) {
+	plainText := []byte("asdfasdfasdf")
+	// uncompressed dumps may be written as either version
+	for _, version := range []byte{envelopeVersion, envelopeVersionCompressed} {
+		got, err := decryptToBuffer(sealEnvelopeWithHeader(t, plainText, 100, version, compressionNone))
+		if err != nil || !bytes.Equal(got, plainText) {
+			t.Errorf("version %d: got %q, %v", version, got, err)
+		}
+	}
+	// the flags are reserved in version 1, compression needs version 2
+	_, err := decryptToBuffer(sealEnvelopeWithHeader(t, compress(t, plainText, compressionZstd), 100, envelopeVersion, compressionZstd))
+	if err == nil || !strings.Contains(err.Error(), "Unsupported envelope flags") {
+		t.Errorf("compression in a version 1 envelope must be rejected, got %v", err)
+	}
+}
+
+func compress(t *testing.T, plainText []byte, compression byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	switch compression {
+	case compressionGzip:
+		w := gzip.NewWriter(&out)
+		w.Write(plainText)
+		w.Close()
+	case compressionZstd:
+		w, _ := zstd.NewWriter(&out)
+		w.Write(plainText)
+		w.Close()
+	}
+	return out.Bytes()
+}
+
+func TestDecryptCompressedEnvelope(t *testing.T) {
+	plainText := bytes.Repeat([]byte("JAVA PROFILE 1.0.2"), 1000)
+	for _, compression := range []byte{compressionGzip, compressionZstd} {
+		envelope := sealEnvelopeWithFlags(t, compress(t, plainText, compression), 100, compression)
+		got, err := decryptToBuffer(envelope)
+		if err != nil {
+			t.Errorf("compression %d: %v", compression, err)
+		}
+		if !bytes.Equal(got, plainText) {
+			t.Errorf("compression %d: decompressed data does not match", compression)
+		}
+	}
+}
+
+func TestDecryptCompressedEnvelopeTruncated(t *testing.T) {
+	plainText := make([]byte, 1000)
+	rand.Read(plainText)
+	compressed := compress(t, plainText, compressionZstd)
+	envelope := sealEnvelopeWithFlags(t, compressed, 100, compressionZstd)
+	lastChunk := 4 + (len(compressed)-1)%100 + 1 + 16
+	_, err := decryptToBuffer(envelope[:len(envelope)-lastChunk])
+	if err != ErrTruncated {
+		t.Errorf("got %v, want %v", err, ErrTruncated)
+	}
+}
+
+func TestDecryptCompressedEnvelopeInvalid(t *testing.T) {
+	_, err := decryptToBuffer(sealEnvelopeWithFlags(t, []byte("not compressed at all"), 100, compressionGzip))
+	if err == nil || !strings.Contains(err.Error(), "Error decompressing heap dump") {
+		t.Errorf("got %v", err)
+	}
+
+	compressed := append(compress(t, []byte("asdfasdfasdf"), compressionGzip), 0)
+	_, err = decryptToBuffer(sealEnvelopeWithFlags(t, compressed, 100, compressionGzip))
+	if err == nil {
+		t.Errorf("trailing data after the compressed stream must be rejected")
+	}
+}
+
+func TestDecryptEnvelopeUnknownFlags(t *testing.T) {
+	for _, flags := range []byte{3, 4, 0x80} {
+		_, err := decryptToBuffer(sealEnvelopeWithFlags(t, []byte("asdf"), 100, flags))
+		if err == nil || !strings.Contains(err.Error(), "Unsupported envelope flags") {
+			t.Errorf("flags %d: got %v", flags, err)
+		}
+	}
+}
@@ -17,7 +17,7 @@ const docTemplate = `{
     "paths": {
         "/upload": {
             "post": {
-                "description": "Request a new Signed Upload URL for a specific file",
+                "description": "Request a new Signed Upload URL for a specific file.\nFiles larger than the multipart threshold get a multipart upload with one URL per part instead,\nwhich has to be finished with /upload/complete or /upload/abort.\nObjects with an artifact type are stored as \u003ctenant\u003e/\u003cnamespace\u003e/\u003cartifact-type\u003e/\u003cfilename\u003e.\nThe namespace defaults to the one of the ServiceAccount, other namespaces have to be allowed by the authorization policy.\nThe encrypted key is stored as \u003cobject\u003e.key, the manifest describing the dump as \u003cobject\u003e.manifest.json.\nWith the encrypted key from /upload/key and the checksums of the encrypted dump the checksums are signed\ninto the URLs and have to be sent as headers, S3 rejects uploads that do not match them.\nIf keys are wrapped by the client, the encrypted key is required and no plaintext key is ever returned.",
                 "consumes": [
                     "application/json"
                 ],
@@ -69,23 +69,328 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/ErrorResponse"
                         }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/upload/abort": {
+            "post": {
+                "description": "Abort a multipart upload and discard all uploaded parts",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Abort a multipart upload",
+                "parameters": [
+                    {
+                        "description": "Upload to abort",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/MultipartRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/StatusResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/upload/complete": {
+            "post": {
+                "description": "Complete a multipart upload with the ETags of all uploaded parts",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Complete a multipart upload",
+                "parameters": [
+                    {
+                        "description": "Upload to complete and its parts",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/MultipartRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/StatusResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/upload/key": {
+            "post": {
+                "description": "Request a new key to encrypt a heap dump with before requesting its upload URLs.\nThe checksums of the encrypted heap dump are signed into the upload URLs, so /upload can only be called\nonce the heap dump is encrypted. Pass the encrypted key to /upload then.\nA part size is returned if the heap dump is uploaded in parts, /upload expects the checksum of every part.\nIf keys are wrapped by the client, only the public key of the tenant is returned. Generate a key, wrap it\nwith RSA-OAEP and SHA-256 and pass it to /upload as vault:v\u003cwrapping-key-version\u003e:\u003cbase64 of the wrapped key\u003e.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Get an encryption key",
+                "parameters": [
+                    {
+                        "description": "Request a new encryption key",
+                        "name": "request",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/KeyRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/KeyResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Service Unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/ErrorResponse"
+                        }
                     }
                 }
             }
         }
     },
     "definitions": {
+        "CompletedPart": {
+            "type": "object",
+            "properties": {
+                "checksum-sha256": {
+                    "type": "string",
+                    "example": "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+                },
+                "etag": {
+                    "type": "string",
+                    "example": "\"d41d8cd98f00b204e9800998ecf8427e\""
+                },
+                "part-number": {
+                    "type": "integer",
+                    "example": 1
+                }
+            }
+        },
         "ErrorResponse": {
             "type": "object",
             "properties": {
                 "error": {
                     "type": "string"
+                },
+                "fields": {
+                    "description": "Fields lists the invalid fields of a bad request.",
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/FieldError"
+                    }
+                },
+                "reason": {
+                    "description": "Reason is set if the authorization policy denied the request or Vault\nor AWS are unavailable.",
+                    "type": "string",
+                    "example": "tenant"
+                }
+            }
+        },
+        "FieldError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "type": "string",
+                    "example": "tenant"
+                },
+                "message": {
+                    "type": "string",
+                    "example": "must be a DNS label of lower case letters, digits and '-'"
+                }
+            }
+        },
+        "KeyRequest": {
+            "type": "object",
+            "properties": {
+                "namespace": {
+                    "type": "string",
+                    "example": "beacon"
+                },
+                "size": {
+                    "type": "integer",
+                    "example": 21474836480
+                },
+                "tenant": {
+                    "type": "string",
+                    "example": "cloud-beacon"
+                }
+            }
+        },
+        "KeyResponse": {
+            "type": "object",
+            "properties": {
+                "aes-key": {
+                    "type": "string"
+                },
+                "encrypted-aes-key": {
+                    "type": "string"
+                },
+                "part-size": {
+                    "description": "PartSize is set if a dump of the requested size is uploaded in\nparts, /upload expects a checksum for each of them.",
+                    "type": "integer"
+                },
+                "wrapping-key": {
+                    "description": "WrappingKey is the PEM encoded RSA public key of the tenant, it is\nreturned instead of a key if keys are wrapped by the client. The key\nwrapped with RSA-OAEP and SHA-256 is passed to /upload as\nvault:v\u003cWrappingKeyVersion\u003e:\u003cbase64 of the wrapped key\u003e.",
+                    "type": "string"
+                },
+                "wrapping-key-version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "MultipartRequest": {
+            "type": "object",
+            "properties": {
+                "artifact-type": {
+                    "type": "string",
+                    "example": "hprof"
+                },
+                "filename": {
+                    "type": "string",
+                    "example": "test_file.dump"
+                },
+                "namespace": {
+                    "type": "string",
+                    "example": "beacon"
+                },
+                "parts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/CompletedPart"
+                    }
+                },
+                "tenant": {
+                    "type": "string",
+                    "example": "cloud-beacon"
+                },
+                "upload-id": {
+                    "type": "string",
+                    "example": "VXBsb2FkIElEIGZvciBlbHZpbmcncyBteS1tb3ZpZS5tMnRzIHVwbG9hZA"
                 }
             }
         },
         "SigningRequest": {
             "type": "object",
             "properties": {
+                "artifact-type": {
+                    "type": "string",
+                    "example": "hprof"
+                },
+                "checksum-sha256": {
+                    "description": "ChecksumSHA256 is the base64 encoded SHA-256 of the encrypted dump,\nPartChecksums those of its parts if it is uploaded in parts. S3\nrejects uploads that do not match them.",
+                    "type": "string",
+                    "example": "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+                },
+                "encrypted-aes-key": {
+                    "description": "EncryptedAesKey is the key from /upload/key the dump is encrypted\nwith, or the key wrapped by the client. Without it a new key is\ngenerated, unless keys are wrapped by the client.",
+                    "type": "string"
+                },
                 "filename": {
                     "type": "string",
                     "example": "test_file.dump"
@@ -94,9 +399,22 @@ const docTemplate = `{
                     "type": "string",
                     "example": "beacon"
                 },
+                "part-checksums": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "size": {
+                    "type": "integer",
+                    "example": 21474836480
+                },
                 "tenant": {
                     "type": "string",
                     "example": "cloud-beacon"
+                },
+                "validation": {
+                    "$ref": "#/definitions/Validation"
                 }
             }
         },
@@ -112,10 +430,69 @@ const docTemplate = `{
                 "encrypted-aes-key-url": {
                     "type": "string"
                 },
+                "head-url": {
+                    "description": "HeadURL tells whether the dump is stored, a client restarting an\ninterrupted upload checks it first.",
+                    "type": "string"
+                },
+                "headers": {
+                    "description": "Headers are signed with URL and have to be sent with the upload.",
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "string"
+                    }
+                },
+                "manifest-url": {
+                    "description": "ManifestURL takes the JSON manifest describing the dump.",
+                    "type": "string"
+                },
+                "part-headers": {
+                    "description": "PartHeaders are signed with the URL of the part at the same index.",
+                    "type": "array",
+                    "items": {
+                        "type": "object",
+                        "additionalProperties": {
+                            "type": "string"
+                        }
+                    }
+                },
+                "part-size": {
+                    "type": "integer"
+                },
+                "part-urls": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "upload-id": {
+                    "type": "string"
+                },
                 "url": {
                     "type": "string"
                 }
             }
+        },
+        "StatusResponse": {
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "string",
+                    "example": "ok"
+                }
+            }
+        },
+        "Validation": {
+            "type": "object",
+            "properties": {
+                "reason": {
+                    "type": "string",
+                    "example": "heap dump end record is missing"
+                },
+                "status": {
+                    "type": "string",
+                    "example": "truncated"
+                }
+            }
         }
     }
 }`
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// AuthorizationRule grants the ServiceAccounts it matches the right to
+// upload heap dumps for some tenants and namespaces. A rule matches a
+// ServiceAccount if every list it sets has an entry matching it, a rule
+// without any of them matches every ServiceAccount. All entries are glob
+// patterns as understood by path.Match.
+type AuthorizationRule struct {
+	// Namespaces and ServiceAccounts the ServiceAccount lives in and is
+	// named, Groups it is a member of
+	Namespaces      []string
+	ServiceAccounts []string
+	Groups          []string
+	// Tenants the ServiceAccount may upload for
+	Tenants []string
+	// UploadNamespaces the ServiceAccount may upload for. Without any it may
+	// only upload for its own namespace.
+	UploadNamespaces []string
+}
+
+func validateAuthorization(rules []AuthorizationRule) error {
+	for i, rule := range rules {
+		if len(rule.Tenants) == 0 {
+			return errors.New(fmt.Sprintf("Authorization rule %d grants no tenants", i))
+		}
+		for _, patterns := range [][]string{rule.Namespaces, rule.ServiceAccounts, rule.Groups, rule.Tenants, rule.UploadNamespaces} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return errors.New(fmt.Sprintf("Authorization rule %d has an invalid pattern %q: %s", i, pattern, err.Error()))
+				}
+			}
+		}
+	}
+	return nil
+}
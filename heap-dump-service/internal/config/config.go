@@ -27,8 +27,33 @@ type AppConfig struct {
 	ServiceAccount struct {
 		JWTokenMountPoint string
 	}
+	Multipart struct {
+		ThresholdBytes int64
+		PartSizeBytes  int64
+	}
+	KeyWrapping struct {
+		Mode string
+	}
+	// Authorization decides which ServiceAccounts may upload for which
+	// tenants and namespaces. Without rules every ServiceAccount may upload
+	// for any tenant, but only for its own namespace.
+	Authorization struct {
+		Rules []AuthorizationRule
+		// NamespaceMismatch decides what happens to requests for another
+		// namespace than the one of the ServiceAccount that no rule allows:
+		// "reject" (default) or "override" with the ServiceAccount's one.
+		NamespaceMismatch string
+	}
 }
 
+// NamespaceMismatchOverride replaces the namespace of a request with the one
+// of the ServiceAccount instead of rejecting it.
+const NamespaceMismatchOverride = "override"
+
+// KeyWrappingClient makes the sidecar generate and wrap the data keys with
+// the public key of the tenant, the service never sees a plaintext key.
+const KeyWrappingClient = "client"
+
 func LoadConfigFromEnvironment(envVarName string) (AppConfig, error) {
 	configFile, found := os.LookupEnv(envVarName)
 	var appConfig AppConfig
@@ -60,5 +85,25 @@ func LoadConfigFromFile(configFile string) (AppConfig, error) {
 		}).Warnf(fmt.Sprintf("Failed to parse json data of file '%v': %v", configFile, err))
 		return appConfig, errors.New(fmt.Sprintf("Failed to parse json data of file '%v': %v", configFile, err.Error()))
 	}
+	if err := validate(&appConfig); err != nil {
+		log.WithFields(log.Fields{
+			"caller": "LoadConfigFromEnvironment",
+		}).Warnf(fmt.Sprintf("Invalid config file '%v': %v", configFile, err))
+		return appConfig, errors.New(fmt.Sprintf("Invalid config file '%v': %v", configFile, err.Error()))
+	}
 	return appConfig, nil
 }
+
+func validate(appConfig *AppConfig) error {
+	switch appConfig.KeyWrapping.Mode {
+	case "", "service", KeyWrappingClient:
+	default:
+		return errors.New(fmt.Sprintf("KeyWrapping.mode must be \"service\" or \"client\", got \"%s\"", appConfig.KeyWrapping.Mode))
+	}
+	switch appConfig.Authorization.NamespaceMismatch {
+	case "", "reject", NamespaceMismatchOverride:
+	default:
+		return errors.New(fmt.Sprintf("Authorization.namespaceMismatch must be \"reject\" or \"override\", got \"%s\"", appConfig.Authorization.NamespaceMismatch))
+	}
+	return validateAuthorization(appConfig.Authorization.Rules)
+}
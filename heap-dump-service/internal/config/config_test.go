@@ -103,3 +103,33 @@ func TestFailNoConfigEnv(t *testing.T) {
 		t.Errorf("got %+v, want %+v", got, want)
 	}
 }
+
+func TestValidateKeyWrapping(t *testing.T) {
+	for mode, valid := range map[string]bool{"": true, "service": true, "client": true, "vault": false} {
+		var appConfig AppConfig
+		appConfig.KeyWrapping.Mode = mode
+		if err := validate(&appConfig); (err == nil) != valid {
+			t.Errorf("mode %q: got %v", mode, err)
+		}
+	}
+}
+
+func TestValidateAuthorization(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []AuthorizationRule
+		valid bool
+	}{
+		{"no rules", nil, true},
+		{"patterns", []AuthorizationRule{{Namespaces: []string{"team-a-*"}, Tenants: []string{"team-a"}}}, true},
+		{"no tenants", []AuthorizationRule{{Namespaces: []string{"team-a"}}}, false},
+		{"invalid pattern", []AuthorizationRule{{Namespaces: []string{"team-["}, Tenants: []string{"team-a"}}}, false},
+	}
+	for _, tc := range cases {
+		var appConfig AppConfig
+		appConfig.Authorization.Rules = tc.rules
+		if err := validate(&appConfig); (err == nil) != tc.valid {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
@@ -41,6 +41,12 @@ func JSONLogMiddleware() gin.HandlerFunc {
 			"status":   c.Writer.Status(),
 			"referrer": c.Request.Referer(),
 		})
+		// SaAuth stores who the request was authenticated as
+		if identity, found := c.Get("identity"); found {
+			if fields, ok := identity.(interface{ LogFields() log.Fields }); ok {
+				entry = entry.WithFields(fields.LogFields())
+			}
+		}
 
 		if c.Writer.Status() >= 500 {
 			entry.Error(c.Errors.String())
@@ -17,8 +17,42 @@ var HeapDumpHandled = prometheus.NewCounterVec(
 	[]string{"namespace", "tenant"},
 )
 
+// DeniedRequests counts requests the authorization policy denied, by the
+// namespace of the ServiceAccount and the reason.
+var DeniedRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "denied_requests",
+		Namespace: "heap_dump_service",
+		Help:      "Number of requests denied by the authorization policy",
+	},
+	[]string{"namespace", "reason"},
+)
+
+// VaultLoginFailures counts failed Kubernetes auth logins to Vault, the
+// service keeps retrying them with a backoff.
+var VaultLoginFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name:      "vault_login_failures",
+		Namespace: "heap_dump_service",
+		Help:      "Number of failed logins to Vault",
+	},
+)
+
+// VaultRenewalFailures counts Vault tokens that could not be renewed, the
+// service logs in again for each of them.
+var VaultRenewalFailures = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name:      "vault_renewal_failures",
+		Namespace: "heap_dump_service",
+		Help:      "Number of failed Vault token renewals",
+	},
+)
+
 func init() {
 	prometheus.MustRegister(HeapDumpHandled)
+	prometheus.MustRegister(DeniedRequests)
+	prometheus.MustRegister(VaultLoginFailures)
+	prometheus.MustRegister(VaultRenewalFailures)
 }
 
 func StartMetricServer(port int, path string) {
@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/gin-gonic/gin"
+	"github.com/shaj13/go-guardian/v2/auth"
+	log "github.com/sirupsen/logrus"
+)
+
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// Reasons a request is denied for, they label the denied requests metric.
+const (
+	DeniedUnknownIdentity = "unknown-identity"
+	DeniedTenant          = "tenant"
+	DeniedNamespace       = "namespace"
+	// DeniedNamespaceMismatch is the reason without rules, a request for
+	// another namespace than the one of the ServiceAccount
+	DeniedNamespaceMismatch = "namespace-mismatch"
+)
+
+// Extensions of bound ServiceAccount tokens naming the pod they were issued
+// for.
+const (
+	podNameExtension = "authentication.kubernetes.io/pod-name"
+	podUIDExtension  = "authentication.kubernetes.io/pod-uid"
+)
+
+// Identity is the ServiceAccount a request was authenticated as. The pod is
+// only known for bound tokens, e.g. projected ServiceAccount tokens.
+type Identity struct {
+	Username       string
+	Namespace      string
+	ServiceAccount string
+	Groups         []string
+	PodName        string
+	PodUID         string
+}
+
+// LogFields describe the identity in log entries.
+func (identity Identity) LogFields() log.Fields {
+	fields := log.Fields{"user": identity.Username}
+	if identity.ServiceAccount != "" {
+		fields["namespace"] = identity.Namespace
+		fields["serviceAccount"] = identity.ServiceAccount
+	}
+	if identity.PodName != "" {
+		fields["pod"] = identity.PodName
+		fields["podUID"] = identity.PodUID
+	}
+	return fields
+}
+
+func (identity Identity) String() string {
+	if identity.ServiceAccount == "" {
+		return identity.Username
+	}
+	return fmt.Sprintf("ServiceAccount %s/%s", identity.Namespace, identity.ServiceAccount)
+}
+
+// identityFromInfo reads the ServiceAccount from the user name of a
+// TokenReview, system:serviceaccount:<namespace>:<name>, and the pod from
+// the extra info of bound tokens.
+func identityFromInfo(info auth.Info) Identity {
+	identity := Identity{
+		Username: info.GetUserName(),
+		Groups:   info.GetGroups(),
+		PodName:  info.GetExtensions().Get(podNameExtension),
+		PodUID:   info.GetExtensions().Get(podUIDExtension),
+	}
+	if namespace, name, found := strings.Cut(strings.TrimPrefix(identity.Username, serviceAccountPrefix), ":"); found && strings.HasPrefix(identity.Username, serviceAccountPrefix) {
+		identity.Namespace = namespace
+		identity.ServiceAccount = name
+	}
+	return identity
+}
+
+// Denial tells why an identity may not upload for a tenant and namespace.
+type Denial struct {
+	Reason  string
+	Message string
+}
+
+func (d *Denial) Error() string {
+	return d.Message
+}
+
+// Authorize checks whether identity may upload for tenant and namespace. It
+// returns a *Denial if none of the rules grants it. Without rules a
+// ServiceAccount may only upload for its own namespace and the tenant named
+// like it, any other tenant has to be granted by a rule.
+func Authorize(rules []config.AuthorizationRule, identity Identity, tenant string, namespace string) error {
+	if len(rules) == 0 {
+		if identity.ServiceAccount == "" {
+			return &Denial{
+				Reason:  DeniedUnknownIdentity,
+				Message: fmt.Sprintf("%s is no ServiceAccount", identity),
+			}
+		}
+		if tenant != identity.Namespace {
+			return &Denial{
+				Reason:  DeniedTenant,
+				Message: fmt.Sprintf("%s may not upload heap dumps for tenant %s, no authorization rules are configured", identity, tenant),
+			}
+		}
+		if namespace != identity.Namespace {
+			return &Denial{
+				Reason:  DeniedNamespaceMismatch,
+				Message: fmt.Sprintf("%s may not upload heap dumps for namespace %s", identity, namespace),
+			}
+		}
+		return nil
+	}
+	denial := &Denial{
+		Reason:  DeniedUnknownIdentity,
+		Message: fmt.Sprintf("%s may not upload heap dumps", identity),
+	}
+	for _, rule := range rules {
+		if !ruleMatches(rule, identity) {
+			continue
+		}
+		if !anyMatches(rule.Tenants, tenant) {
+			if denial.Reason == DeniedUnknownIdentity {
+				denial.Reason = DeniedTenant
+				denial.Message = fmt.Sprintf("%s may not upload heap dumps for tenant %s", identity, tenant)
+			}
+			continue
+		}
+		uploadNamespaces := rule.UploadNamespaces
+		if len(uploadNamespaces) == 0 {
+			uploadNamespaces = []string{identity.Namespace}
+		}
+		if !anyMatches(uploadNamespaces, namespace) {
+			denial.Reason = DeniedNamespace
+			denial.Message = fmt.Sprintf("%s may not upload heap dumps for namespace %s of tenant %s", identity, namespace, tenant)
+			continue
+		}
+		return nil
+	}
+	return denial
+}
+
+func ruleMatches(rule config.AuthorizationRule, identity Identity) bool {
+	if len(rule.Namespaces) > 0 && !anyMatches(rule.Namespaces, identity.Namespace) {
+		return false
+	}
+	if len(rule.ServiceAccounts) > 0 && !anyMatches(rule.ServiceAccounts, identity.ServiceAccount) {
+		return false
+	}
+	if len(rule.Groups) > 0 {
+		for _, group := range identity.Groups {
+			if anyMatches(rule.Groups, group) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// anyMatches tells whether any of the patterns matches value. Patterns were
+// validated when the config was loaded.
+func anyMatches(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// IdentityFromContext returns the identity SaAuth authenticated the request
+// as.
+func IdentityFromContext(c *gin.Context) (Identity, error) {
+	value, found := c.Get("identity")
+	identity, ok := value.(Identity)
+	if !found || !ok {
+		return Identity{}, errors.New("Request is not authenticated")
+	}
+	return identity, nil
+}
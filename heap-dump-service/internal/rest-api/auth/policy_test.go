@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/shaj13/go-guardian/v2/auth"
+)
+
+func TestIdentityFromInfo(t *testing.T) {
+	got := identityFromInfo(auth.NewUserInfo("system:serviceaccount:platform:java-app", "uid", []string{"system:serviceaccounts"}, nil))
+	want := Identity{
+		Username:       "system:serviceaccount:platform:java-app",
+		Namespace:      "platform",
+		ServiceAccount: "java-app",
+		Groups:         []string{"system:serviceaccounts"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// bound tokens name the pod
+	got = identityFromInfo(auth.NewUserInfo("system:serviceaccount:platform:java-app", "uid", nil, auth.Extensions{
+		"authentication.kubernetes.io/pod-name": {"java-app-7d9f"},
+		"authentication.kubernetes.io/pod-uid":  {"0b5a2a3c"},
+	}))
+	if got.PodName != "java-app-7d9f" || got.PodUID != "0b5a2a3c" {
+		t.Errorf("pod has to be taken from the token, got %+v", got)
+	}
+
+	got = identityFromInfo(auth.NewUserInfo("jane", "uid", nil, nil))
+	if got.Namespace != "" || got.ServiceAccount != "" {
+		t.Errorf("users are no ServiceAccounts, got %+v", got)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	rules := []config.AuthorizationRule{
+		// every ServiceAccount of the team may upload for its own namespace
+		{Namespaces: []string{"team-a-*"}, Tenants: []string{"team-a"}},
+		// the platform may upload for all namespaces of its tenant
+		{Namespaces: []string{"platform"}, ServiceAccounts: []string{"uploader"}, Tenants: []string{"platform"}, UploadNamespaces: []string{"*"}},
+		{Groups: []string{"system:serviceaccounts:shared"}, Tenants: []string{"shared"}, UploadNamespaces: []string{"shared-*"}},
+	}
+	teamA := Identity{Namespace: "team-a-dev", ServiceAccount: "default"}
+	uploader := Identity{Namespace: "platform", ServiceAccount: "uploader"}
+	shared := Identity{Namespace: "tools", ServiceAccount: "default", Groups: []string{"system:serviceaccounts", "system:serviceaccounts:shared"}}
+	cases := []struct {
+		name      string
+		identity  Identity
+		tenant    string
+		namespace string
+		reason    string
+	}{
+		{"own namespace", teamA, "team-a", "team-a-dev", ""},
+		{"other tenant", teamA, "platform", "team-a-dev", DeniedTenant},
+		{"other namespace", teamA, "team-a", "team-a-prod", DeniedNamespace},
+		{"any namespace", uploader, "platform", "team-a-dev", ""},
+		{"other service account", Identity{Namespace: "platform", ServiceAccount: "default"}, "platform", "platform", DeniedUnknownIdentity},
+		{"group", shared, "shared", "shared-tools", ""},
+		{"group other namespace", shared, "shared", "tools", DeniedNamespace},
+		{"unknown", Identity{Namespace: "other", ServiceAccount: "default"}, "team-a", "other", DeniedUnknownIdentity},
+	}
+	for _, tc := range cases {
+		err := Authorize(rules, tc.identity, tc.tenant, tc.namespace)
+		var denial *Denial
+		switch {
+		case tc.reason == "" && err != nil:
+			t.Errorf("%s: has to be allowed, got %v", tc.name, err)
+		case tc.reason != "" && !errors.As(err, &denial):
+			t.Errorf("%s: has to be denied, got %v", tc.name, err)
+		case tc.reason != "" && denial.Reason != tc.reason:
+			t.Errorf("%s: got reason %s, want %s", tc.name, denial.Reason, tc.reason)
+		}
+	}
+
+}
+
+func TestAuthorizeWithoutRules(t *testing.T) {
+	identity := Identity{Namespace: "team-a", ServiceAccount: "default"}
+	if err := Authorize(nil, identity, "team-a", "team-a"); err != nil {
+		t.Errorf("without rules the tenant of the own namespace is allowed, got %v", err)
+	}
+	var denial *Denial
+	if err := Authorize(nil, identity, "team-b", "team-a"); !errors.As(err, &denial) || denial.Reason != DeniedTenant {
+		t.Errorf("other tenants have to be denied, got %v", err)
+	}
+	if err := Authorize(nil, identity, "team-a", "team-b"); !errors.As(err, &denial) || denial.Reason != DeniedNamespaceMismatch {
+		t.Errorf("other namespaces have to be denied, got %v", err)
+	}
+	if err := Authorize(nil, Identity{Username: "jane"}, "any", ""); !errors.As(err, &denial) || denial.Reason != DeniedUnknownIdentity {
+		t.Errorf("users have to be denied, got %v", err)
+	}
+}
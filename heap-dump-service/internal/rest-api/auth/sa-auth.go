@@ -72,7 +72,7 @@ func SaAuth(c *gin.Context) {
 
 	strategy := setupGoGuardian(token)
 
-	_, err = strategy.Authenticate(c, c.Request)
+	info, err := strategy.Authenticate(c, c.Request)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"caller": "SaAuth",
@@ -82,4 +82,5 @@ func SaAuth(c *gin.Context) {
 		c.Writer.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
 		return
 	}
+	c.Set("identity", identityFromInfo(info))
 }
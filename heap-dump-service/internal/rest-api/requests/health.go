@@ -1,33 +1,54 @@
 package requests
 
 import (
-	"fmt"
 	"net/http"
 
-	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
 )
 
+// HealthResponse tells whether the service is ready and, if not, why Vault
+// or AWS can not be used.
+type HealthResponse struct {
+	Status string `json:"status"`
+	Vault  string `json:"vault,omitempty"`
+	AWS    string `json:"aws,omitempty"`
+}
+
+// Health is the readiness probe. It fails with 503 while Vault or AWS can
+// not be used, so no requests are routed to the pod until they recover.
 func Health(c *gin.Context) {
-	cfg := c.MustGet("cfg").(*config.AppConfig)
-	client, err := utils.GenerateVaultClient(cfg.Vault.VaultRole, cfg.Vault.VaultAuthMountPath, cfg.ServiceAccount.JWTokenMountPoint)
+	clients := c.MustGet("clients").(*utils.Clients)
+	response := HealthResponse{Status: "ok"}
+
+	err := utils.CheckAWSAccess(clients.S3.Session())
+	if err == nil {
+		_, err = clients.S3.Client()
+	}
 	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "Health",
-		}).Fatalf(fmt.Sprintf("unable to initialize Vanilla Vault Client : %s", err.Error()))
+		response.AWS = err.Error()
 	}
 
-	err = utils.CheckAWSAccess()
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+	vaultClient, err := clients.Vault.Client()
+	if err == nil {
+		err = utils.CheckVaultAccess(vaultClient.Client)
 	}
-	err = utils.CheckVaultAccess(client)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		response.Vault = err.Error()
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+
+	if response.AWS != "" || response.Vault != "" {
+		response.Status = "unavailable"
+		log.WithFields(log.Fields{
+			"caller": "Health",
+			"aws":    response.AWS,
+			"vault":  response.Vault,
+		}).Warn("Not ready")
+		c.JSON(http.StatusServiceUnavailable, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func Liveness(c *gin.Context) {
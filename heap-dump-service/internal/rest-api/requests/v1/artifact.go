@@ -0,0 +1,30 @@
+package v1
+
+import "fmt"
+
+// artifactTypes are the artifact types the notify-sidecar detects. Objects
+// of each type are stored under their own prefix.
+var artifactTypes = []string{"hprof", "hprof.gz", "pprof", "gcdump", "heapsnapshot", "core"}
+
+// validArtifactType accepts the known artifact types and no type at all,
+// which older sidecars send.
+func validArtifactType(artifactType string) bool {
+	if artifactType == "" {
+		return true
+	}
+	for _, known := range artifactTypes {
+		if known == artifactType {
+			return true
+		}
+	}
+	return false
+}
+
+// objectKey returns the key of an uploaded object. Requests without an
+// artifact type keep the layout of older sidecars.
+func objectKey(tenant string, namespace string, artifactType string, fileName string) string {
+	if artifactType == "" {
+		return fmt.Sprintf("%s/%s/%s", tenant, namespace, fileName)
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", tenant, namespace, artifactType, fileName)
+}
@@ -0,0 +1,32 @@
+package v1
+
+import "testing"
+
+func TestObjectKey(t *testing.T) {
+	cases := []struct {
+		artifactType string
+		want         string
+	}{
+		{"", "tenant/ns/pod-dump.hprof.crypted"},
+		{"hprof", "tenant/ns/hprof/pod-dump.hprof.crypted"},
+		{"core", "tenant/ns/core/pod-dump.hprof.crypted"},
+	}
+	for _, tc := range cases {
+		if got := objectKey("tenant", "ns", tc.artifactType, "pod-dump.hprof.crypted"); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
+
+func TestValidArtifactType(t *testing.T) {
+	for _, artifactType := range append([]string{""}, artifactTypes...) {
+		if !validArtifactType(artifactType) {
+			t.Errorf("%q should be valid", artifactType)
+		}
+	}
+	for _, artifactType := range []string{"zip", "HPROF", "../hprof"} {
+		if validArtifactType(artifactType) {
+			t.Errorf("%q should be rejected", artifactType)
+		}
+	}
+}
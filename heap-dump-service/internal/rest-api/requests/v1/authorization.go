@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/metrics"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// authorize checks the authorization policy for an upload for tenant and
+// namespace and returns the namespace to upload for. Requests without a
+// namespace upload for the one of the ServiceAccount, requests for another
+// namespace no rule allows are rejected or, with
+// Authorization.namespaceMismatch "override", redirected to the
+// ServiceAccount's namespace. Denied requests are answered with 403 and
+// counted.
+func authorize(c *gin.Context, tenant string, namespace string) (string, bool) {
+	cfg := c.MustGet("cfg").(*config.AppConfig)
+
+	identity, err := auth.IdentityFromContext(c)
+	if err == nil {
+		if namespace == "" {
+			namespace = identity.Namespace
+		}
+		err = auth.Authorize(cfg.Authorization.Rules, identity, tenant, namespace)
+	}
+	if err != nil && identity.ServiceAccount != "" && namespace != identity.Namespace && cfg.Authorization.NamespaceMismatch == config.NamespaceMismatchOverride {
+		log.WithFields(identity.LogFields()).WithFields(log.Fields{
+			"caller": "authorize",
+		}).Warn(fmt.Sprintf("Uploading for namespace %s instead of %s: %s", identity.Namespace, namespace, err.Error()))
+		namespace = identity.Namespace
+		err = auth.Authorize(cfg.Authorization.Rules, identity, tenant, namespace)
+	}
+	if err == nil {
+		return namespace, true
+	}
+
+	reason := auth.DeniedUnknownIdentity
+	var denial *auth.Denial
+	if errors.As(err, &denial) {
+		reason = denial.Reason
+	}
+	log.WithFields(identity.LogFields()).WithFields(log.Fields{
+		"caller": "authorize",
+	}).Warn(fmt.Sprintf("Denied request: %s", err.Error()))
+	metrics.DeniedRequests.WithLabelValues(strings.ReplaceAll(identity.Namespace, "-", "_"), reason).Inc()
+	c.JSON(http.StatusForbidden, ErrorResponse{
+		Error:  err.Error(),
+		Reason: reason,
+	})
+	return "", false
+}
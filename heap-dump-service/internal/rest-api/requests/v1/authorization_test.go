@@ -0,0 +1,91 @@
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/metrics"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAuthorizeRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.AppConfig{}
+	cfg.Authorization.Rules = []config.AuthorizationRule{{Namespaces: []string{"team-a"}, Tenants: []string{"team-a"}}}
+	identity := auth.Identity{Namespace: "team-a", ServiceAccount: "default"}
+
+	newContext := func() (*gin.Context, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Set("cfg", cfg)
+		c.Set("identity", identity)
+		return c, recorder
+	}
+
+	c, recorder := newContext()
+	if namespace, ok := authorize(c, "team-a", "team-a"); !ok || namespace != "team-a" || recorder.Code != http.StatusOK {
+		t.Errorf("upload for the own namespace has to be allowed, got %d", recorder.Code)
+	}
+
+	denied := testutil.ToFloat64(metrics.DeniedRequests.WithLabelValues("team_a", auth.DeniedTenant))
+	c, recorder = newContext()
+	if _, ok := authorize(c, "team-b", "team-a"); ok {
+		t.Errorf("upload for another tenant has to be denied")
+	}
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	var response ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if response.Reason != auth.DeniedTenant || response.Error == "" {
+		t.Errorf("the reason has to be returned, got %+v", response)
+	}
+	if got := testutil.ToFloat64(metrics.DeniedRequests.WithLabelValues("team_a", auth.DeniedTenant)); got != denied+1 {
+		t.Errorf("denied request has to be counted, got %v", got-denied)
+	}
+
+	// requests SaAuth did not authenticate are denied
+	c, recorder = newContext()
+	c.Keys["identity"] = nil
+	if _, ok := authorize(c, "team-a", "team-a"); ok || recorder.Code != http.StatusForbidden {
+		t.Errorf("unauthenticated request has to be denied, got %d", recorder.Code)
+	}
+}
+
+func TestAuthorizeNamespace(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := &config.AppConfig{}
+	identity := auth.Identity{Namespace: "team-a", ServiceAccount: "default", PodName: "java-app-7d9f"}
+	authorizeNamespace := func(namespace string) (string, bool, int) {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Set("cfg", cfg)
+		c.Set("identity", identity)
+		got, ok := authorize(c, "team-a", namespace)
+		return got, ok, recorder.Code
+	}
+
+	if got, ok, _ := authorizeNamespace(""); !ok || got != "team-a" {
+		t.Errorf("the namespace has to be taken from the ServiceAccount, got %s", got)
+	}
+	if _, ok, code := authorizeNamespace("team-b"); ok || code != http.StatusForbidden {
+		t.Errorf("another namespace has to be rejected, got %d", code)
+	}
+
+	cfg.Authorization.NamespaceMismatch = config.NamespaceMismatchOverride
+	if got, ok, _ := authorizeNamespace("team-b"); !ok || got != "team-a" {
+		t.Errorf("the namespace has to be overridden, got %s", got)
+	}
+
+	// a rule may allow other namespaces
+	cfg.Authorization.NamespaceMismatch = ""
+	cfg.Authorization.Rules = []config.AuthorizationRule{{Namespaces: []string{"team-a"}, Tenants: []string{"team-a"}, UploadNamespaces: []string{"team-*"}}}
+	if got, ok, _ := authorizeNamespace("team-b"); !ok || got != "team-b" {
+		t.Errorf("namespaces allowed by a rule have to be kept, got %s", got)
+	}
+}
@@ -0,0 +1,32 @@
+package v1
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons of 503 replies, the request may be retried later.
+const (
+	ReasonVaultUnavailable = "vault-unavailable"
+	ReasonAWSUnavailable   = "aws-unavailable"
+)
+
+// serverError answers a request the service failed to handle. Vault or AWS
+// not being reachable is answered with 503 and named as reason, anything
+// else with 500.
+func serverError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	response := ErrorResponse{Error: err.Error()}
+	switch {
+	case errors.Is(err, utils.ErrVaultUnavailable):
+		status = http.StatusServiceUnavailable
+		response.Reason = ReasonVaultUnavailable
+	case errors.Is(err, utils.ErrAWSUnavailable):
+		status = http.StatusServiceUnavailable
+		response.Reason = ReasonAWSUnavailable
+	}
+	c.JSON(status, response)
+}
@@ -0,0 +1,41 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestServerError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		reason string
+	}{
+		{"vault unavailable", fmt.Errorf("%w, not logged in", utils.ErrVaultUnavailable), http.StatusServiceUnavailable, ReasonVaultUnavailable},
+		{"aws unavailable", fmt.Errorf("Error initializing the AWS awsClient: %w", utils.ErrAWSUnavailable), http.StatusServiceUnavailable, ReasonAWSUnavailable},
+		{"other error", errors.New("Error encrypting password"), http.StatusInternalServerError, ""},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		serverError(c, test.err)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		var response ErrorResponse
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if response.Reason != test.reason || response.Error != test.err.Error() {
+			t.Errorf("%s: got %+v", test.name, response)
+		}
+	}
+}
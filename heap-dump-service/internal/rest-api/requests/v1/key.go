@@ -0,0 +1,155 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type KeyRequest struct {
+	Tenant    string `json:"tenant" example:"cloud-beacon"`
+	Namespace string `json:"namespace" example:"beacon"`
+	Size      int64  `json:"size,omitempty" example:"21474836480"`
+} // @name KeyRequest
+
+type KeyResponse struct {
+	AesKey          string `json:"aes-key,omitempty"`
+	EncryptedAesKey string `json:"encrypted-aes-key,omitempty"`
+	// WrappingKey is the PEM encoded RSA public key of the tenant, it is
+	// returned instead of a key if keys are wrapped by the client. The key
+	// wrapped with RSA-OAEP and SHA-256 is passed to /upload as
+	// vault:v<WrappingKeyVersion>:<base64 of the wrapped key>.
+	WrappingKey        string `json:"wrapping-key,omitempty"`
+	WrappingKeyVersion int    `json:"wrapping-key-version,omitempty"`
+	// PartSize is set if a dump of the requested size is uploaded in
+	// parts, /upload expects a checksum for each of them.
+	PartSize int64 `json:"part-size,omitempty"`
+} // @name KeyResponse
+
+// generateDataKey returns a new AES key for tenant, base64 encoded in plain
+// and encrypted with the tenant's Vault transit key.
+func generateDataKey(vault *utils.VaultSession, cfg *config.AppConfig, tenant string) (string, string, error) {
+	vaultClient, err := vault.Client()
+	if err != nil {
+		return "", "", err
+	}
+
+	aesKey, err := utils.GenerateRandomBytes(32)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error generating password: %s", err.Error()))
+	}
+	encodedAesKey := utils.EncodeKey(aesKey)
+	encryptedAesKey, err := utils.TransitEncryptString(vaultClient, cfg.Vault.VaultTransitMount, tenant, encodedAesKey)
+	if err != nil {
+		return "", "", fmt.Errorf("Error encrypting password: %w", err)
+	}
+	return encodedAesKey, encryptedAesKey, nil
+}
+
+// clientKeyWrapping tells whether clients generate and wrap their keys
+// themselves, the service never hands out a plaintext key then.
+func clientKeyWrapping(cfg *config.AppConfig) bool {
+	return cfg.KeyWrapping.Mode == config.KeyWrappingClient
+}
+
+// wrappingKey returns the public key of tenant's transit key and its version.
+func wrappingKey(vault *utils.VaultSession, cfg *config.AppConfig, tenant string) (string, int, error) {
+	vaultClient, err := vault.Client()
+	if err != nil {
+		return "", 0, err
+	}
+	return utils.TransitPublicKey(vaultClient, cfg.Vault.VaultTransitMount, tenant)
+}
+
+// @BasePath /api/v1
+
+// @Summary Get an encryption key
+// @Schemes http https
+// @Description Request a new key to encrypt a heap dump with before requesting its upload URLs.
+// @Description The checksums of the encrypted heap dump are signed into the upload URLs, so /upload can only be called
+// @Description once the heap dump is encrypted. Pass the encrypted key to /upload then.
+// @Description A part size is returned if the heap dump is uploaded in parts, /upload expects the checksum of every part.
+// @Description If keys are wrapped by the client, only the public key of the tenant is returned. Generate a key, wrap it
+// @Description with RSA-OAEP and SHA-256 and pass it to /upload as vault:v<wrapping-key-version>:<base64 of the wrapped key>.
+// @Tags v1
+// @param request body KeyRequest true "Request a new encryption key"
+// @Accept json
+// @Produce json
+// @securityDefinitions.apikey ApiKeyAuth
+// @Success      200  {object}  KeyResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure		 403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Failure      503  {object}  ErrorResponse
+// @Router /upload/key [post]
+func HandleRequestKey(c *gin.Context) {
+	cfg := c.MustGet("cfg").(*config.AppConfig)
+
+	var requestBody KeyRequest
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Could not Unmarshal request body %s", err.Error()),
+		})
+		return
+	}
+
+	if err := requestBody.validate(); err != nil {
+		badRequest(c, err)
+		return
+	}
+
+	namespace, ok := authorize(c, requestBody.Tenant, requestBody.Namespace)
+	if !ok {
+		return
+	}
+	requestBody.Namespace = namespace
+	clients := c.MustGet("clients").(*utils.Clients)
+
+	var partSize int64
+	if requestBody.Size > multipartThreshold(cfg) {
+		var err error
+		partSize, _, err = partLayout(requestBody.Size, cfg.Multipart.PartSizeBytes)
+		if err != nil {
+			badRequest(c, fieldError("size", err.Error()))
+			return
+		}
+	}
+
+	if clientKeyWrapping(cfg) {
+		publicKey, version, err := wrappingKey(clients.Vault, cfg, requestBody.Tenant)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"caller": "HandleRequestKey",
+			}).Error(err.Error())
+			serverError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, KeyResponse{
+			WrappingKey:        publicKey,
+			WrappingKeyVersion: version,
+			PartSize:           partSize,
+		})
+		return
+	}
+
+	aesKey, encryptedAesKey, err := generateDataKey(clients.Vault, cfg, requestBody.Tenant)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "HandleRequestKey",
+		}).Error(err.Error())
+		serverError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, KeyResponse{
+		AesKey:          aesKey,
+		EncryptedAesKey: encryptedAesKey,
+		PartSize:        partSize,
+	})
+}
@@ -0,0 +1,286 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMultipartThreshold = 1024 * 1024 * 1024 // 1 GiB
+	defaultPartSize           = 64 * 1024 * 1024   // 64 MiB
+	minPartSize               = 5 * 1024 * 1024    // S3 minimum for all but the last part
+	maxParts                  = 10000
+	maxObjectSize             = 5 * 1024 * 1024 * 1024 * 1024
+	multipartURLExpiry        = 60 * time.Minute
+)
+
+type CompletedPart struct {
+	PartNumber     int64  `json:"part-number" example:"1"`
+	ETag           string `json:"etag" example:"\"d41d8cd98f00b204e9800998ecf8427e\""`
+	ChecksumSHA256 string `json:"checksum-sha256,omitempty" example:"n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="`
+} // @name CompletedPart
+
+type MultipartRequest struct {
+	Tenant       string          `json:"tenant" example:"cloud-beacon"`
+	Namespace    string          `json:"namespace" example:"beacon"`
+	FileName     string          `json:"filename" example:"test_file.dump"`
+	ArtifactType string          `json:"artifact-type,omitempty" example:"hprof"`
+	UploadID     string          `json:"upload-id" example:"VXBsb2FkIElEIGZvciBlbHZpbmcncyBteS1tb3ZpZS5tMnRzIHVwbG9hZA"`
+	Parts        []CompletedPart `json:"parts,omitempty"`
+} // @name MultipartRequest
+
+type StatusResponse struct {
+	Status string `json:"status" example:"ok"`
+} // @name StatusResponse
+
+type multipartUpload struct {
+	UploadID    string
+	PartSize    int64
+	PartURLs    []string
+	PartHeaders []map[string]string
+}
+
+func multipartThreshold(cfg *config.AppConfig) int64 {
+	if cfg.Multipart.ThresholdBytes > 0 {
+		return cfg.Multipart.ThresholdBytes
+	}
+	return defaultMultipartThreshold
+}
+
+// partLayout returns the part size and number of parts for an object of the
+// given size. The preferred part size is raised if the object would need
+// more parts than S3 allows.
+func partLayout(size int64, preferredPartSize int64) (int64, int64, error) {
+	if size > maxObjectSize {
+		return 0, 0, errors.New(fmt.Sprintf("Object of %d bytes exceeds the S3 object size limit", size))
+	}
+	partSize := preferredPartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if minimum := (size + maxParts - 1) / maxParts; partSize < minimum {
+		// round up to full MiB to keep part boundaries readable
+		partSize = (minimum + 1024*1024 - 1) / (1024 * 1024) * (1024 * 1024)
+	}
+	parts := (size + partSize - 1) / partSize
+	if parts == 0 {
+		parts = 1
+	}
+	return partSize, parts, nil
+}
+
+// createMultipartUpload starts a multipart upload for objectKey with the
+// given metadata and presigns one UploadPart URL per part. With checksums,
+// one for each part, S3 verifies every part. The upload is aborted again if
+// presigning fails.
+func createMultipartUpload(client s3iface.S3API, bucket string, objectKey string, metadata map[string]*string, size int64, preferredPartSize int64, checksums []string) (*multipartUpload, error) {
+	partSize, parts, err := partLayout(size, preferredPartSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(checksums) > 0 && int64(len(checksums)) != parts {
+		return nil, errors.New(fmt.Sprintf("Expected %d part checksums, got %d", parts, len(checksums)))
+	}
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(objectKey),
+		Metadata: metadata,
+	}
+	if len(checksums) > 0 {
+		input.ChecksumAlgorithm = aws.String(s3.ChecksumAlgorithmSha256)
+	}
+	created, err := client.CreateMultipartUpload(input)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating multipart upload: %w", utils.AWSError(err))
+	}
+
+	upload := &multipartUpload{
+		UploadID: aws.StringValue(created.UploadId),
+		PartSize: partSize,
+		PartURLs: make([]string, 0, parts),
+	}
+	for partNumber := int64(1); partNumber <= parts; partNumber++ {
+		partInput := &s3.UploadPartInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(objectKey),
+			UploadId:   created.UploadId,
+			PartNumber: aws.Int64(partNumber),
+		}
+		if len(checksums) > 0 {
+			partInput.ChecksumSHA256 = aws.String(checksums[partNumber-1])
+		}
+		sdkReq, _ := client.UploadPartRequest(partInput)
+		u, headers, err := presignWithHeaders(sdkReq, multipartURLExpiry)
+		if err != nil {
+			abortMultipartUpload(client, bucket, objectKey, upload.UploadID)
+			return nil, fmt.Errorf("Error Creating Signed URL for part %d: %w", partNumber, err)
+		}
+		upload.PartURLs = append(upload.PartURLs, u)
+		if headers != nil {
+			if upload.PartHeaders == nil {
+				upload.PartHeaders = make([]map[string]string, parts)
+			}
+			upload.PartHeaders[partNumber-1] = headers
+		}
+	}
+	return upload, nil
+}
+
+func abortMultipartUpload(client s3iface.S3API, bucket string, objectKey string, uploadID string) error {
+	_, err := client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(objectKey),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "abortMultipartUpload",
+		}).Error(fmt.Sprintf("Error aborting multipart upload %s of %s: %s", uploadID, objectKey, err.Error()))
+		return fmt.Errorf("Error aborting multipart upload: %w", utils.AWSError(err))
+	}
+	return nil
+}
+
+func completeMultipartUpload(client s3iface.S3API, bucket string, objectKey string, uploadID string, parts []CompletedPart) error {
+	if len(parts) == 0 {
+		return errors.New("Error completing multipart upload: no parts reported")
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedPart := &s3.CompletedPart{
+			PartNumber: aws.Int64(part.PartNumber),
+			ETag:       aws.String(part.ETag),
+		}
+		if part.ChecksumSHA256 != "" {
+			completedPart.ChecksumSHA256 = aws.String(part.ChecksumSHA256)
+		}
+		completed = append(completed, completedPart)
+	}
+	_, err := client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(objectKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return fmt.Errorf("Error completing multipart upload: %w", utils.AWSError(err))
+	}
+	return nil
+}
+
+func bindMultipartRequest(c *gin.Context) (*MultipartRequest, s3iface.S3API, bool) {
+	var requestBody MultipartRequest
+	if err := c.ShouldBindJSON(&requestBody); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{
+			Error: fmt.Sprintf("Could not Unmarshal request body %s", err.Error()),
+		})
+		return nil, nil, false
+	}
+	if err := requestBody.validate(); err != nil {
+		badRequest(c, err)
+		return nil, nil, false
+	}
+	namespace, ok := authorize(c, requestBody.Tenant, requestBody.Namespace)
+	if !ok {
+		return nil, nil, false
+	}
+	requestBody.Namespace = namespace
+
+	clients := c.MustGet("clients").(*utils.Clients)
+	awsClient, err := clients.S3.Client()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "bindMultipartRequest",
+		}).Error(fmt.Sprintf("Error initializing the AWS awsClient: %s", err.Error()))
+		serverError(c, fmt.Errorf("Error initializing the AWS awsClient: %w", err))
+		return nil, nil, false
+	}
+	return &requestBody, awsClient, true
+}
+
+// @Summary Complete a multipart upload
+// @Schemes http https
+// @Description Complete a multipart upload with the ETags of all uploaded parts
+// @Tags v1
+// @param request body MultipartRequest true "Upload to complete and its parts"
+// @Accept json
+// @Produce json
+// @securityDefinitions.apikey ApiKeyAuth
+// @Success      200  {object}  StatusResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure		 403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Failure      503  {object}  ErrorResponse
+// @Router /upload/complete [post]
+func HandleCompleteUpload(c *gin.Context) {
+	cfg := c.MustGet("cfg").(*config.AppConfig)
+	requestBody, awsClient, ok := bindMultipartRequest(c)
+	if !ok {
+		return
+	}
+
+	key := objectKey(requestBody.Tenant, requestBody.Namespace, requestBody.ArtifactType, requestBody.FileName)
+	log.WithFields(log.Fields{
+		"caller": "HandleCompleteUpload",
+	}).Info(fmt.Sprintf("Completing multipart upload of %s with %d parts", key, len(requestBody.Parts)))
+
+	err := completeMultipartUpload(awsClient, cfg.App.Bucket, key, requestBody.UploadID, requestBody.Parts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "HandleCompleteUpload",
+		}).Error(err.Error())
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, StatusResponse{Status: "ok"})
+}
+
+// @Summary Abort a multipart upload
+// @Schemes http https
+// @Description Abort a multipart upload and discard all uploaded parts
+// @Tags v1
+// @param request body MultipartRequest true "Upload to abort"
+// @Accept json
+// @Produce json
+// @securityDefinitions.apikey ApiKeyAuth
+// @Success      200  {object}  StatusResponse
+// @Failure      400  {object}  ErrorResponse
+// @Failure		 403  {object}  ErrorResponse
+// @Failure      500  {object}  ErrorResponse
+// @Failure      503  {object}  ErrorResponse
+// @Router /upload/abort [post]
+func HandleAbortUpload(c *gin.Context) {
+	cfg := c.MustGet("cfg").(*config.AppConfig)
+	requestBody, awsClient, ok := bindMultipartRequest(c)
+	if !ok {
+		return
+	}
+
+	key := objectKey(requestBody.Tenant, requestBody.Namespace, requestBody.ArtifactType, requestBody.FileName)
+	log.WithFields(log.Fields{
+		"caller": "HandleAbortUpload",
+	}).Info(fmt.Sprintf("Aborting multipart upload of %s", key))
+
+	if err := abortMultipartUpload(awsClient, cfg.App.Bucket, key, requestBody.UploadID); err != nil {
+		serverError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, StatusResponse{Status: "ok"})
+}
@@ -0,0 +1,199 @@
+package v1
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
+)
+
+// fakeS3 presigns with static credentials and records multipart calls
+// instead of sending them to AWS.
+type fakeS3 struct {
+	s3iface.S3API
+	createErr   error
+	completeErr error
+	created     *s3.CreateMultipartUploadInput
+	aborted     []string
+	completed   *s3.CompleteMultipartUploadInput
+}
+
+func newFakeS3() *fakeS3 {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-central-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	return &fakeS3{S3API: s3.New(sess)}
+}
+
+func (f *fakeS3) CreateMultipartUpload(in *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if f.createErr != nil {
+		return nil, f.createErr
+	}
+	f.created = in
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(in *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.aborted = append(f.aborted, aws.StringValue(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(in *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	if f.completeErr != nil {
+		return nil, f.completeErr
+	}
+	f.completed = in
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestPartLayout(t *testing.T) {
+	cases := []struct {
+		size, preferred, wantSize, wantParts int64
+	}{
+		{size: 20 << 30, preferred: 64 << 20, wantSize: 64 << 20, wantParts: 320},
+		{size: 1, preferred: 0, wantSize: defaultPartSize, wantParts: 1},
+		{size: 10 << 20, preferred: 1 << 20, wantSize: minPartSize, wantParts: 2},
+		// 1 TiB does not fit into 10000 parts of 64 MiB
+		{size: 1 << 40, preferred: 64 << 20, wantSize: 105 << 20, wantParts: 9987},
+	}
+	for _, tc := range cases {
+		gotSize, gotParts, err := partLayout(tc.size, tc.preferred)
+		if err != nil {
+			t.Errorf("size %d: %v", tc.size, err)
+		}
+		if gotSize != tc.wantSize || gotParts != tc.wantParts {
+			t.Errorf("size %d: got %d parts of %d, want %d parts of %d", tc.size, gotParts, gotSize, tc.wantParts, tc.wantSize)
+		}
+	}
+
+	_, _, err := partLayout(6<<40, 0)
+	if err == nil {
+		t.Errorf("objects beyond 5 TiB can not be uploaded")
+	}
+}
+
+func TestCreateMultipartUpload(t *testing.T) {
+	client := newFakeS3()
+	upload, err := createMultipartUpload(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, 150<<20, 64<<20, nil)
+	if err != nil {
+		t.Fatalf("Failed to create multipart upload: %v", err)
+	}
+	if upload.UploadID != "upload-1" || upload.PartSize != 64<<20 || len(upload.PartURLs) != 3 {
+		t.Fatalf("unexpected upload %+v", upload)
+	}
+	for i, partURL := range upload.PartURLs {
+		u, err := url.Parse(partURL)
+		if err != nil {
+			t.Fatalf("invalid part URL %s: %v", partURL, err)
+		}
+		if u.Query().Get("uploadId") != "upload-1" || u.Query().Get("partNumber") != string(rune('1'+i)) {
+			t.Errorf("part URL %d does not reference the upload: %s", i, partURL)
+		}
+		if !strings.Contains(u.Path, "tenant/ns/dump.hprof.crypted") {
+			t.Errorf("part URL %d does not reference the object: %s", i, partURL)
+		}
+	}
+
+	client.createErr = errors.New("access denied")
+	_, err = createMultipartUpload(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, 150<<20, 64<<20, nil)
+	if err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCreateMultipartUploadChecksums(t *testing.T) {
+	client := newFakeS3()
+	checksums := []string{
+		"n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg=",
+		"LCa0a2j/xo/5m0U8HTBBNBNCLXBkg7+g+YpeiGJm564=",
+		"uMx/U1ZM6SiP+vE2I0oeFnFUmJCunAexXY5NqGSQS7U=",
+	}
+	upload, err := createMultipartUpload(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, 150<<20, 64<<20, checksums)
+	if err != nil {
+		t.Fatalf("Failed to create multipart upload: %v", err)
+	}
+	if aws.StringValue(client.created.ChecksumAlgorithm) != s3.ChecksumAlgorithmSha256 {
+		t.Errorf("upload has to be created with SHA-256 checksums, got %v", client.created.ChecksumAlgorithm)
+	}
+	if len(upload.PartHeaders) != 3 {
+		t.Fatalf("every part needs its headers, got %v", upload.PartHeaders)
+	}
+	for i, headers := range upload.PartHeaders {
+		if headers["X-Amz-Checksum-Sha256"] != checksums[i] {
+			t.Errorf("part %d: got headers %v", i+1, headers)
+		}
+	}
+
+	_, err = createMultipartUpload(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, 150<<20, 64<<20, checksums[:2])
+	if err == nil {
+		t.Errorf("every part needs a checksum")
+	}
+}
+
+func TestMultipartAWSUnavailable(t *testing.T) {
+	client := newFakeS3()
+	parts := []CompletedPart{{PartNumber: 1, ETag: "\"a\""}}
+	tests := []struct {
+		name        string
+		err         error
+		unavailable bool
+	}{
+		{"server error", awserr.NewRequestFailure(awserr.New("InternalError", "We encountered an internal error", nil), 500, "id"), true},
+		{"throttled", awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate", nil), 503, "id"), true},
+		{"not reachable", awserr.New(request.ErrCodeRequestError, "send request failed", &net.OpError{Op: "dial", Err: errors.New("connection refused")}), true},
+		{"no such upload", awserr.NewRequestFailure(awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil), 404, "id"), false},
+	}
+	for _, test := range tests {
+		client.createErr = test.err
+		_, err := createMultipartUpload(client, "test-bucket", "key", nil, 150<<20, 64<<20, nil)
+		if errors.Is(err, utils.ErrAWSUnavailable) != test.unavailable {
+			t.Errorf("%s: creating got %v, want unavailable %t", test.name, err, test.unavailable)
+		}
+		client.completeErr = test.err
+		err = completeMultipartUpload(client, "test-bucket", "key", "upload-1", parts)
+		if errors.Is(err, utils.ErrAWSUnavailable) != test.unavailable {
+			t.Errorf("%s: completing got %v, want unavailable %t", test.name, err, test.unavailable)
+		}
+	}
+}
+
+func TestCompleteMultipartUpload(t *testing.T) {
+	client := newFakeS3()
+	parts := []CompletedPart{
+		{PartNumber: 2, ETag: "\"b\""},
+		{PartNumber: 1, ETag: "\"a\""},
+	}
+	if err := completeMultipartUpload(client, "test-bucket", "key", "upload-1", parts); err != nil {
+		t.Fatalf("Failed to complete upload: %v", err)
+	}
+	got := client.completed.MultipartUpload.Parts
+	if aws.Int64Value(got[0].PartNumber) != 1 || aws.StringValue(got[0].ETag) != "\"a\"" {
+		t.Errorf("parts must be sent in ascending order, got %v", got)
+	}
+	if got[0].ChecksumSHA256 != nil {
+		t.Errorf("parts without checksum must not send one, got %v", got)
+	}
+
+	parts = []CompletedPart{{PartNumber: 1, ETag: "\"a\"", ChecksumSHA256: "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="}}
+	if err := completeMultipartUpload(client, "test-bucket", "key", "upload-1", parts); err != nil {
+		t.Fatalf("Failed to complete upload: %v", err)
+	}
+	if aws.StringValue(client.completed.MultipartUpload.Parts[0].ChecksumSHA256) != parts[0].ChecksumSHA256 {
+		t.Errorf("part checksums have to be passed on, got %v", client.completed.MultipartUpload.Parts)
+	}
+
+	if err := completeMultipartUpload(client, "test-bucket", "key", "upload-1", nil); err == nil {
+		t.Errorf("completing without parts must fail")
+	}
+}
@@ -1,6 +1,8 @@
 package v1
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"strings"
@@ -9,7 +11,10 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/config"
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/metrics"
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
@@ -17,27 +22,71 @@ import (
 )
 
 type SigningRequest struct {
-	Tenant    string `json:"tenant" example:"cloud-beacon"`
-	Namespace string `json:"namespace" example:"beacon"`
-	FileName  string `json:"filename" example:"test_file.dump"`
+	Tenant       string      `json:"tenant" example:"cloud-beacon"`
+	Namespace    string      `json:"namespace" example:"beacon"`
+	FileName     string      `json:"filename" example:"test_file.dump"`
+	ArtifactType string      `json:"artifact-type,omitempty" example:"hprof"`
+	Size         int64       `json:"size,omitempty" example:"21474836480"`
+	Validation   *Validation `json:"validation,omitempty"`
+	// EncryptedAesKey is the key from /upload/key the dump is encrypted
+	// with, or the key wrapped by the client. Without it a new key is
+	// generated, unless keys are wrapped by the client.
+	EncryptedAesKey string `json:"encrypted-aes-key,omitempty"`
+	// ChecksumSHA256 is the base64 encoded SHA-256 of the encrypted dump,
+	// PartChecksums those of its parts if it is uploaded in parts. S3
+	// rejects uploads that do not match them.
+	ChecksumSHA256 string   `json:"checksum-sha256,omitempty" example:"n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="`
+	PartChecksums  []string `json:"part-checksums,omitempty"`
 } // @name SigningRequest
 
+// Validation is the verdict of the sidecar's hprof validator, it is stored
+// as metadata of the uploaded heap dump.
+type Validation struct {
+	Status string `json:"status" example:"truncated"`
+	Reason string `json:"reason,omitempty" example:"heap dump end record is missing"`
+} // @name Validation
+
 type SigningResponse struct {
-	URL                string `json:"url"`
-	EncryptedAesKey    string `json:"encrypted-aes-key"`
-	EncryptedAesKeyURL string `json:"encrypted-aes-key-url"`
-	AesKey             string `json:"aes-key"`
+	URL                string   `json:"url"`
+	EncryptedAesKey    string   `json:"encrypted-aes-key"`
+	EncryptedAesKeyURL string   `json:"encrypted-aes-key-url"`
+	AesKey             string   `json:"aes-key"`
+	UploadID           string   `json:"upload-id,omitempty"`
+	PartSize           int64    `json:"part-size,omitempty"`
+	PartURLs           []string `json:"part-urls,omitempty"`
+	// Headers are signed with URL and have to be sent with the upload.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ManifestURL takes the JSON manifest describing the dump.
+	ManifestURL string `json:"manifest-url,omitempty"`
+	// PartHeaders are signed with the URL of the part at the same index.
+	PartHeaders []map[string]string `json:"part-headers,omitempty"`
+	// HeadURL tells whether the dump is stored, a client restarting an
+	// interrupted upload checks it first.
+	HeadURL string `json:"head-url,omitempty"`
 } // @name SigningResponse
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Reason is set if the authorization policy denied the request or Vault
+	// or AWS are unavailable.
+	Reason string `json:"reason,omitempty" example:"tenant"`
+	// Fields lists the invalid fields of a bad request.
+	Fields []FieldError `json:"fields,omitempty"`
 } // @name ErrorResponse
 
 // @BasePath /api/v1
 
 // @Summary Get signed upload URL
 // @Schemes http https
-// @Description Request a new Signed Upload URL for a specific file
+// @Description Request a new Signed Upload URL for a specific file.
+// @Description Files larger than the multipart threshold get a multipart upload with one URL per part instead,
+// @Description which has to be finished with /upload/complete or /upload/abort.
+// @Description Objects with an artifact type are stored as <tenant>/<namespace>/<artifact-type>/<filename>.
+// @Description The namespace defaults to the one of the ServiceAccount, other namespaces have to be allowed by the authorization policy.
+// @Description The encrypted key is stored as <object>.key, the manifest describing the dump as <object>.manifest.json.
+// @Description With the encrypted key from /upload/key and the checksums of the encrypted dump the checksums are signed
+// @Description into the URLs and have to be sent as headers, S3 rejects uploads that do not match them.
+// @Description If keys are wrapped by the client, the encrypted key is required and no plaintext key is ever returned.
 // @Tags v1
 // @param request body SigningRequest true "Request a new Signed Upload URL"
 // @Accept json
@@ -48,17 +97,11 @@ type ErrorResponse struct {
 // @Failure		 403  {object}  ErrorResponse
 // @Failure      404  {object}  ErrorResponse
 // @Failure      500  {object}  ErrorResponse
+// @Failure      503  {object}  ErrorResponse
 // @Router /upload [post]
 func HandleRequestUpload(c *gin.Context) {
 
 	cfg := c.MustGet("cfg").(*config.AppConfig)
-	vaultClient, err := utils.GenerateTransitVaultClient(cfg.Vault.VaultRole, cfg.Vault.VaultAuthMountPath, cfg.ServiceAccount.JWTokenMountPoint)
-
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "HandleRequestUpload",
-		}).Fatalf(fmt.Sprintf("unable to initialize Transit Vault Client : %s", err.Error()))
-	}
 
 	var requestBody SigningRequest
 	if err := c.ShouldBindJSON(&requestBody); err != nil {
@@ -69,85 +112,117 @@ func HandleRequestUpload(c *gin.Context) {
 		return
 	}
 
-	objectKey := fmt.Sprintf("%s/%s/%s", requestBody.Tenant, requestBody.Namespace, requestBody.FileName)
-	aesKeyObjectKey := fmt.Sprintf("%s/%s/%s.%s", requestBody.Tenant, requestBody.Namespace, requestBody.FileName, "key")
+	if err := requestBody.validate(); err != nil {
+		badRequest(c, err)
+		return
+	}
 
-	awsClient, err := utils.GenerateS3Client(cfg.App.Bucket)
+	namespace, ok := authorize(c, requestBody.Tenant, requestBody.Namespace)
+	if !ok {
+		return
+	}
+	requestBody.Namespace = namespace
 
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "HandleRequestUpload",
-		}).Error(fmt.Sprintf("Error initializing the AWS awsClient: %s", err.Error()))
+	if err := validateEncryptedAesKey(requestBody, clientKeyWrapping(cfg)); err != nil {
+		badRequest(c, err)
+		return
+	}
 
-		errResp := ErrorResponse{
-			Error: fmt.Sprintf("Error initializing the AWS awsClient: %s", err.Error()),
-		}
-		c.JSON(http.StatusInternalServerError, errResp)
+	multipart := requestBody.Size > multipartThreshold(cfg)
+	if err := validateChecksums(requestBody, multipart, cfg.Multipart.PartSizeBytes); err != nil {
+		badRequest(c, err)
 		return
 	}
-	log.WithFields(log.Fields{
-		"caller": "HandleRequestUpload",
-	}).Info(fmt.Sprintf("Received request to presign PutObject for %s", objectKey))
-	sdkReq, _ := awsClient.PutObjectRequest(&s3.PutObjectInput{
-		Bucket: aws.String(cfg.App.Bucket),
-		Key:    aws.String(objectKey),
-	})
-	u, _, err := sdkReq.PresignRequest(15 * time.Minute)
+
+	dumpObjectKey := objectKey(requestBody.Tenant, requestBody.Namespace, requestBody.ArtifactType, requestBody.FileName)
+	aesKeyObjectKey := fmt.Sprintf("%s.%s", dumpObjectKey, "key")
+	manifestObjectKey := fmt.Sprintf("%s.%s", dumpObjectKey, "manifest.json")
+
+	clients := c.MustGet("clients").(*utils.Clients)
+	awsClient, err := clients.S3.Client()
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"caller": "HandleRequestUpload",
-		}).Error(fmt.Sprintf("Error Creating Signed URL: %s", err.Error()))
-
-		errResp := ErrorResponse{
-			Error: fmt.Sprintf("Error Creating Signed URL: %s", err.Error()),
-		}
-		c.JSON(http.StatusInternalServerError, errResp)
+		}).Error(fmt.Sprintf("Error initializing the AWS awsClient: %s", err.Error()))
+		serverError(c, fmt.Errorf("Error initializing the AWS awsClient: %w", err))
 		return
 	}
-
-	aesKey, err := utils.GenerateRandomBytes(32)
+	var u string
+	var headers map[string]string
+	upload := &multipartUpload{}
+	metadata := objectMetadata(requestBody.Validation)
+	if requestBody.Validation != nil && requestBody.Validation.Status != "valid" {
+		log.WithFields(log.Fields{
+			"caller": "HandleRequestUpload",
+		}).Warn(fmt.Sprintf("%s is uploaded although it is %s: %s", dumpObjectKey, requestBody.Validation.Status, requestBody.Validation.Reason))
+	}
+	if multipart {
+		log.WithFields(log.Fields{
+			"caller": "HandleRequestUpload",
+		}).Info(fmt.Sprintf("Received request to presign multipart upload of %d bytes for %s", requestBody.Size, dumpObjectKey))
+		upload, err = createMultipartUpload(awsClient, cfg.App.Bucket, dumpObjectKey, metadata, requestBody.Size, cfg.Multipart.PartSizeBytes, requestBody.PartChecksums)
+	} else {
+		log.WithFields(log.Fields{
+			"caller": "HandleRequestUpload",
+		}).Info(fmt.Sprintf("Received request to presign PutObject for %s", dumpObjectKey))
+		u, headers, err = presignPutObject(awsClient, cfg.App.Bucket, dumpObjectKey, metadata, requestBody.ChecksumSHA256)
+	}
 
 	if err != nil {
 		log.WithFields(log.Fields{
 			"caller": "HandleRequestUpload",
-		}).Error(fmt.Sprintf("Error generating password: %s", err.Error()))
-		errResp := ErrorResponse{
-			Error: fmt.Sprintf("Error generating password: %s", err.Error()),
-		}
-		c.JSON(http.StatusInternalServerError, errResp)
+		}).Error(fmt.Sprintf("Error Creating Signed URL: %s", err.Error()))
+		serverError(c, fmt.Errorf("Error Creating Signed URL: %w", err))
 		return
 	}
 
-	encodedAesKey := utils.EncodeKey(aesKey)
+	// nobody would ever complete a multipart upload we fail to hand out
+	abortPendingUpload := func() {
+		if upload.UploadID != "" {
+			abortMultipartUpload(awsClient, cfg.App.Bucket, dumpObjectKey, upload.UploadID)
+		}
+	}
 
-	encryptedAesKey, err := utils.TransitEncryptString(vaultClient, cfg.Vault.VaultTransitMount, requestBody.Tenant, encodedAesKey)
+	// the dump was encrypted before with a key from /upload/key
+	encodedAesKey, encryptedAesKey := "", requestBody.EncryptedAesKey
+	if encryptedAesKey == "" {
+		encodedAesKey, encryptedAesKey, err = generateDataKey(clients.Vault, cfg, requestBody.Tenant)
+	}
 
 	if err != nil {
+		abortPendingUpload()
 		log.WithFields(log.Fields{
 			"caller": "HandleRequestUpload",
-		}).Error(fmt.Sprintf("Error encrypting password: %s", err.Error()))
-		errResp := ErrorResponse{
-			Error: fmt.Sprintf("Error encrypting password: %s", err.Error()),
-		}
-		c.JSON(http.StatusInternalServerError, errResp)
+		}).Error(err.Error())
+		serverError(c, err)
 		return
 	}
 
-	sdkReq, _ = awsClient.PutObjectRequest(&s3.PutObjectInput{
+	sdkReq, _ := awsClient.PutObjectRequest(&s3.PutObjectInput{
 		Bucket: aws.String(cfg.App.Bucket),
 		Key:    aws.String(aesKeyObjectKey),
 	})
 	aesKeyURL, _, err := sdkReq.PresignRequest(15 * time.Minute)
+	err = utils.AWSError(err)
+	var manifestURL, headURL string
+	if err == nil {
+		manifestURL, _, err = presignPutObject(awsClient, cfg.App.Bucket, manifestObjectKey, nil, "")
+	}
+	if err == nil {
+		headReq, _ := awsClient.HeadObjectRequest(&s3.HeadObjectInput{
+			Bucket: aws.String(cfg.App.Bucket),
+			Key:    aws.String(dumpObjectKey),
+		})
+		headURL, _, err = presignWithHeaders(headReq, 15*time.Minute)
+	}
 
 	if err != nil {
+		abortPendingUpload()
 		log.WithFields(log.Fields{
 			"caller": "HandleRequestUpload",
 		}).Error(fmt.Sprintf("Error generating presigned upload URL: %s", err.Error()))
-		errResp := ErrorResponse{
-			Error: fmt.Sprintf("Error generating presigned upload URL: %s", err.Error()),
-		}
-		c.JSON(http.StatusInternalServerError, errResp)
+		serverError(c, fmt.Errorf("Error generating presigned upload URL: %w", err))
 		return
 	}
 
@@ -156,6 +231,13 @@ func HandleRequestUpload(c *gin.Context) {
 		EncryptedAesKey:    encryptedAesKey,
 		EncryptedAesKeyURL: aesKeyURL,
 		AesKey:             encodedAesKey,
+		UploadID:           upload.UploadID,
+		PartSize:           upload.PartSize,
+		PartURLs:           upload.PartURLs,
+		Headers:            headers,
+		ManifestURL:        manifestURL,
+		PartHeaders:        upload.PartHeaders,
+		HeadURL:            headURL,
 	}
 
 	c.JSON(http.StatusOK, resp)
@@ -165,3 +247,106 @@ func HandleRequestUpload(c *gin.Context) {
 	metrics.HeapDumpHandled.WithLabelValues(namespaceString, requestBody.Tenant).Inc()
 
 }
+
+// objectMetadata records the validation verdict with the uploaded object.
+func objectMetadata(validation *Validation) map[string]*string {
+	if validation == nil {
+		return nil
+	}
+	metadata := map[string]*string{
+		"hprof-validation": aws.String(validation.Status),
+	}
+	if validation.Reason != "" {
+		metadata["hprof-validation-reason"] = aws.String(validation.Reason)
+	}
+	return metadata
+}
+
+// validateEncryptedAesKey makes sure a service that wraps no keys itself
+// never generates one, and that a given key looks like transit ciphertext.
+func validateEncryptedAesKey(request SigningRequest, clientWrapping bool) error {
+	if request.EncryptedAesKey == "" {
+		if clientWrapping {
+			return fieldError("encrypted-aes-key", "is required, keys are wrapped by the client, see /upload/key")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(request.EncryptedAesKey, "vault:v") {
+		return fieldError("encrypted-aes-key", "must be Vault transit ciphertext")
+	}
+	return nil
+}
+
+// validateChecksums checks the checksums of an upload request. Checksums
+// are optional, but part checksums have to cover every part.
+func validateChecksums(request SigningRequest, multipart bool, preferredPartSize int64) error {
+	if request.ChecksumSHA256 != "" && !validChecksum(request.ChecksumSHA256) {
+		return fieldError("checksum-sha256", "must be a base64 encoded SHA-256")
+	}
+	if len(request.PartChecksums) == 0 {
+		return nil
+	}
+	if !multipart {
+		return fieldError("part-checksums", "are only accepted for multipart uploads")
+	}
+	_, parts, err := partLayout(request.Size, preferredPartSize)
+	if err != nil {
+		return fieldError("size", err.Error())
+	}
+	if int64(len(request.PartChecksums)) != parts {
+		return fieldError("part-checksums", fmt.Sprintf("must hold %d checksums, got %d", parts, len(request.PartChecksums)))
+	}
+	for i, checksum := range request.PartChecksums {
+		if !validChecksum(checksum) {
+			return fieldError(fmt.Sprintf("part-checksums[%d]", i), "must be a base64 encoded SHA-256")
+		}
+	}
+	return nil
+}
+
+func validChecksum(checksum string) bool {
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	return err == nil && len(sum) == sha256.Size
+}
+
+// presignPutObject presigns a PutObject request. Metadata and the checksum
+// are part of the signature, the returned headers have to be sent with the
+// upload.
+func presignPutObject(client s3iface.S3API, bucket string, objectKey string, metadata map[string]*string, checksum string) (string, map[string]string, error) {
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(objectKey),
+		Metadata: metadata,
+	}
+	if checksum != "" {
+		input.ChecksumSHA256 = aws.String(checksum)
+	}
+	sdkReq, _ := client.PutObjectRequest(input)
+	return presignWithHeaders(sdkReq, 15*time.Minute)
+}
+
+// presignWithHeaders presigns sdkReq and returns the headers that have to be
+// sent with it. The SDK would move most x-amz-* headers, like the checksum,
+// into the query string, they are kept as signed headers instead.
+func presignWithHeaders(sdkReq *request.Request, expiry time.Duration) (string, map[string]string, error) {
+	sdkReq.Handlers.Sign.Swap(v4.SignRequestHandler.Name, v4.BuildNamedHandler(v4.SignRequestHandler.Name, func(signer *v4.Signer) {
+		signer.DisableHeaderHoisting = true
+	}))
+	u, signedHeaders, err := sdkReq.PresignRequest(expiry)
+	if err != nil {
+		// presigning fetches the credentials, e.g. from STS
+		return "", nil, utils.AWSError(err)
+	}
+	var headers map[string]string
+	// the signer keeps the header names in lower case
+	for name, values := range signedHeaders {
+		if strings.EqualFold(name, "Host") {
+			continue
+		}
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ",")
+	}
+	return u, headers, nil
+}
@@ -0,0 +1,122 @@
+package v1
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestObjectMetadata(t *testing.T) {
+	if objectMetadata(nil) != nil {
+		t.Errorf("uploads without verdict have no metadata")
+	}
+	metadata := objectMetadata(&Validation{Status: "truncated", Reason: "heap dump end record is missing"})
+	if aws.StringValue(metadata["hprof-validation"]) != "truncated" || aws.StringValue(metadata["hprof-validation-reason"]) != "heap dump end record is missing" {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+	metadata = objectMetadata(&Validation{Status: "valid"})
+	if _, ok := metadata["hprof-validation-reason"]; ok || len(metadata) != 1 {
+		t.Errorf("unexpected metadata %v", metadata)
+	}
+}
+
+func TestPresignPutObject(t *testing.T) {
+	client := newFakeS3()
+	u, headers, err := presignPutObject(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, "")
+	if err != nil {
+		t.Fatalf("Failed to presign: %v", err)
+	}
+	if headers != nil {
+		t.Errorf("no headers have to be sent without metadata, got %v", headers)
+	}
+
+	u, headers, err = presignPutObject(client, "test-bucket", "tenant/ns/dump.hprof.crypted", objectMetadata(&Validation{Status: "truncated"}), "")
+	if err != nil {
+		t.Fatalf("Failed to presign: %v", err)
+	}
+	if headers["X-Amz-Meta-Hprof-Validation"] != "truncated" || len(headers) != 1 {
+		t.Errorf("metadata has to be sent as header, got %v", headers)
+	}
+	parsed, _ := url.Parse(u)
+	if !strings.Contains(parsed.Query().Get("X-Amz-SignedHeaders"), "x-amz-meta-hprof-validation") {
+		t.Errorf("metadata is not signed: %s", u)
+	}
+}
+
+func TestCreateMultipartUploadMetadata(t *testing.T) {
+	client := newFakeS3()
+	metadata := objectMetadata(&Validation{Status: "corrupt"})
+	if _, err := createMultipartUpload(client, "test-bucket", "tenant/ns/dump.hprof.crypted", metadata, 150<<20, 64<<20, nil); err != nil {
+		t.Fatalf("Failed to create multipart upload: %v", err)
+	}
+	if aws.StringValue(client.created.Metadata["hprof-validation"]) != "corrupt" {
+		t.Errorf("metadata is not set on the upload: %v", client.created.Metadata)
+	}
+}
+
+func TestPresignPutObjectChecksum(t *testing.T) {
+	client := newFakeS3()
+	checksum := "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+	u, headers, err := presignPutObject(client, "test-bucket", "tenant/ns/dump.hprof.crypted", nil, checksum)
+	if err != nil {
+		t.Fatalf("Failed to presign: %v", err)
+	}
+	if headers["X-Amz-Checksum-Sha256"] != checksum {
+		t.Errorf("checksum has to be sent as header, got %v", headers)
+	}
+	parsed, _ := url.Parse(u)
+	if !strings.Contains(parsed.Query().Get("X-Amz-SignedHeaders"), "x-amz-checksum-sha256") {
+		t.Errorf("checksum is not signed: %s", u)
+	}
+	if parsed.Query().Has("X-Amz-Checksum-Sha256") {
+		t.Errorf("checksum must not be part of the query: %s", u)
+	}
+}
+
+func TestValidateChecksums(t *testing.T) {
+	checksum := "n4bQgYhMfWWaL+qgxVrQFaO/TxsrC4Is0V1sFbDwCgg="
+	cases := []struct {
+		name      string
+		request   SigningRequest
+		multipart bool
+		valid     bool
+	}{
+		{"no checksums", SigningRequest{Size: 100}, false, true},
+		{"single upload", SigningRequest{Size: 100, ChecksumSHA256: checksum}, false, true},
+		{"not base64", SigningRequest{Size: 100, ChecksumSHA256: "not a checksum"}, false, false},
+		{"no SHA-256", SigningRequest{Size: 100, ChecksumSHA256: "YWJj"}, false, false},
+		{"parts of single upload", SigningRequest{Size: 100, PartChecksums: []string{checksum}}, false, false},
+		{"all parts", SigningRequest{Size: 150 << 20, PartChecksums: []string{checksum, checksum, checksum}}, true, true},
+		{"missing part", SigningRequest{Size: 150 << 20, PartChecksums: []string{checksum, checksum}}, true, false},
+		{"invalid part", SigningRequest{Size: 150 << 20, PartChecksums: []string{checksum, "YWJj", checksum}}, true, false},
+	}
+	for _, tc := range cases {
+		err := validateChecksums(tc.request, tc.multipart, 64<<20)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestValidateEncryptedAesKey(t *testing.T) {
+	cases := []struct {
+		name           string
+		request        SigningRequest
+		clientWrapping bool
+		valid          bool
+	}{
+		{"service generates key", SigningRequest{}, false, true},
+		{"key from /upload/key", SigningRequest{EncryptedAesKey: "vault:v1:abc"}, false, true},
+		{"wrapped by client", SigningRequest{EncryptedAesKey: "vault:v3:abc"}, true, true},
+		{"no key wrapped by client", SigningRequest{}, true, false},
+		{"no transit ciphertext", SigningRequest{EncryptedAesKey: "abc"}, false, false},
+	}
+	for _, tc := range cases {
+		err := validateEncryptedAesKey(tc.request, tc.clientWrapping)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package v1
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxLabelLength          = 63
+	maxFileNameLength       = 255
+	maxUploadIDLength       = 1024
+	maxValidationReasonSize = 512
+)
+
+var (
+	// dnsLabel is a DNS label as defined in RFC 1123, which Kubernetes
+	// requires for namespaces. Tenants name Vault transit keys and the top
+	// level prefix of the bucket, so they follow the same rules.
+	dnsLabel = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// fileNamePattern allows no path separators, and no names like ".."
+	fileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+	// printableASCII may be sent as S3 object metadata
+	printableASCII = regexp.MustCompile(`^[\x20-\x7e]*$`)
+)
+
+var validationStatuses = []string{"valid", "truncated", "corrupt"}
+
+// FieldError tells what is wrong with a field of a request.
+type FieldError struct {
+	Field   string `json:"field" example:"tenant"`
+	Message string `json:"message" example:"must be a DNS label of lower case letters, digits and '-'"`
+} // @name FieldError
+
+// ValidationError holds everything that is wrong with a request.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fmt.Sprintf("%s %s", fieldError.Field, fieldError.Message)
+	}
+	return fmt.Sprintf("Invalid request: %s", strings.Join(messages, ", "))
+}
+
+// fieldError returns a ValidationError of a single field.
+func fieldError(field string, message string) error {
+	return ValidationError{{Field: field, Message: message}}
+}
+
+type validator struct {
+	errors ValidationError
+}
+
+func (v *validator) check(valid bool, field string, message string) {
+	if !valid {
+		v.errors = append(v.errors, FieldError{Field: field, Message: message})
+	}
+}
+
+// err returns the collected errors, or nil if there are none.
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return v.errors
+}
+
+func (v *validator) label(field string, value string, required bool) {
+	switch {
+	case value == "":
+		v.check(!required, field, "is required")
+	case len(value) > maxLabelLength:
+		v.check(false, field, fmt.Sprintf("must be at most %d characters long", maxLabelLength))
+	default:
+		v.check(dnsLabel.MatchString(value), field, "must be a DNS label of lower case letters, digits and '-'")
+	}
+}
+
+func (v *validator) fileName(fileName string) {
+	switch {
+	case fileName == "":
+		v.check(false, "filename", "is required")
+	case len(fileName) > maxFileNameLength:
+		v.check(false, "filename", fmt.Sprintf("must be at most %d characters long", maxFileNameLength))
+	default:
+		v.check(fileNamePattern.MatchString(fileName), "filename", "must start with a letter or digit and only contain letters, digits, '.', '_' and '-'")
+	}
+}
+
+func (v *validator) artifactType(artifactType string) {
+	v.check(validArtifactType(artifactType), "artifact-type", fmt.Sprintf("must be one of %s", strings.Join(artifactTypes, ", ")))
+}
+
+func (v *validator) size(size int64) {
+	v.check(size >= 0, "size", "must not be negative")
+}
+
+func (v *validator) validation(validation *Validation) {
+	if validation == nil {
+		return
+	}
+	known := false
+	for _, status := range validationStatuses {
+		known = known || validation.Status == status
+	}
+	v.check(known, "validation.status", fmt.Sprintf("must be one of %s", strings.Join(validationStatuses, ", ")))
+	if len(validation.Reason) > maxValidationReasonSize {
+		v.check(false, "validation.reason", fmt.Sprintf("must be at most %d characters long", maxValidationReasonSize))
+	} else {
+		v.check(printableASCII.MatchString(validation.Reason), "validation.reason", "must only contain printable ASCII characters")
+	}
+}
+
+// validate checks the fields of an upload request. The namespace may be
+// left out, it is taken from the ServiceAccount then.
+func (request SigningRequest) validate() error {
+	var v validator
+	v.label("tenant", request.Tenant, true)
+	v.label("namespace", request.Namespace, false)
+	v.fileName(request.FileName)
+	v.artifactType(request.ArtifactType)
+	v.size(request.Size)
+	v.validation(request.Validation)
+	return v.err()
+}
+
+func (request KeyRequest) validate() error {
+	var v validator
+	v.label("tenant", request.Tenant, true)
+	v.label("namespace", request.Namespace, false)
+	v.size(request.Size)
+	return v.err()
+}
+
+func (request MultipartRequest) validate() error {
+	var v validator
+	v.label("tenant", request.Tenant, true)
+	v.label("namespace", request.Namespace, false)
+	v.fileName(request.FileName)
+	v.artifactType(request.ArtifactType)
+	v.check(request.UploadID != "", "upload-id", "is required")
+	v.check(len(request.UploadID) <= maxUploadIDLength, "upload-id", fmt.Sprintf("must be at most %d characters long", maxUploadIDLength))
+	v.check(len(request.Parts) <= maxParts, "parts", fmt.Sprintf("must not hold more than %d parts", maxParts))
+	for i, part := range request.Parts {
+		v.check(part.PartNumber >= 1 && part.PartNumber <= maxParts, fmt.Sprintf("parts[%d].part-number", i), fmt.Sprintf("must be between 1 and %d", maxParts))
+		v.check(part.ETag != "", fmt.Sprintf("parts[%d].etag", i), "is required")
+	}
+	return v.err()
+}
+
+// badRequest answers with 400, listing the invalid fields of a
+// ValidationError.
+func badRequest(c *gin.Context, err error) {
+	response := ErrorResponse{Error: err.Error()}
+	if fields, ok := err.(ValidationError); ok {
+		response.Fields = fields
+	}
+	c.JSON(http.StatusBadRequest, response)
+}
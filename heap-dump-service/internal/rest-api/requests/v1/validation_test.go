@@ -0,0 +1,102 @@
+package v1
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func invalidFields(err error) []string {
+	var validationError ValidationError
+	if !errors.As(err, &validationError) {
+		return nil
+	}
+	fields := []string{}
+	for _, fieldError := range validationError {
+		fields = append(fields, fieldError.Field)
+	}
+	return fields
+}
+
+func TestValidateSigningRequest(t *testing.T) {
+	valid := SigningRequest{
+		Tenant:       "cloud-beacon",
+		Namespace:    "beacon",
+		FileName:     "java-app-7d9f-java_pid1.hprof-2024-01-01-12-00-05.hprof.crypted",
+		ArtifactType: "hprof",
+		Size:         100,
+		Validation:   &Validation{Status: "truncated", Reason: "heap dump end record is missing"},
+	}
+	cases := []struct {
+		name   string
+		modify func(*SigningRequest)
+		fields []string
+	}{
+		{"valid", func(r *SigningRequest) {}, nil},
+		{"namespace from token", func(r *SigningRequest) { r.Namespace = "" }, nil},
+		{"no tenant", func(r *SigningRequest) { r.Tenant = "" }, []string{"tenant"}},
+		{"upper case tenant", func(r *SigningRequest) { r.Tenant = "Cloud" }, []string{"tenant"}},
+		{"tenant with trailing dash", func(r *SigningRequest) { r.Tenant = "cloud-" }, []string{"tenant"}},
+		{"long namespace", func(r *SigningRequest) { r.Namespace = strings.Repeat("a", 64) }, []string{"namespace"}},
+		{"namespace with path", func(r *SigningRequest) { r.Namespace = "../other" }, []string{"namespace"}},
+		{"no filename", func(r *SigningRequest) { r.FileName = "" }, []string{"filename"}},
+		{"filename with slash", func(r *SigningRequest) { r.FileName = "a/b.hprof" }, []string{"filename"}},
+		{"dot dot filename", func(r *SigningRequest) { r.FileName = ".." }, []string{"filename"}},
+		{"non ascii filename", func(r *SigningRequest) { r.FileName = "dump-\xff.hprof" }, []string{"filename"}},
+		{"long filename", func(r *SigningRequest) { r.FileName = strings.Repeat("a", 256) }, []string{"filename"}},
+		{"unknown artifact type", func(r *SigningRequest) { r.ArtifactType = "jfr" }, []string{"artifact-type"}},
+		{"negative size", func(r *SigningRequest) { r.Size = -1 }, []string{"size"}},
+		{"unknown verdict", func(r *SigningRequest) { r.Validation.Status = "fine" }, []string{"validation.status"}},
+		{"reason with line break", func(r *SigningRequest) { r.Validation.Reason = "a\nb" }, []string{"validation.reason"}},
+		{"everything", func(r *SigningRequest) { *r = SigningRequest{Size: -1} }, []string{"tenant", "filename", "size"}},
+	}
+	for _, tc := range cases {
+		request := valid
+		validation := *valid.Validation
+		request.Validation = &validation
+		tc.modify(&request)
+		err := request.validate()
+		if got := invalidFields(err); !reflect.DeepEqual(got, tc.fields) {
+			t.Errorf("%s: got %v (%v), want %v", tc.name, got, err, tc.fields)
+		}
+	}
+}
+
+func TestValidateMultipartRequest(t *testing.T) {
+	request := MultipartRequest{
+		Tenant:   "cloud-beacon",
+		FileName: "dump.hprof.crypted",
+		UploadID: "upload",
+		Parts:    []CompletedPart{{PartNumber: 1, ETag: "\"etag\""}, {PartNumber: 0}},
+	}
+	want := []string{"parts[1].part-number", "parts[1].etag"}
+	if got := invalidFields(request.validate()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	request.Parts = request.Parts[:1]
+	request.UploadID = ""
+	if got := invalidFields(request.validate()); !reflect.DeepEqual(got, []string{"upload-id"}) {
+		t.Errorf("got %v, want [upload-id]", got)
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	badRequest(c, KeyRequest{Tenant: "Cloud", Size: -1}.validate())
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	var response ErrorResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if len(response.Fields) != 2 || response.Fields[0].Field != "tenant" || response.Fields[1].Field != "size" || response.Error == "" {
+		t.Errorf("invalid fields have to be listed, got %+v", response)
+	}
+}
@@ -1,6 +1,7 @@
 package restapi
 
 import (
+	"context"
 	"fmt"
 
 	docs "github.com/dbschenker/heap-dump-management/heap-dump-service/docs"
@@ -9,7 +10,9 @@ import (
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/auth"
 	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/requests"
 	apiV1 "github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/requests/v1"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/rest-api/utils"
 	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
 
 	swaggerfiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -17,10 +20,20 @@ import (
 
 const BASE_PATH = "/api/v1"
 const UPLOAD_ENDPOINT = "/upload"
+const KEY_ENDPOINT = "/upload/key"
+const COMPLETE_UPLOAD_ENDPOINT = "/upload/complete"
+const ABORT_UPLOAD_ENDPOINT = "/upload/abort"
 
 func Serve(cfg *config.AppConfig) {
 
 	docs.SwaggerInfo.BasePath = BASE_PATH
+	if len(cfg.Authorization.Rules) == 0 {
+		log.WithFields(log.Fields{
+			"caller": "Serve",
+		}).Warn("No authorization rules configured, ServiceAccounts may only upload for the tenant named like their namespace")
+	}
+	clients := newClients(cfg)
+
 	router := gin.New()
 	router.SetTrustedProxies([]string{"10.0.0.0/8"})
 
@@ -29,12 +42,16 @@ func Serve(cfg *config.AppConfig) {
 
 	router.Use(func(c *gin.Context) {
 		c.Set("cfg", cfg)
+		c.Set("clients", clients)
 		c.Next()
 	})
 
 	v1 := router.Group(BASE_PATH)
 	{
 		v1.POST(UPLOAD_ENDPOINT, auth.SaAuth, apiV1.HandleRequestUpload)
+		v1.POST(KEY_ENDPOINT, auth.SaAuth, apiV1.HandleRequestKey)
+		v1.POST(COMPLETE_UPLOAD_ENDPOINT, auth.SaAuth, apiV1.HandleCompleteUpload)
+		v1.POST(ABORT_UPLOAD_ENDPOINT, auth.SaAuth, apiV1.HandleAbortUpload)
 	}
 	router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerfiles.Handler))
 	router.GET("/health", requests.Health)
@@ -42,3 +59,26 @@ func Serve(cfg *config.AppConfig) {
 
 	router.Run(":" + fmt.Sprint(cfg.App.Port))
 }
+
+// newClients creates the Vault and S3 clients shared by all requests. Vault
+// logins and the bucket region lookup are retried later if they fail now.
+func newClients(cfg *config.AppConfig) *utils.Clients {
+	vaultSession, err := utils.NewVaultSession(context.Background(), cfg.Vault.VaultRole, cfg.Vault.VaultAuthMountPath, cfg.ServiceAccount.JWTokenMountPoint)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "Serve",
+		}).Fatalf(fmt.Sprintf("unable to initialize Vault Client : %s", err.Error()))
+	}
+	s3Session, err := utils.NewS3Session(cfg.App.Bucket)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "Serve",
+		}).Fatalf(fmt.Sprintf("unable to initialize AWS Client : %s", err.Error()))
+	}
+	if _, err := s3Session.Client(); err != nil {
+		log.WithFields(log.Fields{
+			"caller": "Serve",
+		}).Warn(err.Error())
+	}
+	return &utils.Clients{Vault: vaultSession, S3: s3Session}
+}
@@ -0,0 +1,360 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/metrics"
+	"github.com/hashicorp/vault/api"
+	vaultAuth "github.com/hashicorp/vault/api/auth/kubernetes"
+	vaultTransit "github.com/mittwald/vaultgo"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrVaultUnavailable and ErrAWSUnavailable mark errors of Vault or AWS
+// not being reachable for now, requests failing with them may be retried.
+var ErrVaultUnavailable = errors.New("Vault is unavailable")
+var ErrAWSUnavailable = errors.New("AWS is unavailable")
+
+// VaultError marks err of a Vault request as ErrVaultUnavailable if Vault
+// could not be reached or failed itself. Answers to the request, like an
+// unknown transit key, are returned as they are.
+func VaultError(err error) error {
+	if err == nil || errors.Is(err, ErrVaultUnavailable) {
+		return err
+	}
+	var responseErr *api.ResponseError
+	if errors.As(err, &responseErr) {
+		if unavailableStatus(responseErr.StatusCode) {
+			return fmt.Errorf("%w: %w", ErrVaultUnavailable, err)
+		}
+		return err
+	}
+	if transportError(err) {
+		return fmt.Errorf("%w: %w", ErrVaultUnavailable, err)
+	}
+	return err
+}
+
+// AWSError marks err of an AWS request as ErrAWSUnavailable if AWS could
+// not be reached or failed itself, errors of the request are returned as
+// they are.
+func AWSError(err error) error {
+	if err == nil || errors.Is(err, ErrAWSUnavailable) {
+		return err
+	}
+	for cause := err; cause != nil; {
+		var requestFailure awserr.RequestFailure
+		if errors.As(cause, &requestFailure) && unavailableStatus(requestFailure.StatusCode()) {
+			return fmt.Errorf("%w: %w", ErrAWSUnavailable, err)
+		}
+		var awsErr awserr.Error
+		if !errors.As(cause, &awsErr) {
+			if transportError(cause) {
+				return fmt.Errorf("%w: %w", ErrAWSUnavailable, err)
+			}
+			break
+		}
+		switch awsErr.Code() {
+		case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, "RequestTimeout":
+			return fmt.Errorf("%w: %w", ErrAWSUnavailable, err)
+		}
+		// credentials are fetched from STS and friends on the first
+		// request, their failure is wrapped in the error of the request
+		cause = awsErr.OrigErr()
+	}
+	return err
+}
+
+func unavailableStatus(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+func transportError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+const vaultLoginMinBackoff = time.Second
+const vaultLoginMaxBackoff = time.Minute
+
+// Clients are created once at startup and shared by all requests.
+type Clients struct {
+	Vault *VaultSession
+	S3    *S3Session
+}
+
+// VaultSession keeps a transit client logged in to Vault with Kubernetes
+// auth. Its token is renewed by a lifetime watcher, once it can not be
+// renewed any longer the session logs in again.
+type VaultSession struct {
+	client *vaultTransit.Client
+	login  func(ctx context.Context) (*api.Secret, error)
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu       sync.RWMutex
+	loggedIn bool
+	expiry   time.Time
+	err      error
+}
+
+// NewVaultSession creates the transit client for VAULT_ADDR, logs in and
+// keeps the token alive until ctx is done. A failed login does not fail the
+// session, it keeps trying in the background and Client returns the error
+// until it succeeds.
+func NewVaultSession(ctx context.Context, role string, mountPath string, jwtLocation string) (*VaultSession, error) {
+	vaultURL, found := os.LookupEnv("VAULT_ADDR")
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Could not find valid vault URL on env: %s", "VAULT_ADDR"))
+	}
+
+	client, err := vaultTransit.NewClient(vaultURL, vaultTransit.WithCaPath(""))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating Transit Vault Client: %s", err.Error()))
+	}
+
+	k8sAuth, err := vaultAuth.NewKubernetesAuth(
+		role,
+		vaultAuth.WithServiceAccountTokenPath(jwtLocation),
+		vaultAuth.WithMountPath(mountPath),
+	)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to initialize Vault Authentication : %s", err.Error()))
+	}
+
+	s := newVaultSession(client, func(ctx context.Context) (*api.Secret, error) {
+		return client.Auth().Login(ctx, k8sAuth)
+	})
+	s.start(ctx)
+	return s, nil
+}
+
+func newVaultSession(client *vaultTransit.Client, login func(ctx context.Context) (*api.Secret, error)) *VaultSession {
+	return &VaultSession{
+		client:     client,
+		login:      login,
+		minBackoff: vaultLoginMinBackoff,
+		maxBackoff: vaultLoginMaxBackoff,
+	}
+}
+
+// Client returns the logged in transit client, or an ErrVaultUnavailable
+// telling why there is none.
+func (s *VaultSession) Client() (*vaultTransit.Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.loggedIn {
+		return nil, fmt.Errorf("%w, not logged in: %s", ErrVaultUnavailable, s.err)
+	}
+	if !s.expiry.IsZero() && time.Now().After(s.expiry) {
+		if s.err != nil {
+			return nil, fmt.Errorf("%w, token expired and logging in again failed: %s", ErrVaultUnavailable, s.err)
+		}
+		return nil, fmt.Errorf("%w, token expired", ErrVaultUnavailable)
+	}
+	return s.client, nil
+}
+
+func (s *VaultSession) start(ctx context.Context) {
+	secret, _ := s.logIn(ctx)
+	go s.run(ctx, secret)
+}
+
+// run keeps the session logged in until ctx is done.
+func (s *VaultSession) run(ctx context.Context, secret *api.Secret) {
+	for {
+		if secret == nil {
+			secret = s.relogin(ctx)
+			if secret == nil {
+				return
+			}
+		}
+		s.keepAlive(ctx, secret)
+		if ctx.Err() != nil {
+			return
+		}
+		secret = nil
+	}
+}
+
+// relogin logs in until it succeeds, backing off exponentially. It returns
+// nil once ctx is done.
+func (s *VaultSession) relogin(ctx context.Context) *api.Secret {
+	backoff := s.minBackoff
+	for {
+		secret, err := s.logIn(ctx)
+		if err == nil {
+			return secret
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+func (s *VaultSession) logIn(ctx context.Context) (*api.Secret, error) {
+	secret, err := s.login(ctx)
+	if err == nil && (secret == nil || secret.Auth == nil) {
+		err = errors.New("no auth info was returned after login")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		metrics.VaultLoginFailures.Inc()
+		log.WithFields(log.Fields{
+			"caller": "VaultSession",
+		}).Warn(fmt.Sprintf("unable to log in with Kubernetes auth : %s", err.Error()))
+		s.err = err
+		return nil, err
+	}
+	s.loggedIn = true
+	s.err = nil
+	s.setExpiry(secret.Auth.LeaseDuration)
+	return secret, nil
+}
+
+// setExpiry records when the token runs out after a login or renewal. A
+// lease duration of 0 never expires. The caller holds the lock.
+func (s *VaultSession) setExpiry(leaseDuration int) {
+	s.expiry = time.Time{}
+	if leaseDuration > 0 {
+		s.expiry = time.Now().Add(time.Duration(leaseDuration) * time.Second)
+	}
+}
+
+// keepAlive renews the token of secret and returns once a new login is
+// due or ctx is done.
+func (s *VaultSession) keepAlive(ctx context.Context, secret *api.Secret) {
+	if !secret.Auth.Renewable {
+		if secret.Auth.LeaseDuration == 0 {
+			<-ctx.Done()
+			return
+		}
+		// Log in again well before the token runs out.
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(secret.Auth.LeaseDuration) * time.Second * 2 / 3):
+		}
+		return
+	}
+
+	watcher, err := s.client.NewLifetimeWatcher(&api.LifetimeWatcherInput{
+		Secret:        secret,
+		RenewBehavior: api.RenewBehaviorErrorOnErrors,
+	})
+	if err != nil {
+		metrics.VaultRenewalFailures.Inc()
+		log.WithFields(log.Fields{
+			"caller": "VaultSession",
+		}).Warn(fmt.Sprintf("unable to watch the Vault token : %s", err.Error()))
+		return
+	}
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.DoneCh():
+			// A token that reached its max TTL is not renewable any longer,
+			// that is no failure.
+			if err != nil && !errors.Is(err, api.ErrLifetimeWatcherNotRenewable) {
+				metrics.VaultRenewalFailures.Inc()
+				log.WithFields(log.Fields{
+					"caller": "VaultSession",
+				}).Warn(fmt.Sprintf("unable to renew the Vault token, logging in again : %s", err.Error()))
+			}
+			return
+		case renewal := <-watcher.RenewCh():
+			if renewal.Secret != nil && renewal.Secret.Auth != nil {
+				s.mu.Lock()
+				s.setExpiry(renewal.Secret.Auth.LeaseDuration)
+				s.mu.Unlock()
+			}
+			log.WithFields(log.Fields{
+				"caller": "VaultSession",
+			}).Debug("Renewed the Vault token")
+		}
+	}
+}
+
+// S3Session shares one AWS session for the bucket. The region of the bucket
+// is looked up once, the S3 client is created on first use and cached.
+type S3Session struct {
+	bucket       string
+	sess         *session.Session
+	lookupRegion func(ctx context.Context, sess *session.Session, bucket string) (string, error)
+
+	mu     sync.Mutex
+	client s3iface.S3API
+}
+
+func NewS3Session(bucketName string) (*S3Session, error) {
+	cfg := aws.NewConfig().
+		WithEC2MetadataDisableTimeoutOverride(true).
+		WithCredentialsChainVerboseErrors(true)
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error creating AWS session: %s", err.Error()))
+	}
+	return &S3Session{
+		bucket:       bucketName,
+		sess:         sess,
+		lookupRegion: bucketRegion,
+	}, nil
+}
+
+func bucketRegion(ctx context.Context, sess *session.Session, bucketName string) (string, error) {
+	return s3manager.GetBucketRegion(ctx, sess, bucketName, endpoints.EuCentral1RegionID)
+}
+
+// Client returns the S3 client for the region of the bucket. A failed region
+// lookup is an ErrAWSUnavailable and not cached, the next call tries again.
+func (s *S3Session) Client() (s3iface.S3API, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	region, err := s.lookupRegion(aws.BackgroundContext(), s.sess, s.bucket)
+	if err != nil {
+		return nil, fmt.Errorf("%w, looking up the region of bucket %s failed: %s", ErrAWSUnavailable, s.bucket, err.Error())
+	}
+	s.client = s3.New(s.sess, &aws.Config{
+		Region: aws.String(region),
+	})
+	return s.client, nil
+}
+
+// Session is the AWS session the S3 client is created from.
+func (s *S3Session) Session() *session.Session {
+	return s.sess
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/dbschenker/heap-dump-management/heap-dump-service/internal/metrics"
+	"github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func loginSecret(leaseDuration int) *api.Secret {
+	return &api.Secret{Auth: &api.SecretAuth{ClientToken: "token", LeaseDuration: leaseDuration}}
+}
+
+func TestVaultSessionLogsInBeforeExpiry(t *testing.T) {
+	var logins int32
+	s := newVaultSession(nil, func(ctx context.Context) (*api.Secret, error) {
+		atomic.AddInt32(&logins, 1)
+		return loginSecret(1), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.start(ctx)
+
+	if _, err := s.Client(); err != nil {
+		t.Errorf("Want a client after login, got %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if got := atomic.LoadInt32(&logins); got < 2 {
+		t.Errorf("Want a new login before the token expires, got %d logins", got)
+	}
+}
+
+func TestVaultSessionRetriesLogin(t *testing.T) {
+	failures := testutil.ToFloat64(metrics.VaultLoginFailures)
+	var logins int32
+	s := newVaultSession(nil, func(ctx context.Context) (*api.Secret, error) {
+		if atomic.AddInt32(&logins, 1) <= 2 {
+			return nil, errors.New("permission denied")
+		}
+		return loginSecret(0), nil
+	})
+	s.minBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.start(ctx)
+
+	if _, err := s.Client(); !errors.Is(err, ErrVaultUnavailable) {
+		t.Errorf("Want Vault to be unavailable before the first successful login, got %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := s.Client(); err != nil {
+		t.Errorf("Want a client after retrying the login, got %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.VaultLoginFailures) - failures; got != 2 {
+		t.Errorf("Want 2 counted login failures, got %v", got)
+	}
+}
+
+func TestVaultSessionExpiredToken(t *testing.T) {
+	s := newVaultSession(nil, nil)
+	s.loggedIn = true
+	s.expiry = time.Now().Add(-time.Second)
+
+	if _, err := s.Client(); !errors.Is(err, ErrVaultUnavailable) {
+		t.Errorf("Want Vault to be unavailable with an expired token, got %v", err)
+	}
+}
+
+func TestS3SessionCachesRegion(t *testing.T) {
+	sess, err := session.NewSession(aws.NewConfig())
+	if err != nil {
+		t.Fatalf("Could not create session: %v", err)
+	}
+	lookups := 0
+	s := &S3Session{
+		bucket: "dumps",
+		sess:   sess,
+		lookupRegion: func(ctx context.Context, sess *session.Session, bucket string) (string, error) {
+			lookups++
+			if lookups == 1 {
+				return "", errors.New("no network")
+			}
+			return "eu-west-1", nil
+		},
+	}
+
+	if _, err := s.Client(); !errors.Is(err, ErrAWSUnavailable) {
+		t.Errorf("Want AWS to be unavailable if the region lookup fails, got %v", err)
+	}
+	first, err := s.Client()
+	if err != nil {
+		t.Fatalf("Want a client after the region was found, got %v", err)
+	}
+	second, _ := s.Client()
+	if first != second {
+		t.Errorf("Want the cached client on every call")
+	}
+	if lookups != 2 {
+		t.Errorf("Want the region looked up until it was found once, got %d lookups", lookups)
+	}
+}
+
+func TestVaultError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		unavailable bool
+	}{
+		{"sealed", &api.ResponseError{StatusCode: 503, Errors: []string{"Vault is sealed"}}, true},
+		{"not reachable", &url.Error{Op: "Put", URL: "https://vault:8200", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, true},
+		{"unknown key", &api.ResponseError{StatusCode: 400, Errors: []string{"encryption key not found"}}, false},
+		{"permission denied", &api.ResponseError{StatusCode: 403}, false},
+	}
+	for _, test := range tests {
+		err := VaultError(fmt.Errorf("request failed: %w", test.err))
+		if errors.Is(err, ErrVaultUnavailable) != test.unavailable {
+			t.Errorf("%s: got %v, want unavailable %t", test.name, err, test.unavailable)
+		}
+	}
+	if err := VaultError(VaultError(&api.ResponseError{StatusCode: 500})); strings.Count(err.Error(), ErrVaultUnavailable.Error()) != 1 {
+		t.Errorf("Want an error marked once, got %v", err)
+	}
+}
@@ -1,15 +1,12 @@
 package utils
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"net/url"
-	"os"
+	"strings"
 
-	"github.com/hashicorp/vault/api"
 	vault "github.com/hashicorp/vault/api"
-	vaultAuth "github.com/hashicorp/vault/api/auth/kubernetes"
 	vaultTransit "github.com/mittwald/vaultgo"
 	log "github.com/sirupsen/logrus"
 )
@@ -35,71 +32,6 @@ func CheckVaultAccess(client *vault.Client) error {
 	return nil
 }
 
-func GenerateVaultClient(role string, mountPath string, jwtLocation string) (*api.Client, error) {
-	config := api.DefaultConfig()
-
-	k8sAuth, err := vaultAuth.NewKubernetesAuth(
-		role,
-		vaultAuth.WithServiceAccountTokenPath(jwtLocation),
-		vaultAuth.WithMountPath(mountPath),
-	)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "GenerateVaultClient",
-		}).Fatalf(fmt.Sprintf("unable to initialize Vault Authentication : %s", err.Error()))
-	}
-
-	vanillaVaultclient, err := api.NewClient(config)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "GenerateVaultClient",
-		}).Warn(fmt.Sprintf("unable to initialize Vanilla Vault Client : %s", err.Error()))
-		return nil, errors.New(fmt.Sprintf("unable to initialize Vanilla Vault Client : %s", err.Error()))
-	}
-	authInfo, err := vanillaVaultclient.Auth().Login(context.Background(), k8sAuth)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "GenerateVaultClient",
-		}).Warn(fmt.Sprintf("unable to log in with Kubernetes auth : %s", err.Error()))
-		return nil, errors.New(fmt.Sprintf("unable to log in with Kubernetes auth: %s", err.Error()))
-	}
-	if authInfo == nil {
-		log.WithFields(log.Fields{
-			"caller": "GenerateVaultClient",
-		}).Warn(fmt.Sprintf("no auth info was returned after login"))
-		return nil, errors.New(fmt.Sprintf("no auth info was returned after login"))
-	}
-	return vanillaVaultclient, nil
-}
-
-func GenerateTransitVaultClient(role string, mountPath string, jwtLocation string) (*vaultTransit.Client, error) {
-
-	vaultURL, found := os.LookupEnv("VAULT_ADDR")
-	if !found {
-		log.WithFields(log.Fields{
-			"caller": "GenerateTransitVaultClient",
-		}).Error(fmt.Sprintf("Could not find valid vault URL on env: %s", "VAULT_ADDR"))
-		return nil, errors.New(fmt.Sprintf("Could not find valid vault URL on env: %s", "VAULT_ADDR"))
-	}
-
-	c, err := vaultTransit.NewClient(
-		vaultURL,
-		vaultTransit.WithCaPath(""),
-		vaultTransit.WithKubernetesAuth(
-			role,
-			vaultTransit.WithJwtFromFile(jwtLocation),
-			vaultTransit.WithMountPoint(mountPath),
-		),
-	)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"caller": "GenerateTransitVaultClient",
-		}).Error(fmt.Sprintf("Error creating Transit Vault Client: %s", err.Error()))
-		return nil, err
-	}
-	return c, nil
-}
-
 func TransitEncryptString(client *vaultTransit.Client, mountPoint string, topicKey string, key string) (string, error) {
 
 	transit := client.TransitWithMountPoint(mountPoint)
@@ -111,8 +43,39 @@ func TransitEncryptString(client *vaultTransit.Client, mountPoint string, topicK
 		log.WithFields(log.Fields{
 			"caller": "TransitEncryptString",
 		}).Error(fmt.Sprintf("Error occurred during encryption: %s", err.Error()))
-		return "", err
+		return "", VaultError(err)
 	}
 
 	return encryptResponse.Data.Ciphertext, nil
 }
+
+// TransitPublicKey returns the PEM encoded public key of the latest version
+// of an RSA transit key along with that version. Data keys wrapped with it
+// can be decrypted with the transit key like any other ciphertext.
+func TransitPublicKey(client *vaultTransit.Client, mountPoint string, topicKey string) (string, int, error) {
+	transit := client.TransitWithMountPoint(mountPoint)
+
+	readResponse, err := transit.Read(topicKey)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "TransitPublicKey",
+		}).Error(fmt.Sprintf("Error reading transit key %s: %s", topicKey, err.Error()))
+		return "", 0, fmt.Errorf("Error reading transit key %s: %w", topicKey, VaultError(err))
+	}
+	return latestPublicKey(readResponse.Data)
+}
+
+func latestPublicKey(key vaultTransit.TransitReadResponseData) (string, int, error) {
+	if !strings.HasPrefix(key.Type, "rsa-") {
+		return "", 0, errors.New(fmt.Sprintf("Transit key %s can not wrap keys, it is of type %s instead of rsa", key.Name, key.Type))
+	}
+	version, ok := key.Keys[key.LatestVersion].(map[string]interface{})
+	if !ok {
+		return "", 0, errors.New(fmt.Sprintf("Transit key %s has no version %d", key.Name, key.LatestVersion))
+	}
+	publicKey, ok := version["public_key"].(string)
+	if !ok || publicKey == "" {
+		return "", 0, errors.New(fmt.Sprintf("Transit key %s has no public key", key.Name))
+	}
+	return publicKey, key.LatestVersion, nil
+}
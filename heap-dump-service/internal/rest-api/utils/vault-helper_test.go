@@ -2,7 +2,12 @@ package utils
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"os"
 	"testing"
@@ -169,3 +174,67 @@ func TestCheckVaultAccess(t *testing.T) {
 		t.Errorf("Failed Health Check: %s", err.Error())
 	}
 }
+
+func TestTransitPublicKey(t *testing.T) {
+	testClient, err := vaultTransit.NewClient(Vault.URI(), vaultTransit.WithCaPath(""), vaultTransit.WithAuthToken(Vault.token))
+	if err != nil {
+		t.Fatalf("Error creating test client: %s", err.Error())
+	}
+	transit := testClient.TransitWithMountPoint("transit")
+	if err := transit.Create("wrapping-topic", &vaultTransit.TransitCreateOptions{Type: "rsa-2048"}); err != nil {
+		t.Fatalf("Error creating rsa key: %s", err.Error())
+	}
+
+	publicKeyPEM, version, err := TransitPublicKey(testClient, "transit", "wrapping-topic")
+	if err != nil {
+		t.Fatalf("Error reading public key: %s", err.Error())
+	}
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		t.Fatalf("Public key is not PEM encoded: %s", publicKeyPEM)
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatalf("Error parsing public key: %s", err.Error())
+	}
+
+	// a key wrapped with the public key decrypts like any transit ciphertext
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey.(*rsa.PublicKey), []byte("data key"), nil)
+	if err != nil {
+		t.Fatalf("Error wrapping key: %s", err.Error())
+	}
+	decrypted, err := transit.Decrypt("wrapping-topic", &vaultTransit.TransitDecryptOptions{
+		Ciphertext: fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(wrapped)),
+	})
+	if err != nil {
+		t.Fatalf("Error unwrapping key: %s", err.Error())
+	}
+	if decrypted.Data.Plaintext != "data key" {
+		t.Errorf("got %s, want data key", decrypted.Data.Plaintext)
+	}
+
+	if _, _, err := TransitPublicKey(testClient, "transit", "test-topic"); err == nil {
+		t.Errorf("aes keys can not wrap keys")
+	}
+}
+
+func TestLatestPublicKey(t *testing.T) {
+	key := vaultTransit.TransitReadResponseData{
+		Name:          "topic",
+		Type:          "rsa-4096",
+		LatestVersion: 2,
+		Keys: map[int]interface{}{
+			1: map[string]interface{}{"public_key": "old"},
+			2: map[string]interface{}{"public_key": "new"},
+		},
+	}
+	publicKey, version, err := latestPublicKey(key)
+	if err != nil || publicKey != "new" || version != 2 {
+		t.Errorf("got %s, %d, %v, want new, 2", publicKey, version, err)
+	}
+
+	key.Type = "aes256-gcm96"
+	if _, _, err := latestPublicKey(key); err == nil {
+		t.Errorf("aes keys can not wrap keys")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
+)
+
+const (
+	stagingDirName = "heap-dump-staging"
+	stagedSuffix   = ".staged"
+	// stagingReserve is left free on the staging volume for everything
+	// else writing to it
+	stagingReserve = 64 << 20
+)
+
+// errNotStaged tells that there was no room to stage the compressed dump,
+// it is uploaded as it is instead.
+var errNotStaged = errors.New("compressed dump not staged")
+
+// freeSpace returns the bytes available in a directory, tests replace it.
+var freeSpace = diskFree
+
+// stagingDir defaults to the temporary directory, so staging never fills
+// the volume the dumps are written to.
+func stagingDir(cfg config.AppConfig) string {
+	if cfg.Compression.StagingPath != "" {
+		return cfg.Compression.StagingPath
+	}
+	return filepath.Join(os.TempDir(), stagingDirName)
+}
+
+// stagingWriter fails once more than limit bytes are written and records
+// whether writing the staged file failed.
+type stagingWriter struct {
+	file  *os.File
+	limit int64
+	err   error
+}
+
+func (w *stagingWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.limit {
+		w.err = errors.New(fmt.Sprintf("more than the %d bytes available", w.limit))
+		return 0, w.err
+	}
+	n, err := w.file.Write(p)
+	w.limit -= int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// stageCompressed compresses dump of size bytes into the staging
+// directory. Unlike the encryption this can not happen while uploading, as
+// the size of the compressed dump is needed to request the upload URLs.
+// The staged file is kept below the free space of the staging directory
+// and the size of the dump, a compressed dump that would grow beyond
+// either is not worth staging. errNotStaged is returned then or if writing
+// the staged file fails otherwise. The staged file is removed on every
+// error, else the caller removes it with removeStaged.
+func stageCompressed(cfg config.AppConfig, file string, dump io.Reader, size int64, compression utils.Compression) (*os.File, int64, error) {
+	dir := stagingDir(cfg)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, 0, fmt.Errorf("%w: could not create staging directory %s: %s", errNotStaged, dir, err.Error())
+	}
+	limit := size
+	if free, err := freeSpace(dir); err != nil {
+		log.WithFields(log.Fields{
+			"caller": "stageCompressed",
+		}).Warn(fmt.Sprintf("Could not determine the free space in %s: %s", dir, err.Error()))
+	} else {
+		limit = min(limit, free-stagingReserve)
+	}
+	if limit <= 0 {
+		return nil, 0, fmt.Errorf("%w: no space left in %s", errNotStaged, dir)
+	}
+	staged, err := os.CreateTemp(dir, filepath.Base(file)+"-*"+stagedSuffix)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %s", errNotStaged, err.Error())
+	}
+
+	start := time.Now()
+	writer := &stagingWriter{file: staged, limit: limit}
+	if err := utils.Compress(writer, dump, compression, cfg.Compression.Level); err != nil {
+		removeStaged(staged)
+		if writer.err != nil {
+			return nil, 0, fmt.Errorf("%w: staging %s in %s: %s", errNotStaged, file, dir, writer.err.Error())
+		}
+		return nil, 0, err
+	}
+	info, err := staged.Stat()
+	if err != nil {
+		removeStaged(staged)
+		return nil, 0, errors.New(fmt.Sprintf("Error staging %s: %s", file, err.Error()))
+	}
+	log.WithFields(log.Fields{
+		"caller": "stageCompressed",
+	}).Info(fmt.Sprintf("Compressed %s with %s to %d bytes in %v", file, compression, info.Size(), time.Since(start).Round(time.Millisecond)))
+	return staged, info.Size(), nil
+}
+
+func removeStaged(staged *os.File) {
+	staged.Close()
+	os.Remove(staged.Name())
+}
+
+// cleanStaging removes files left behind by a sidecar that was stopped
+// while compressing or uploading, the journal restarts those uploads.
+func cleanStaging(cfg config.AppConfig) {
+	leftovers, _ := filepath.Glob(filepath.Join(stagingDir(cfg), "*"+stagedSuffix))
+	for _, leftover := range leftovers {
+		if err := os.Remove(leftover); err != nil {
+			log.WithFields(log.Fields{
+				"caller": "cleanStaging",
+			}).Warn(fmt.Sprintf("Could not remove staged file %s: %s", leftover, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	cfg "github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
+)
+
+func TestStageCompressed(t *testing.T) {
+	var config cfg.AppConfig
+	config.WatchPath.Path = t.TempDir()
+	config.Compression.Algorithm = "zstd"
+	config.Compression.StagingPath = t.TempDir()
+	plainText := []byte(strings.Repeat("JAVA PROFILE 1.0.2", 10000))
+
+	staged, size, err := stageCompressed(config, "/dumps/test.hprof", bytes.NewReader(plainText), int64(len(plainText)), utils.CompressionZstd)
+	if err != nil {
+		t.Fatalf("Failed to stage: %v", err)
+	}
+	if filepath.Dir(staged.Name()) != config.Compression.StagingPath {
+		t.Errorf("staged as %s, want it in %s", staged.Name(), config.Compression.StagingPath)
+	}
+	if size <= 0 || size >= int64(len(plainText)) {
+		t.Errorf("staged size %d for %d bytes of plaintext", size, len(plainText))
+	}
+	dec, _ := zstd.NewReader(io.NewSectionReader(staged, 0, size))
+	got, err := io.ReadAll(dec)
+	dec.Close()
+	if err != nil || !bytes.Equal(got, plainText) {
+		t.Errorf("staged file does not decompress to the dump: %v", err)
+	}
+
+	removeStaged(staged)
+	if _, err := os.Stat(staged.Name()); !os.IsNotExist(err) {
+		t.Errorf("staged file was not removed: %v", err)
+	}
+}
+
+func TestStagingDirDefault(t *testing.T) {
+	var config cfg.AppConfig
+	config.WatchPath.Path = "/dumps"
+	if dir := stagingDir(config); strings.HasPrefix(dir, config.WatchPath.Path) {
+		t.Errorf("staging in %s on the watched volume", dir)
+	}
+	config.Compression.StagingPath = "/staging"
+	if dir := stagingDir(config); dir != "/staging" {
+		t.Errorf("staging in %s, want the configured /staging", dir)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
+
+func TestStageCompressedCleansUp(t *testing.T) {
+	incompressible := make([]byte, 1<<20)
+	rand.Read(incompressible)
+	compressible := []byte(strings.Repeat("JAVA PROFILE 1.0.2", 10000))
+	tests := []struct {
+		name      string
+		dump      io.Reader
+		size      int64
+		free      int64
+		notStaged bool
+	}{
+		{"no space", bytes.NewReader(compressible), int64(len(compressible)), stagingReserve, true},
+		{"less space than compressed", bytes.NewReader(compressible), int64(len(compressible)), stagingReserve + 16, true},
+		{"larger than the dump", bytes.NewReader(incompressible), int64(len(incompressible)), 1 << 40, true},
+		{"dump not readable", failingReader{}, 1 << 20, 1 << 40, false},
+	}
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config cfg.AppConfig
+			config.Compression.StagingPath = t.TempDir()
+			freeSpace = func(string) (int64, error) { return test.free, nil }
+
+			staged, _, err := stageCompressed(config, "/dumps/test.hprof", test.dump, test.size, utils.CompressionZstd)
+			if err == nil {
+				removeStaged(staged)
+				t.Fatalf("staged without error")
+			}
+			if errors.Is(err, errNotStaged) != test.notStaged {
+				t.Errorf("got %v, want errNotStaged %t", err, test.notStaged)
+			}
+			if leftovers, _ := os.ReadDir(config.Compression.StagingPath); len(leftovers) != 0 {
+				t.Errorf("left %d files in the staging directory", len(leftovers))
+			}
+		})
+	}
+}
+
+func TestCleanStaging(t *testing.T) {
+	var config cfg.AppConfig
+	config.Compression.StagingPath = t.TempDir()
+	leftover := filepath.Join(config.Compression.StagingPath, "test.hprof-123"+stagedSuffix)
+	other := filepath.Join(config.Compression.StagingPath, "keep")
+	os.WriteFile(leftover, []byte("x"), 0o600)
+	os.WriteFile(other, []byte("x"), 0o600)
+
+	cleanStaging(config)
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover was not removed: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file was removed: %v", err)
+	}
+}
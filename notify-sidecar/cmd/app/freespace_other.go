@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func diskFree(dir string) (int64, error) {
+	return 0, errors.New("free space is only known on Linux")
+}
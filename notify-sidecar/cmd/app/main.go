@@ -1,155 +1,500 @@
 package main
 
 import (
-	"container/list"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
-	"io/ioutil"
+	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/artifact"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/journal"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/logging"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
 )
 
-func handleNewHeapDump(fileSystem fs.FS, cfg config.AppConfig, file string) error {
-	response := new(models.SigningResponse)
-	err := utils.RequestUploadConfig(fileSystem, cfg, file, response)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error requesting upload URL: %s", err.Error()))
-	}
-	key, err := base64.StdEncoding.DecodeString(response.AesKey)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error decoding aes key: %s", err.Error()))
+const (
+	defaultRetryAttempts     = 5
+	defaultRetryInitialDelay = time.Second
+	defaultRetryMaxDelay     = time.Minute
+)
+
+func retryBackoff(cfg config.AppConfig) utils.Backoff {
+	backoff := utils.Backoff{
+		Attempts:     cfg.Retry.Attempts,
+		InitialDelay: time.Duration(cfg.Retry.InitialDelaySeconds) * time.Second,
+		MaxDelay:     time.Duration(cfg.Retry.MaxDelaySeconds) * time.Second,
 	}
-	entryptedFileLocation, err := utils.EncryptDump(fileSystem, strings.TrimPrefix(file, "/"), key)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error encrypting dump: %s", err.Error()))
+	if backoff.Attempts == 0 {
+		backoff.Attempts = defaultRetryAttempts
 	}
-	encryptDumpFileHandler, err := os.Open(entryptedFileLocation)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error reading %s: %s", entryptedFileLocation, err.Error()))
+	if backoff.InitialDelay == 0 {
+		backoff.InitialDelay = defaultRetryInitialDelay
 	}
-	encryptedKeyFile, err := os.CreateTemp("/tmp", "key")
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error creating tmp file %s: %s", encryptedKeyFile.Name(), err.Error()))
+	if backoff.MaxDelay == 0 {
+		backoff.MaxDelay = defaultRetryMaxDelay
 	}
-	_, err = encryptedKeyFile.WriteString(response.EncryptedAesKey)
+	return backoff
+}
 
-	if err != nil {
-		return errors.New(fmt.Sprintf("Error writing encrypted AesKey to file %s: %s", encryptedKeyFile.Name(), err.Error()))
+// uploadMultipart uploads the parts and completes the upload. Completing is
+// retried with the uploaded parts, once the upload can not be finished it is
+// aborted so no parts are left behind in the bucket.
+func uploadMultipart(fileSystem fs.FS, cfg config.AppConfig, payload models.Payload, response *models.SigningResponse, envelope *utils.Envelope) error {
+	parts, err := utils.UploadMultipart(response.PartURLs, response.PartSize, envelope.NewSectionReader, envelope.Size(), utils.MultipartOptions{
+		Concurrency: cfg.Upload.Concurrency,
+		Backoff:     retryBackoff(cfg),
+		PartHeaders: response.PartHeaders,
+	})
+	if err == nil {
+		err = retryBackoff(cfg).Retry("Completing the multipart upload", func() error {
+			return utils.CompleteMultipartUpload(fileSystem, cfg, payload, response.UploadID, parts)
+		}, utils.Transient)
 	}
-	err = utils.UploadToS3(response.URL, encryptDumpFileHandler)
 	if err != nil {
+		if abortErr := utils.AbortMultipartUpload(fileSystem, cfg, payload, response.UploadID); abortErr != nil {
+			log.WithFields(log.Fields{
+				"caller": "uploadMultipart",
+			}).Warn(abortErr.Error())
+		}
 		return err
 	}
+	return nil
+}
 
-	encryptedKeyFileHandler, err := os.Open(encryptedKeyFile.Name())
-
-	defer encryptedKeyFileHandler.Close()
-	defer os.Remove(encryptedKeyFile.Name())
-	defer os.Remove(entryptedFileLocation)
-	defer os.Remove(file)
+// saveJournal records the progress of an upload. A journal that can not be
+// written only matters after a restart, so the upload goes on.
+func saveJournal(jrnl *journal.Journal, entry *journal.Entry) {
+	if err := jrnl.Save(entry); err != nil {
+		log.WithFields(log.Fields{
+			"caller": "saveJournal",
+		}).Warn(err.Error())
+	}
+}
 
+// uploadKeyAndManifest stores the encrypted key and the manifest next to
+// the uploaded dump. Expired URLs are replaced by new ones for the same
+// objects.
+func uploadKeyAndManifest(fileSystem fs.FS, cfg config.AppConfig, jrnl *journal.Journal, entry *journal.Entry) error {
+	// The dump is uploaded at this point, retrying the whole upload would
+	// store it a second time under a new name.
+	expired := false
+	err := retryBackoff(cfg).Retry("Upload of the encrypted key", func() error {
+		if expired {
+			if err := refreshKeyURLs(fileSystem, cfg, jrnl, entry); err != nil {
+				return err
+			}
+		}
+		err := utils.UploadToS3(entry.EncryptedAesKeyURL, strings.NewReader(entry.EncryptedAesKey), int64(len(entry.EncryptedAesKey)), nil)
+		expired = utils.Classify(err) == utils.Expired
+		return err
+	}, utils.Transient, utils.Expired)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error Creating FileHandler for %s: %s", encryptedKeyFile.Name(), err.Error()))
+		return err
+	}
+	uploadManifest(cfg, entry)
+	entry.State = journal.Completed
+	saveJournal(jrnl, entry)
+	return nil
+}
+
+// refreshKeyURLs replaces the expired key, manifest and HEAD URLs of entry.
+func refreshKeyURLs(fileSystem fs.FS, cfg config.AppConfig, jrnl *journal.Journal, entry *journal.Entry) error {
+	response := new(models.SigningResponse)
+	if err := utils.RequestKeyURLs(fileSystem, cfg, entry.Payload, entry.EncryptedAesKey, response); err != nil {
+		return fmt.Errorf("Error requesting new URLs for the key of %s: %w", entry.File, err)
 	}
+	entry.EncryptedAesKeyURL = response.EncryptedAesKeyURL
+	entry.ManifestURL = response.ManifestURL
+	entry.HeadURL = response.HeadURL
+	saveJournal(jrnl, entry)
+	return nil
+}
 
-	err = utils.UploadToS3(response.EncryptedAesKeyURL, encryptedKeyFileHandler)
-	if err != nil {
+// dumpStored tells whether the dump of an interrupted upload was stored
+// anyway, e.g. if the sidecar stopped right after the last byte was sent.
+// Expired URLs are replaced by new ones. Without a HEAD URL the dump is
+// taken as not stored.
+func dumpStored(fileSystem fs.FS, cfg config.AppConfig, jrnl *journal.Journal, entry *journal.Entry) (bool, error) {
+	stored := false
+	expired := false
+	err := retryBackoff(cfg).Retry("Checking for the stored dump", func() error {
+		if expired {
+			if err := refreshKeyURLs(fileSystem, cfg, jrnl, entry); err != nil {
+				return err
+			}
+		}
+		if entry.HeadURL == "" {
+			return nil
+		}
+		var err error
+		stored, err = utils.ObjectStored(entry.HeadURL, entry.Payload.Size)
+		expired = utils.Classify(err) == utils.Expired
 		return err
+	}, utils.Transient, utils.Expired)
+	return stored, err
+}
+
+// completeUpload finishes an upload whose dump is stored already.
+func completeUpload(fileSystem fs.FS, cfg config.AppConfig, jrnl *journal.Journal, entry *journal.Entry) error {
+	if entry.State == journal.DumpUploaded {
+		if err := uploadKeyAndManifest(fileSystem, cfg, jrnl, entry); err != nil {
+			return err
+		}
 	}
+	finishUpload(cfg, jrnl, entry.File)
+	return nil
+}
+
+// finishUpload removes the uploaded dump and then its journal entry.
+func finishUpload(cfg config.AppConfig, jrnl *journal.Journal, file string) {
+	os.Remove(file)
+	jrnl.Remove(file)
 
 	log.WithFields(log.Fields{
 		"caller": "handleNewHeapDump",
 	}).Info(fmt.Sprintf("Uploaded encrypted Heap dump for %s successfully", cfg.ServiceOwner.Tenant))
 
 	metrics.HeapDumpHandled.WithLabelValues(cfg.ServiceOwner.Tenant).Inc()
+}
 
-	return nil
+// requestKey requests the key to encrypt a dump with before its upload URLs,
+// so the checksums of the encrypted dump can be signed into them. It returns
+// nil if the heap dump service only issues keys with the upload URLs.
+func requestKey(fileSystem fs.FS, cfg config.AppConfig, encryptedSize int64) (*models.KeyResponse, error) {
+	key, err := utils.RequestKey(fileSystem, cfg, encryptedSize)
+	var requestErr *utils.RequestError
+	if errors.As(err, &requestErr) && requestErr.StatusCode == http.StatusNotFound {
+		log.WithFields(log.Fields{
+			"caller": "requestKey",
+		}).Debug("The heap dump service does not issue keys up front, uploading without checksums")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error requesting encryption key: %w", err)
+	}
+	return &key, nil
 }
 
-func cleanupStaleFiles(basePath string, staleFiles *list.List, appConfig config.AppConfig) {
-	for e := staleFiles.Front(); e != nil; e = e.Next() {
-		f := e.Value.(fs.FileInfo)
-		if time.Now().Sub(f.ModTime()) > time.Minute*5 {
-			log.WithFields(log.Fields{
-				"caller": "pollChanges",
-			}).Info(fmt.Sprintf("Deleting %s", f.Name()))
-			os.Remove(path.Join(basePath, f.Name()))
-			staleFiles.Remove(e)
-			metrics.FailedDumps.WithLabelValues(appConfig.ServiceOwner.Tenant).Inc()
-		}
+// newEnvelope encrypts plain with the base64 encoded key.
+func newEnvelope(plain io.ReaderAt, plainSize int64, encodedKey string, compression utils.Compression, sourceCheck func() error) (*utils.Envelope, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error decoding aes key: %s", err.Error()))
 	}
+	envelope, err := utils.NewEnvelope(plain, plainSize, key, compression)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error encrypting dump: %s", err.Error()))
+	}
+	envelope.SetSourceCheck(sourceCheck)
+	return envelope, nil
 }
 
-func pollChanges(appConfig config.AppConfig) {
-	c := time.Tick(10 * time.Second)
-	var fzise int64 = 0
-	staleFiles := list.New()
-	for range c {
+// detectArtifactType sniffs the type of a dump from its first bytes. Files
+// that are not recognized keep the type of the rule that matched them.
+func detectArtifactType(dump io.ReaderAt, file string, ruleType string) string {
+	detected, err := artifact.Sniff(dump)
+	if err != nil {
 		log.WithFields(log.Fields{
-			"caller": "pollChanges",
-		}).Info(fmt.Sprintf("Checking for new files at %s", time.Now()))
-		files, err := ioutil.ReadDir(appConfig.WatchPath.Path)
-		if err != nil {
+			"caller": "detectArtifactType",
+		}).Warn(fmt.Sprintf("Could not detect the type of %s, assuming %s: %s", file, ruleType, err.Error()))
+		return ruleType
+	}
+	if detected == "" {
+		log.WithFields(log.Fields{
+			"caller": "detectArtifactType",
+		}).Debug(fmt.Sprintf("Type of %s not recognized, assuming %s", file, ruleType))
+		return ruleType
+	}
+	if detected != ruleType {
+		log.WithFields(log.Fields{
+			"caller": "detectArtifactType",
+		}).Info(fmt.Sprintf("%s is a %s file, not %s as configured in its rule", file, detected, ruleType))
+	}
+	return detected
+}
+
+// handleNewHeapDump encrypts the dump while it is being uploaded. Neither
+// the encrypted dump nor the encrypted key are written to disk, only a
+// compressed dump is staged if compression is enabled. The dump is
+// encrypted once more before the upload to compute the checksums S3
+// verifies the upload against. Every step
+// is recorded in the journal, so a restarted sidecar knows where it left
+// off. The artifact type of the rule is used if the type can not be
+// detected, jrnl may be nil.
+func handleNewHeapDump(fileSystem fs.FS, cfg config.AppConfig, job uploadJob, jrnl *journal.Journal) (err error) {
+	file := job.path
+	dump, err := fileSystem.Open(strings.TrimPrefix(file, "/"))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading %s: %s", file, err.Error()))
+	}
+	defer dump.Close()
+	dumpInfo, err := dump.Stat()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading %s: %s", file, err.Error()))
+	}
+	// a retry after the dump was stored only has to finish the upload, a
+	// new dump with the same name must not overwrite the entry of a stored
+	// dump that still lacks its key
+	if entry, found := jrnl.Get(file); found && entry.State != journal.Requested {
+		if entry.Matches(dumpInfo) {
+			return completeUpload(fileSystem, cfg, jrnl, &entry)
+		}
+		if entry.State == journal.DumpUploaded {
+			if err := uploadKeyAndManifest(fileSystem, cfg, jrnl, &entry); err != nil {
+				return err
+			}
+		}
+	}
+	plainText, ok := dump.(io.ReaderAt)
+	if !ok {
+		return errors.New(fmt.Sprintf("Error reading %s: random access is not supported", file))
+	}
+	artifactType := detectArtifactType(plainText, file, job.rule.ArtifactType)
+	validation, err := validateDump(cfg, plainText, dumpInfo.Size(), file, artifactType)
+	if err != nil {
+		return err
+	}
+	plainSize := dumpInfo.Size()
+	// every pass seals with the same key and nonces, the dump must be the
+	// one found stable for all of them. The dump is removed after the
+	// upload, so this holds for a compressed copy as well.
+	sourceCheck := utils.FileCheck(dump, dumpInfo)
+	compression, err := utils.ParseCompression(cfg.Compression.Algorithm)
+	if err != nil {
+		return err
+	}
+	if artifact.Compressed(artifactType) {
+		compression = utils.CompressionNone
+	}
+	// the checksum of the original dump goes into the manifest, so the
+	// companion can verify the decrypted dump, it is computed while
+	// compressing or along with the checksums of the encrypted dump
+	var plainSHA256 []byte
+	if compression != utils.CompressionNone {
+		digest := sha256.New()
+		staged, stagedSize, err := stageCompressed(cfg, file, io.TeeReader(dump, digest), plainSize, compression)
+		switch {
+		case errors.Is(err, errNotStaged):
 			log.WithFields(log.Fields{
-				"caller": "pollChanges",
-			}).Fatal(fmt.Sprintf("Could not read files in dir: %s", err.Error()))
+				"caller": "handleNewHeapDump",
+			}).Warn(fmt.Sprintf("Uploading %s uncompressed: %s", file, err.Error()))
+			compression = utils.CompressionNone
+		case err != nil:
+			return err
+		default:
+			defer removeStaged(staged)
+			plainText, plainSize = staged, stagedSize
+			plainSHA256 = digest.Sum(nil)
 		}
+	}
 
-		for _, file := range files {
-			//defer os.Remove(path.Join(appConfig.WatchPath.Path, file.Name()))
-			log.WithFields(log.Fields{
-				"caller": "pollChanges",
-			}).Debug(fmt.Sprintf("Checking Heap Dump: %s modified at %v, with size %d", file.Name(), file.ModTime(), file.Size()))
-			// Flag file for deletion
-			if time.Now().Sub(file.ModTime()) > time.Minute*1 {
-				log.WithFields(log.Fields{
-					"caller": "pollChanges",
-				}).Info(fmt.Sprintf("Flagging %s for deletion", file.Name()))
-				staleFiles.PushBack(file)
-			}
-			// Ignore files smaller than 16 MB
-			if file.Size() < 16777216 {
-				log.WithFields(log.Fields{
-					"caller": "pollChanges",
-				}).Debug(fmt.Sprintf("%s is too small for a Heap Dump: %d", file.Name(), file.Size()))
-			} else {
-				if time.Now().Sub(file.ModTime()) > time.Second*15 && fzise == file.Size() {
-					log.WithFields(log.Fields{
-						"caller": "pollChanges",
-					}).Info(fmt.Sprintf("Processing file: %s modified at %v, with size %d", file.Name(), file.ModTime(), file.Size()))
-					err := handleNewHeapDump(os.DirFS("/"), appConfig, fmt.Sprintf("%s/%s", appConfig.WatchPath.Path, file.Name()))
-					utils.CheckError(err)
-				}
+	uploadInfo := utils.DumpInfo{
+		File:          file,
+		ArtifactType:  artifactType,
+		EncryptedSize: utils.EncryptedSize(plainSize),
+		Validation:    validation,
+	}
+	key, err := requestKey(fileSystem, cfg, uploadInfo.EncryptedSize)
+	if err != nil {
+		return err
+	}
+	var envelope *utils.Envelope
+	if key != nil {
+		if key.WrappingKey != "" {
+			// the heap dump service only hands out the public key, the
+			// plaintext key never leaves the sidecar
+			key.AesKey, key.EncryptedAesKey, err = utils.WrapNewKey(key.WrappingKey, key.WrappingKeyVersion)
+			if err != nil {
+				return err
 			}
-			cleanupStaleFiles(appConfig.WatchPath.Path, staleFiles, appConfig)
-			log.WithFields(log.Fields{
-				"caller": "pollChanges",
-			}).Debug(fmt.Sprintf("Write operation still in progress for Heap Dump %s", file.Name()))
-			fzise = file.Size()
-			time.Sleep(time.Second * 2)
 		}
+		envelope, err = newEnvelope(plainText, plainSize, key.AesKey, compression, sourceCheck)
+		if err != nil {
+			return err
+		}
+		// S3 verifies the upload against the checksums signed into its
+		// URLs, so they take a pass of their own before the upload
+		checksums, err := envelope.Checksums(key.PartSize)
+		if err != nil {
+			return err
+		}
+		if plainSHA256 == nil {
+			plainSHA256 = checksums.PlainSHA256
+		}
+		uploadInfo.EncryptedAesKey = key.EncryptedAesKey
+		uploadInfo.Checksums = &checksums
+	} else if plainSHA256 == nil {
+		// services without keys up front take no checksums, the dump is
+		// hashed in a pass of its own
+		digest := sha256.New()
+		if _, err := io.Copy(digest, io.NewSectionReader(plainText, 0, plainSize)); err != nil {
+			return errors.New(fmt.Sprintf("Error reading %s: %s", file, err.Error()))
+		}
+		plainSHA256 = digest.Sum(nil)
+	}
+
+	response := new(models.SigningResponse)
+	payload, err := utils.RequestUploadConfig(fileSystem, cfg, uploadInfo, response)
+	if err != nil {
+		return fmt.Errorf("Error requesting upload URL: %w", err)
+	}
+	entry := &journal.Entry{
+		File:               file,
+		Size:               dumpInfo.Size(),
+		ModTime:            dumpInfo.ModTime(),
+		State:              journal.Requested,
+		Payload:            payload,
+		UploadID:           response.UploadID,
+		EncryptedAesKey:    response.EncryptedAesKey,
+		EncryptedAesKeyURL: response.EncryptedAesKeyURL,
+		ManifestURL:        response.ManifestURL,
+		HeadURL:            response.HeadURL,
+	}
+	saveJournal(jrnl, entry)
+	// a failed attempt is over, the next one requests new URLs, unless the
+	// dump is stored already and only its key and manifest are missing
+	defer func() {
+		if err != nil && entry.State == journal.Requested {
+			jrnl.Remove(file)
+		}
+	}()
+
+	if envelope == nil {
+		envelope, err = newEnvelope(plainText, plainSize, response.AesKey, compression, sourceCheck)
+		if err != nil {
+			return err
+		}
+	}
+	manifestDescription := dumpDescription{
+		job:            job,
+		artifactType:   artifactType,
+		compression:    compression,
+		plaintextSize:  dumpInfo.Size(),
+		ciphertextSize: envelope.Size(),
+		sha256:         hex.EncodeToString(plainSHA256),
+	}
+	if uploadInfo.Checksums != nil {
+		manifestDescription.ciphertextSHA256 = hex.EncodeToString(uploadInfo.Checksums.SHA256)
 	}
+	entry.Manifest, err = buildManifest(fileSystem, cfg, payload, manifestDescription)
+	if err != nil {
+		return err
+	}
+
+	if response.UploadID != "" {
+		err = uploadMultipart(fileSystem, cfg, payload, response, envelope)
+	} else {
+		err = utils.UploadToS3(response.URL, envelope.NewSectionReader(0, envelope.Size()), envelope.Size(), response.Headers)
+	}
+	if err != nil {
+		return err
+	}
+	entry.State = journal.DumpUploaded
+	saveJournal(jrnl, entry)
+
+	return completeUpload(fileSystem, cfg, jrnl, entry)
+}
+
+const defaultGracePeriod = 25 * time.Second
+
+func gracePeriod(cfg config.AppConfig) time.Duration {
+	if cfg.Shutdown.GracePeriodSeconds > 0 {
+		return time.Duration(cfg.Shutdown.GracePeriodSeconds) * time.Second
+	}
+	return defaultGracePeriod
+}
+
+// waitForDrain waits until the watch loop stopped or the grace period is
+// over. It returns false in the latter case.
+func waitForDrain(done <-chan struct{}, grace time.Duration) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(grace):
+		return false
+	}
+}
+
+// drainHandler stops picking up new heap dumps and waits for the current
+// upload, so it can be used as preStop hook.
+func drainHandler(drain context.CancelFunc, done <-chan struct{}, grace time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		drain()
+		if !waitForDrain(done, grace) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "upload still in progress")
+			return
+		}
+		fmt.Fprintln(w, "drained")
+	})
 }
 
 func main() {
 	logging.SetupLogging()
+	log.WithFields(log.Fields{
+		"caller": "main",
+	}).Info(fmt.Sprintf("Starting notify sidecar %s", version))
 
 	appConfig, err := config.LoadConfigFromEnvironment("APP_CONFIG_FILE")
 	utils.CheckError(err)
 
-	go pollChanges(appConfig)
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	// watching stops on a signal or when drained by the preStop hook
+	watchCtx, drain := context.WithCancel(signals)
+	defer drain()
+
+	sidecar, err := newSidecar(appConfig)
+	utils.CheckError(err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sidecar.watch(watchCtx)
+	}()
+
+	grace := gracePeriod(appConfig)
+	server := metrics.NewMetricServer(appConfig.Metrics.Port, appConfig.Metrics.Path)
+	http.Handle("/quarantine", sidecar.quarantine.ListHandler())
+	http.Handle("/quarantine/retry", sidecar.quarantine.RetryHandler(os.Getenv("QUARANTINE_RETRY_TOKEN")))
+	http.Handle("/drain", drainHandler(drain, done, grace))
+	go func() {
+		log.WithFields(log.Fields{
+			"caller": "main",
+		}).Info("Serving Metrics")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithFields(log.Fields{
+				"caller": "main",
+			}).Fatal(fmt.Sprintf("Metrics server failed: %s", err.Error()))
+		}
+	}()
+
+	<-signals.Done()
+	log.WithFields(log.Fields{
+		"caller": "main",
+	}).Info(fmt.Sprintf("Shutting down, waiting up to %v for the current upload", grace))
+	drain()
+	if !waitForDrain(done, grace) {
+		log.WithFields(log.Fields{
+			"caller": "main",
+		}).Warn("Grace period is over, the interrupted upload is restarted from the journal on the next start")
+	}
 
-	metrics.StartMetricServer(appConfig.Metrics.Port, appConfig.Metrics.Path)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
 }
@@ -1,22 +1,33 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	b64 "encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"testing/fstest"
 	"time"
 
 	cfg "github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
 )
 
 var staticTestKey = b64.StdEncoding.EncodeToString([]byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49})
@@ -98,8 +109,8 @@ func TestNoToken(t *testing.T) {
 		"test_heap_dump": {Data: []byte("asdfasdfasdf")},
 		"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
 	}
-	want := errors.New(fmt.Sprintf("Error requesting upload URL: %s", "Error reading SA Token: open var/run/secrets/kubernetes.io/serviceaccount/token: file does not exist"))
-	got := handleNewHeapDump(fs, goodConfig, "test_heap_dump")
+	want := errors.New(fmt.Sprintf("Error requesting encryption key: %s", "Error reading SA Token: open var/run/secrets/kubernetes.io/serviceaccount/token: file does not exist"))
+	got := handleNewHeapDump(fs, goodConfig, uploadJob{path: "test_heap_dump", rule: cfg.Rule{ArtifactType: "hprof"}}, nil)
 	if got == nil {
 		t.Errorf("This should produce an Error")
 	}
@@ -135,7 +146,7 @@ func TestBadAESKey(t *testing.T) {
 		"test_heap_dump": {Data: []byte("dummy")},
 	}
 	want := errors.New(fmt.Sprintf("Error encrypting dump: %s", "Error initializing ARE Cipher: crypto/aes: invalid key size 2"))
-	got := handleNewHeapDump(fs, badConfig, "test_heap_dump")
+	got := handleNewHeapDump(fs, badConfig, uploadJob{path: "test_heap_dump", rule: cfg.Rule{ArtifactType: "hprof"}}, nil)
 	if got == nil {
 		t.Errorf("This should produce an Error")
 	}
@@ -170,7 +181,7 @@ func TestHandleNewHeapDump(t *testing.T) {
 		"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
 		"test_heap_dump": {Data: []byte("dummy")},
 	}
-	err := handleNewHeapDump(fs, config, "test_heap_dump")
+	err := handleNewHeapDump(fs, config, uploadJob{path: "test_heap_dump", rule: cfg.Rule{ArtifactType: "hprof"}}, nil)
 	if err == nil {
 		t.Errorf("This should fail!")
 	}
@@ -179,3 +190,226 @@ func TestHandleNewHeapDump(t *testing.T) {
 	}
 	cleanup("test_heap_dump.crypted")
 }
+
+func TestDetectArtifactType(t *testing.T) {
+	cases := []struct {
+		content  string
+		ruleType string
+		want     string
+	}{
+		{"JAVA PROFILE 1.0.2\x00", "hprof", "hprof"},
+		{"JAVA PROFILE 1.0.2\x00", "core", "hprof"},
+		{`{"snapshot":{}}`, "hprof", "heapsnapshot"},
+		{"unknown content", "gcdump", "gcdump"},
+	}
+	for _, tc := range cases {
+		if got := detectArtifactType(strings.NewReader(tc.content), "dump", tc.ruleType); got != tc.want {
+			t.Errorf("%q with rule type %s: got %s, want %s", tc.content, tc.ruleType, got, tc.want)
+		}
+	}
+}
+
+func TestHandleNewHeapDumpChecksums(t *testing.T) {
+	var mu sync.Mutex
+	var signing models.SigningRequest
+	uploaded := map[string][]byte{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/key":
+			json.NewEncoder(w).Encode(models.KeyResponse{AesKey: staticTestKey, EncryptedAesKey: "cryptedTest"})
+		case r.Method == http.MethodPost && r.URL.Path == "/upload":
+			json.NewDecoder(r.Body).Decode(&signing)
+			json.NewEncoder(w).Encode(models.SigningResponse{
+				URL:                server.URL + "/dump",
+				Headers:            map[string]string{"X-Amz-Checksum-Sha256": signing.ChecksumSHA256},
+				EncryptedAesKey:    signing.EncryptedAesKey,
+				EncryptedAesKeyURL: server.URL + "/dump.key",
+				ManifestURL:        server.URL + "/dump.manifest.json",
+			})
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			if r.URL.Path == "/dump" {
+				sum := sha256.Sum256(body)
+				if r.Header.Get("X-Amz-Checksum-Sha256") != b64.StdEncoding.EncodeToString(sum[:]) {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, "<Code>BadDigest</Code>")
+					return
+				}
+			}
+			uploaded[r.URL.Path] = body
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	// without room to stage the compressed dump it is uploaded as it is
+	defer func(original func(string) (int64, error)) { freeSpace = original }(freeSpace)
+	freeSpace = func(string) (int64, error) { return 0, nil }
+	tests := []struct {
+		name        string
+		compression string
+	}{
+		{"uncompressed", "none"},
+		{"no room to compress", "zstd"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var config cfg.AppConfig
+			config.Middleware.Endpoint = server.URL + "/upload"
+			config.ServiceOwner.Tenant = "testTenant"
+			config.Retry.Attempts = 1
+			config.Compression.Algorithm = test.compression
+			config.Compression.StagingPath = t.TempDir()
+			dump := []byte("some heap dump")
+			fs := fstest.MapFS{
+				"var/run/secrets/kubernetes.io/serviceaccount/token":     {Data: []byte("test_token")},
+				"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
+				"test_heap_dump": {Data: dump},
+			}
+			if err := handleNewHeapDump(fs, config, uploadJob{path: "test_heap_dump", rule: cfg.Rule{ArtifactType: "core"}}, nil); err != nil {
+				t.Fatalf("Failed to upload: %v", err)
+			}
+
+			if signing.EncryptedAesKey != "cryptedTest" || signing.ChecksumSHA256 == "" {
+				t.Errorf("upload URLs have to be requested with the key and checksum, got %+v", signing)
+			}
+			var manifest struct {
+				Compression      string `json:"compression"`
+				SHA256           string `json:"sha256"`
+				CiphertextSHA256 string `json:"ciphertext-sha256"`
+			}
+			if err := json.Unmarshal(uploaded["/dump.manifest.json"], &manifest); err != nil {
+				t.Fatalf("Invalid manifest: %v", err)
+			}
+			plainSum := sha256.Sum256(dump)
+			cipherSum := sha256.Sum256(uploaded["/dump"])
+			if manifest.SHA256 != hex.EncodeToString(plainSum[:]) || manifest.CiphertextSHA256 != hex.EncodeToString(cipherSum[:]) {
+				t.Errorf("manifest has to hold both checksums, got %+v", manifest)
+			}
+			if manifest.Compression != "none" {
+				t.Errorf("dump uploaded with compression %s, want none", manifest.Compression)
+			}
+		})
+	}
+}
+
+func TestHandleNewHeapDumpWrapsKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate rsa key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	var mu sync.Mutex
+	var signing models.SigningRequest
+	uploaded := map[string][]byte{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/key":
+			json.NewEncoder(w).Encode(models.KeyResponse{WrappingKey: publicKeyPEM, WrappingKeyVersion: 2})
+		case r.Method == http.MethodPost && r.URL.Path == "/upload":
+			json.NewDecoder(r.Body).Decode(&signing)
+			json.NewEncoder(w).Encode(models.SigningResponse{
+				URL:                server.URL + "/dump",
+				EncryptedAesKey:    signing.EncryptedAesKey,
+				EncryptedAesKeyURL: server.URL + "/dump.key",
+			})
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			uploaded[r.URL.Path] = body
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var config cfg.AppConfig
+	config.Middleware.Endpoint = server.URL + "/upload"
+	config.ServiceOwner.Tenant = "testTenant"
+	config.Retry.Attempts = 1
+	fs := fstest.MapFS{
+		"var/run/secrets/kubernetes.io/serviceaccount/token":     {Data: []byte("test_token")},
+		"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
+		"test_heap_dump": {Data: []byte("some heap dump")},
+	}
+	if err := handleNewHeapDump(fs, config, uploadJob{path: "test_heap_dump", rule: cfg.Rule{ArtifactType: "core"}}, nil); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+
+	wrappedKey := string(uploaded["/dump.key"])
+	if wrappedKey != signing.EncryptedAesKey || !strings.HasPrefix(wrappedKey, "vault:v2:") {
+		t.Fatalf("the wrapped key has to be passed to the service and uploaded, got %s and %s", signing.EncryptedAesKey, wrappedKey)
+	}
+	wrapped, _ := b64.StdEncoding.DecodeString(strings.TrimPrefix(wrappedKey, "vault:v2:"))
+	unwrapped, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, wrapped, nil)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if key, err := b64.StdEncoding.DecodeString(string(unwrapped)); err != nil || len(key) != 32 {
+		t.Errorf("Expected a base64 encoded 32 byte key, got %s", unwrapped)
+	}
+}
+
+func TestUploadMultipartAbortsOnFailedComplete(t *testing.T) {
+	var mu sync.Mutex
+	completes, aborts := 0, 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPut:
+			io.Copy(io.Discard, r.Body)
+			w.Header().Set("ETag", `"etag"`)
+		case r.URL.Path == "/upload/complete":
+			completes++
+			if completes == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+		case r.URL.Path == "/upload/abort":
+			aborts++
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	var config cfg.AppConfig
+	config.Middleware.Endpoint = server.URL + "/upload"
+	config.Retry.Attempts = 2
+	config.Retry.InitialDelaySeconds = 1
+	fs := fstest.MapFS{
+		"var/run/secrets/kubernetes.io/serviceaccount/token": {Data: []byte("test_token")},
+	}
+	key, _ := b64.StdEncoding.DecodeString(staticTestKey)
+	dump := []byte("some heap dump")
+	envelope, err := utils.NewEnvelope(bytes.NewReader(dump), int64(len(dump)), key, utils.CompressionNone)
+	if err != nil {
+		t.Fatalf("Failed to create envelope: %v", err)
+	}
+	response := &models.SigningResponse{
+		UploadID: "upload-1",
+		PartSize: envelope.Size(),
+		PartURLs: []string{server.URL + "/part1"},
+	}
+	err = uploadMultipart(fs, config, models.Payload{FileName: "dump"}, response, envelope)
+	if err == nil {
+		t.Fatalf("Expected completing the upload to fail")
+	}
+	if completes != 2 {
+		t.Errorf("a transient failure to complete has to be retried, got %d attempts", completes)
+	}
+	if aborts != 1 {
+		t.Errorf("an upload that can not be completed has to be aborted, got %d aborts", aborts)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/journal"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/manifest"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
+)
+
+const defaultPodInfoPath = "/etc/podinfo"
+
+// version of the sidecar, set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+func podInfoPath(cfg config.AppConfig) string {
+	if cfg.Manifest.PodInfoPath != "" {
+		return cfg.Manifest.PodInfoPath
+	}
+	return defaultPodInfoPath
+}
+
+// dumpDescription is what the manifest of a dump is built from.
+type dumpDescription struct {
+	job            uploadJob
+	artifactType   string
+	compression    utils.Compression
+	plaintextSize  int64
+	ciphertextSize int64
+	sha256         string
+	// ciphertextSHA256 is only known if the checksums were signed into
+	// the upload URLs
+	ciphertextSHA256 string
+}
+
+// buildManifest returns the JSON manifest of an uploaded dump.
+func buildManifest(fileSystem fs.FS, cfg config.AppConfig, payload models.Payload, dump dumpDescription) (string, error) {
+	pod := manifest.ReadPod(fileSystem, podInfoPath(cfg))
+	pod.Namespace = payload.Namespace
+	detected := dump.job.detected
+	if detected.IsZero() {
+		detected = time.Now()
+	}
+	data, err := json.MarshalIndent(manifest.Manifest{
+		Pod:              pod,
+		FileName:         filepath.Base(dump.job.path),
+		Object:           payload.FileName,
+		ArtifactType:     dump.artifactType,
+		Compression:      dump.compression.String(),
+		PlaintextSize:    dump.plaintextSize,
+		CiphertextSize:   dump.ciphertextSize,
+		SHA256:           dump.sha256,
+		CiphertextSHA256: dump.ciphertextSHA256,
+		DetectedAt:       detected.UTC(),
+		SidecarVersion:   version,
+	}, "", "  ")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error encoding manifest of %s: %s", dump.job.path, err.Error()))
+	}
+	return string(data), nil
+}
+
+// uploadManifest stores the manifest next to the uploaded dump. The dump
+// can be decrypted without it, so a failed upload is only logged.
+func uploadManifest(cfg config.AppConfig, entry *journal.Entry) {
+	if entry.ManifestURL == "" {
+		log.WithFields(log.Fields{
+			"caller": "uploadManifest",
+		}).Debug(fmt.Sprintf("No manifest is stored for %s, the heap dump service did not issue a URL", entry.File))
+		return
+	}
+	err := retryBackoff(cfg).Retry("Upload of the manifest", func() error {
+		return utils.UploadToS3(entry.ManifestURL, strings.NewReader(entry.Manifest), int64(len(entry.Manifest)), nil)
+	}, utils.Transient)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "uploadManifest",
+		}).Warn(fmt.Sprintf("Could not upload the manifest of %s: %s", entry.File, err.Error()))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/journal"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/manifest"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
+)
+
+func TestBuildManifest(t *testing.T) {
+	t.Setenv("POD_NAME", "java-app-7d9f")
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("CONTAINER_NAME", "java-app")
+	var cfg config.AppConfig
+	cfg.Manifest.PodInfoPath = "/podinfo"
+	fileSystem := fstest.MapFS{
+		"podinfo/labels":      {Data: []byte("app=\"java-app\"\n")},
+		"podinfo/annotations": {Data: []byte("team=\"platform\"\n")},
+	}
+	detected := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	data, err := buildManifest(fileSystem, cfg, models.Payload{Namespace: "platform", FileName: "java-app-7d9f-java_pid1.hprof-2024-01-01-12-00-05.hprof.crypted"}, dumpDescription{
+		job:            uploadJob{path: "/heap-dumps/java_pid1.hprof", detected: detected},
+		artifactType:   "hprof",
+		compression:    utils.CompressionZstd,
+		plaintextSize:  1000,
+		ciphertextSize: 300,
+		sha256:         "abc",
+	})
+	if err != nil {
+		t.Fatalf("Failed to build manifest: %v", err)
+	}
+	var got manifest.Manifest
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("Manifest is no valid JSON: %v", err)
+	}
+	want := manifest.Manifest{
+		Pod: manifest.Pod{
+			Name:        "java-app-7d9f",
+			Namespace:   "platform",
+			Node:        "node-1",
+			Container:   "java-app",
+			Labels:      map[string]string{"app": "java-app"},
+			Annotations: map[string]string{"team": "platform"},
+		},
+		FileName:       "java_pid1.hprof",
+		Object:         "java-app-7d9f-java_pid1.hprof-2024-01-01-12-00-05.hprof.crypted",
+		ArtifactType:   "hprof",
+		Compression:    "zstd",
+		PlaintextSize:  1000,
+		CiphertextSize: 300,
+		SHA256:         "abc",
+		DetectedAt:     detected,
+		SidecarVersion: version,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUploadKeyAndManifest(t *testing.T) {
+	uploaded := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		uploaded[r.URL.Path] = string(body)
+	}))
+	defer server.Close()
+
+	var cfg config.AppConfig
+	cfg.Retry.Attempts = 1
+	entry := &journal.Entry{
+		File:               "/heap-dumps/java_pid1.hprof",
+		EncryptedAesKey:    "encrypted-key",
+		EncryptedAesKeyURL: server.URL + "/dump.key",
+		Manifest:           `{"sha256":"abc"}`,
+		ManifestURL:        server.URL + "/dump.manifest.json",
+	}
+	if err := uploadKeyAndManifest(nil, cfg, nil, entry); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	want := map[string]string{"/dump.key": "encrypted-key", "/dump.manifest.json": `{"sha256":"abc"}`}
+	if !reflect.DeepEqual(uploaded, want) {
+		t.Errorf("got %v, want %v", uploaded, want)
+	}
+	if entry.State != journal.Completed {
+		t.Errorf("upload has to be completed, got %s", entry.State)
+	}
+
+	// a service without manifests does not issue a manifest URL
+	uploaded = map[string]string{}
+	entry.ManifestURL = ""
+	if err := uploadKeyAndManifest(nil, cfg, nil, entry); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	if _, found := uploaded["/dump.manifest.json"]; found || len(uploaded) != 1 {
+		t.Errorf("only the key has to be uploaded, got %v", uploaded)
+	}
+}
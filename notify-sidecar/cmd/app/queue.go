@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+)
+
+// uploadJob is a stable heap dump waiting for a worker.
+type uploadJob struct {
+	path     string
+	rule     config.Rule
+	detected time.Time
+}
+
+// workQueue hands upload jobs from the watch loop to the workers. Push never
+// blocks, so the watch loop keeps observing files while all workers are
+// busy.
+type workQueue struct {
+	tenant string
+	mu     sync.Mutex
+	cond   *sync.Cond
+	jobs   []uploadJob
+	closed bool
+}
+
+func newWorkQueue(tenant string) *workQueue {
+	q := &workQueue{tenant: tenant}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *workQueue) push(job uploadJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.jobs = append(q.jobs, job)
+	metrics.QueuedUploads.WithLabelValues(q.tenant).Set(float64(len(q.jobs)))
+	q.cond.Signal()
+}
+
+// pop waits for the next job. It returns false once the queue is closed.
+func (q *workQueue) pop() (uploadJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return uploadJob{}, false
+	}
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	metrics.QueuedUploads.WithLabelValues(q.tenant).Set(float64(len(q.jobs)))
+	return job, true
+}
+
+// close wakes up all workers and returns the jobs that were not started.
+func (q *workQueue) close() []uploadJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	pending := q.jobs
+	q.jobs = nil
+	metrics.QueuedUploads.WithLabelValues(q.tenant).Set(0)
+	q.cond.Broadcast()
+	return pending
+}
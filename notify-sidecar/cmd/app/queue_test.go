@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkQueue(t *testing.T) {
+	q := newWorkQueue("testTenant")
+	q.push(uploadJob{path: "/dumps/a"})
+	q.push(uploadJob{path: "/dumps/b"})
+
+	job, ok := q.pop()
+	if !ok || job.path != "/dumps/a" {
+		t.Errorf("got %+v, %v", job, ok)
+	}
+
+	popped := make(chan bool)
+	go func() {
+		q.pop()
+		_, ok := q.pop()
+		popped <- ok
+	}()
+	select {
+	case <-popped:
+		t.Fatalf("pop must wait for a job")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if pending := q.close(); len(pending) != 0 {
+		t.Errorf("got %v", pending)
+	}
+	if ok := <-popped; ok {
+		t.Errorf("pop must return false once the queue is closed")
+	}
+	q.push(uploadJob{path: "/dumps/c"})
+	if _, ok := q.pop(); ok {
+		t.Errorf("a closed queue must not accept jobs")
+	}
+}
+
+func TestWorkQueueCloseReturnsPending(t *testing.T) {
+	q := newWorkQueue("testTenant")
+	q.push(uploadJob{path: "/dumps/a"})
+	pending := q.close()
+	if len(pending) != 1 || pending[0].path != "/dumps/a" {
+		t.Errorf("got %v", pending)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/artifact"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/hprof"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+)
+
+// invalidDumpError is returned for truncated or corrupt heap dumps if the
+// policy is to quarantine them.
+type invalidDumpError struct {
+	file    string
+	verdict hprof.Verdict
+}
+
+func (e *invalidDumpError) Error() string {
+	return fmt.Sprintf("%s is not a valid heap dump: %s", e.file, e.verdict)
+}
+
+// validateDump checks hprof heap dumps before they are uploaded and returns
+// the verdict to record with the upload. Other artifact types are not
+// checked.
+func validateDump(cfg config.AppConfig, dump io.ReaderAt, size int64, file string, artifactType string) (*models.Validation, error) {
+	if cfg.Validation.Policy == config.ValidationOff {
+		return nil, nil
+	}
+	var verdict hprof.Verdict
+	var err error
+	switch artifactType {
+	case artifact.Hprof:
+		verdict, err = hprof.ValidateFile(dump, size)
+	case artifact.HprofGzip:
+		verdict, err = hprof.ValidateGzip(io.NewSectionReader(dump, 0, size))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error validating %s: %s", file, err.Error()))
+	}
+	metrics.ValidatedDumps.WithLabelValues(cfg.ServiceOwner.Tenant, string(verdict.Status)).Inc()
+
+	if !verdict.Valid() {
+		log.WithFields(log.Fields{
+			"caller": "validateDump",
+		}).Warn(fmt.Sprintf("%s is not a valid heap dump after %d records: %s", file, verdict.Records, verdict))
+		if cfg.Validation.Policy == config.ValidationQuarantine {
+			return nil, &invalidDumpError{file: file, verdict: verdict}
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"caller": "validateDump",
+		}).Debug(fmt.Sprintf("%s is a valid heap dump (%s, %d records)", file, verdict.Version, verdict.Records))
+	}
+	return &models.Validation{Status: string(verdict.Status), Reason: verdict.Reason}, nil
+}
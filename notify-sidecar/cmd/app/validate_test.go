@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	cfg "github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+)
+
+// a heap dump cut off after its header
+const truncatedHprof = "JAVA PROFILE 1.0.2\x00\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00"
+
+func TestValidateDump(t *testing.T) {
+	var config cfg.AppConfig
+	dump := strings.NewReader(truncatedHprof)
+
+	validation, err := validateDump(config, dump, dump.Size(), "dump.hprof", "hprof")
+	if err != nil || validation == nil || validation.Status != "truncated" {
+		t.Errorf("invalid dumps are uploaded by default, got %+v, %v", validation, err)
+	}
+
+	validation, err = validateDump(config, dump, dump.Size(), "dump.core", "core")
+	if err != nil || validation != nil {
+		t.Errorf("only hprof dumps are validated, got %+v, %v", validation, err)
+	}
+
+	config.Validation.Policy = cfg.ValidationOff
+	validation, err = validateDump(config, dump, dump.Size(), "dump.hprof", "hprof")
+	if err != nil || validation != nil {
+		t.Errorf("validation is off, got %+v, %v", validation, err)
+	}
+
+	config.Validation.Policy = cfg.ValidationQuarantine
+	_, err = validateDump(config, dump, dump.Size(), "dump.hprof", "hprof")
+	var invalid *invalidDumpError
+	if !errors.As(err, &invalid) || invalid.verdict.Status != "truncated" {
+		t.Errorf("invalid dumps must be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/journal"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/quarantine"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/utils"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/watcher"
+)
+
+const (
+	defaultFlagAfter       = time.Minute
+	defaultQuarantineAfter = 5 * time.Minute
+	quarantineDirName      = ".quarantine"
+	journalDirName         = ".journal"
+	defaultWorkers         = 2
+)
+
+// sidecar holds the state of the watch loop.
+type sidecar struct {
+	cfg        config.AppConfig
+	fileSystem fs.FS
+	tracker    *watcher.Tracker
+	quarantine *quarantine.Quarantine
+	journal    *journal.Journal
+	queue      *workQueue
+
+	mu sync.Mutex
+	// flagged holds the files no rule takes care of that were already
+	// reported as stale
+	flagged map[string]bool
+	// oversized holds the files too large for the quarantine that were
+	// already reported
+	oversized map[string]bool
+}
+
+func newSidecar(appConfig config.AppConfig) (*sidecar, error) {
+	if err := appConfig.Validate(); err != nil {
+		return nil, err
+	}
+	quarantinePath := appConfig.Quarantine.Path
+	if quarantinePath == "" {
+		quarantinePath = filepath.Join(appConfig.WatchPath.Path, quarantineDirName)
+	}
+	q, err := quarantine.New(quarantinePath, appConfig.ServiceOwner.Tenant, appConfig.Quarantine.MaxBytes, time.Duration(appConfig.Quarantine.MaxAgeSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	journalPath := appConfig.Journal.Path
+	if journalPath == "" {
+		journalPath = filepath.Join(appConfig.WatchPath.Path, journalDirName)
+	}
+	j, err := journal.Open(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	cleanStaging(appConfig)
+	return &sidecar{
+		cfg:        appConfig,
+		fileSystem: os.DirFS("/"),
+		tracker:    watcher.NewTracker(appConfig.ServiceOwner.Tenant, time.Duration(appConfig.Watcher.SettleSeconds)*time.Second, appConfig.Watcher.StableChecks),
+		quarantine: q,
+		journal:    j,
+		queue:      newWorkQueue(appConfig.ServiceOwner.Tenant),
+		flagged:    map[string]bool{},
+		oversized:  map[string]bool{},
+	}, nil
+}
+
+func (s *sidecar) flagAfter() time.Duration {
+	if s.cfg.Cleanup.FlagAfterSeconds > 0 {
+		return time.Duration(s.cfg.Cleanup.FlagAfterSeconds) * time.Second
+	}
+	return defaultFlagAfter
+}
+
+func (s *sidecar) quarantineAfter() time.Duration {
+	if s.cfg.Cleanup.QuarantineAfterSeconds > 0 {
+		return time.Duration(s.cfg.Cleanup.QuarantineAfterSeconds) * time.Second
+	}
+	return defaultQuarantineAfter
+}
+
+// quarantineFile moves a file the sidecar can not handle out of the watch
+// path, so it is neither lost nor picked up again. A file too large for the
+// quarantine stays where it is, it is reported once.
+func (s *sidecar) quarantineFile(file string, reason string, cause error) {
+	err := s.quarantine.Add(file, reason, cause)
+	if errors.Is(err, quarantine.ErrTooLarge) {
+		if s.markOversized(file) {
+			log.WithFields(log.Fields{
+				"caller": "quarantineFile",
+			}).Error(fmt.Sprintf("Leaving %s (%s) in place: %s", file, reason, err.Error()))
+			metrics.OversizedFiles.WithLabelValues(s.cfg.ServiceOwner.Tenant).Inc()
+		}
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "quarantineFile",
+		}).Error(err.Error())
+		return
+	}
+	s.tracker.Forget(file)
+	s.unflag(file)
+	metrics.FailedDumps.WithLabelValues(s.cfg.ServiceOwner.Tenant).Inc()
+}
+
+// checkFile feeds a file reported by the watcher into the tracker and
+// applies the matching rule once the file is stable.
+func (s *sidecar) checkFile(ctx context.Context, event watcher.Event) {
+	file, err := os.Stat(event.Path)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "watchChanges",
+		}).Debug(fmt.Sprintf("Skipping %s: %s", event.Path, err.Error()))
+		s.tracker.Forget(event.Path)
+		s.unflag(event.Path)
+		return
+	}
+	if !file.Mode().IsRegular() {
+		return
+	}
+	log.WithFields(log.Fields{
+		"caller": "watchChanges",
+	}).Debug(fmt.Sprintf("Checking Heap Dump: %s (%s) modified at %v, with size %d", file.Name(), event.Op, file.ModTime(), file.Size()))
+
+	rule, matched := s.cfg.MatchRule(file.Name(), file.Size())
+	state := s.tracker.Observe(event.Path, file, event.Op, time.Duration(rule.SettleSeconds)*time.Second)
+	if !matched {
+		age := time.Now().Sub(file.ModTime())
+		if age > s.quarantineAfter() {
+			s.quarantineFile(event.Path, "no rule matched", nil)
+		} else if age > s.flagAfter() && s.flag(event.Path) {
+			log.WithFields(log.Fields{
+				"caller": "watchChanges",
+			}).Info(fmt.Sprintf("Flagging %s for quarantine, no rule matches it", file.Name()))
+		}
+		return
+	}
+	if state != watcher.Stable {
+		return
+	}
+
+	switch rule.Action {
+	case config.ActionIgnore:
+		log.WithFields(log.Fields{
+			"caller": "watchChanges",
+		}).Debug(fmt.Sprintf("Ignoring %s as of rule %s", file.Name(), rule.Name))
+	case config.ActionDelete:
+		log.WithFields(log.Fields{
+			"caller": "watchChanges",
+		}).Info(fmt.Sprintf("Deleting %s as of rule %s", file.Name(), rule.Name))
+		os.Remove(event.Path)
+		s.tracker.Forget(event.Path)
+	case config.ActionUpload:
+		// no new uploads once shutting down, Start makes sure a dump is
+		// only queued once
+		if ctx.Err() != nil || !s.tracker.Start(event.Path) {
+			return
+		}
+		log.WithFields(log.Fields{
+			"caller": "watchChanges",
+		}).Info(fmt.Sprintf("Queueing %s file as of rule %s: %s modified at %v, with size %d", rule.ArtifactType, rule.Name, file.Name(), file.ModTime(), file.Size()))
+		s.queue.push(uploadJob{path: event.Path, rule: rule, detected: s.tracker.Discovered(event.Path)})
+	}
+}
+
+// flag marks a file as stale and returns false if it already was.
+func (s *sidecar) flag(file string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flagged[file] {
+		return false
+	}
+	s.flagged[file] = true
+	return true
+}
+
+func (s *sidecar) unflag(file string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.flagged, file)
+	delete(s.oversized, file)
+}
+
+func (s *sidecar) markOversized(file string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oversized[file] {
+		return false
+	}
+	s.oversized[file] = true
+	return true
+}
+
+func (s *sidecar) workers() int {
+	if s.cfg.Upload.Workers > 0 {
+		return s.cfg.Upload.Workers
+	}
+	return defaultWorkers
+}
+
+// work uploads queued heap dumps until the queue is closed.
+func (s *sidecar) work(ctx context.Context) {
+	for {
+		job, ok := s.queue.pop()
+		if !ok {
+			return
+		}
+		s.upload(ctx, job)
+	}
+}
+
+func (s *sidecar) upload(ctx context.Context, job uploadJob) {
+	metrics.ActiveUploads.WithLabelValues(s.cfg.ServiceOwner.Tenant).Inc()
+	defer metrics.ActiveUploads.WithLabelValues(s.cfg.ServiceOwner.Tenant).Dec()
+
+	name := filepath.Base(job.path)
+	log.WithFields(log.Fields{
+		"caller": "upload",
+	}).Info(fmt.Sprintf("Processing %s file as of rule %s: %s", job.rule.ArtifactType, job.rule.Name, job.path))
+	// Transient failures and expired URLs are retried with fresh URLs
+	// from the heap dump service.
+	backoff := retryBackoff(s.cfg)
+	backoff.Cancel = ctx.Done()
+	err := backoff.Retry(fmt.Sprintf("Upload of %s", name), func() error {
+		return handleNewHeapDump(s.fileSystem, s.cfg, job, s.journal)
+	}, utils.Transient, utils.Expired)
+	if err != nil && ctx.Err() != nil {
+		// not the fault of the dump, it is picked up again after the restart
+		log.WithFields(log.Fields{
+			"caller": "upload",
+		}).Warn(fmt.Sprintf("Upload of %s was interrupted by the shutdown: %s", name, err.Error()))
+		s.tracker.Forget(job.path)
+		return
+	}
+	if errors.Is(err, utils.ErrSourceChanged) {
+		// still being written, the dump is uploaded once it settled again
+		log.WithFields(log.Fields{
+			"caller": "upload",
+		}).Warn(fmt.Sprintf("%s changed during its upload, waiting for it to settle again: %s", name, err.Error()))
+		s.tracker.Forget(job.path)
+		s.checkFile(ctx, watcher.Event{Path: job.path, Op: watcher.Found})
+		return
+	}
+	s.tracker.Finish(job.path, err)
+	if entry, found := s.journal.Get(job.path); err != nil && found && entry.State == journal.DumpUploaded {
+		// the dump is stored, it must not be uploaded again or quarantined
+		log.WithFields(log.Fields{
+			"caller": "upload",
+		}).Error(fmt.Sprintf("Could not upload the key of %s, retrying on the next start: %s", name, err.Error()))
+		return
+	}
+	var invalid *invalidDumpError
+	if errors.As(err, &invalid) {
+		s.quarantineFile(job.path, fmt.Sprintf("invalid heap dump (%s)", invalid.verdict.Status), err)
+		return
+	}
+	if err != nil {
+		class := utils.Classify(err)
+		log.WithFields(log.Fields{
+			"caller": "upload",
+		}).Error(fmt.Sprintf("Upload of %s failed (%s): %s", name, class, err.Error()))
+		metrics.FailedUploads.WithLabelValues(s.cfg.ServiceOwner.Tenant, class.String()).Inc()
+		s.quarantineFile(job.path, fmt.Sprintf("upload failed (%s)", class), err)
+	}
+}
+
+// resume finishes or restarts the uploads the journal knows about. It runs
+// before the watcher starts, so no dump is picked up while its previous
+// upload is still pending.
+func (s *sidecar) resume() {
+	entries, err := s.journal.Load()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "resume",
+		}).Error(err.Error())
+		return
+	}
+	for i := range entries {
+		s.resumeEntry(&entries[i])
+	}
+}
+
+func (s *sidecar) resumeEntry(entry *journal.Entry) {
+	logger := log.WithFields(log.Fields{
+		"caller": "resume",
+	})
+	info, err := os.Stat(entry.File)
+	changed := err != nil || !entry.Matches(info)
+
+	if entry.State == journal.Requested {
+		// uploading a stored dump again would store it twice
+		stored, err := dumpStored(s.fileSystem, s.cfg, s.journal, entry)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Could not check whether %s was stored before the restart: %s", entry.File, err.Error()))
+		}
+		if stored {
+			entry.State = journal.DumpUploaded
+			saveJournal(s.journal, entry)
+		}
+	}
+
+	switch {
+	case entry.State == journal.DumpUploaded:
+		// the key does not need the dump, it is stored even if the dump
+		// changed since
+		logger.Info(fmt.Sprintf("Uploading the key and manifest of %s, the dump was uploaded before the restart", entry.File))
+		if err := uploadKeyAndManifest(s.fileSystem, s.cfg, s.journal, entry); err != nil {
+			// without its key the uploaded dump is useless, keep trying
+			// instead of uploading it again
+			logger.Warn(fmt.Sprintf("Could not upload the key of %s, retrying later: %s", entry.File, err.Error()))
+			return
+		}
+		if changed {
+			s.journal.Remove(entry.File)
+			return
+		}
+		finishUpload(s.cfg, s.journal, entry.File)
+	case changed:
+		// the dump is gone or was replaced by a new one with the same name
+		logger.Info(fmt.Sprintf("Dropping journal entry of %s in state %s, the dump changed", entry.File, entry.State))
+		s.abandon(entry)
+	case entry.State == journal.Completed:
+		logger.Info(fmt.Sprintf("%s was uploaded before the restart, removing it", entry.File))
+		finishUpload(s.cfg, s.journal, entry.File)
+	default:
+		// the plaintext key is not journaled, so the dump is uploaded again
+		logger.Info(fmt.Sprintf("Restarting the interrupted upload of %s", entry.File))
+		s.abandon(entry)
+	}
+}
+
+// abandon drops a journal entry and aborts its multipart upload, if any.
+func (s *sidecar) abandon(entry *journal.Entry) {
+	if entry.UploadID != "" && entry.State == journal.Requested {
+		err := utils.AbortMultipartUpload(s.fileSystem, s.cfg, entry.Payload, entry.UploadID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"caller": "resume",
+			}).Warn(err.Error())
+		}
+	}
+	s.journal.Remove(entry.File)
+}
+
+// watch processes the files in the watch path until ctx is cancelled.
+// Heap dumps being uploaded at that time are finished first, queued ones
+// are left for the next start.
+func (s *sidecar) watch(ctx context.Context) {
+	s.resume()
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.workers(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work(ctx)
+		}()
+	}
+	defer func() {
+		for _, job := range s.queue.close() {
+			s.tracker.Forget(job.path)
+		}
+		workers.Wait()
+	}()
+
+	w, err := watcher.New(s.cfg.WatchPath.Path, s.cfg.Watcher.Backend, time.Duration(s.cfg.Watcher.PollIntervalSeconds)*time.Second)
+	utils.CheckError(err)
+	defer w.Close()
+
+	// Files only found in a listing need to be checked again until they
+	// settle, inotify will not report them a second time.
+	recheck := time.NewTicker(10 * time.Second)
+	defer recheck.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.WithFields(log.Fields{
+				"caller": "watchChanges",
+			}).Info("Stopped watching for new files")
+			return
+		case event := <-w.Events():
+			s.checkFile(ctx, event)
+		case err := <-w.Errors():
+			log.WithFields(log.Fields{
+				"caller": "watchChanges",
+			}).Error(err.Error())
+		case <-recheck.C:
+			for _, path := range s.tracker.Pending() {
+				if ctx.Err() != nil {
+					break
+				}
+				s.checkFile(ctx, watcher.Event{Path: path, Op: watcher.Found})
+			}
+			s.quarantine.Prune()
+		}
+	}
+}
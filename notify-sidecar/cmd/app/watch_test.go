@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	cfg "github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/journal"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+)
+
+func newTestSidecar(t *testing.T) (*sidecar, string) {
+	t.Helper()
+	var appConfig cfg.AppConfig
+	appConfig.WatchPath.Path = t.TempDir()
+	appConfig.ServiceOwner.Tenant = "testTenant"
+	s, err := newSidecar(appConfig)
+	if err != nil {
+		t.Fatalf("Failed to create sidecar: %v", err)
+	}
+	return s, appConfig.WatchPath.Path
+}
+
+func journaledDump(t *testing.T, s *sidecar, dir string, state journal.State) string {
+	t.Helper()
+	file := filepath.Join(dir, "java_pid1.hprof")
+	os.WriteFile(file, []byte("dump"), 0o644)
+	info, _ := os.Stat(file)
+	s.journal.Save(&journal.Entry{File: file, Size: info.Size(), ModTime: info.ModTime(), State: state})
+	return file
+}
+
+func TestResumeCompletedUpload(t *testing.T) {
+	s, dir := newTestSidecar(t)
+	file := journaledDump(t, s, dir, journal.Completed)
+
+	s.resume()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("an uploaded dump must be removed instead of uploaded again")
+	}
+	if entries, _ := s.journal.Load(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestResumeInterruptedUpload(t *testing.T) {
+	s, dir := newTestSidecar(t)
+	file := journaledDump(t, s, dir, journal.Requested)
+
+	s.resume()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("an interrupted upload has to start over: %v", err)
+	}
+	if entries, _ := s.journal.Load(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestResumeReplacedDump(t *testing.T) {
+	s, dir := newTestSidecar(t)
+	file := journaledDump(t, s, dir, journal.Completed)
+	// a new dump with the same name must not be taken for the uploaded one
+	os.WriteFile(file, []byte("new dump"), 0o644)
+
+	s.resume()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("the new dump must be kept: %v", err)
+	}
+	if entries, _ := s.journal.Load(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestResumeFailedKeyUpload(t *testing.T) {
+	var mu sync.Mutex
+	dumpUploads := 0
+	keyReply := http.StatusInternalServerError
+	uploaded := map[string]string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/key":
+			json.NewEncoder(w).Encode(models.KeyResponse{AesKey: staticTestKey, EncryptedAesKey: "cryptedTest"})
+		case r.Method == http.MethodPost && r.URL.Path == "/upload":
+			var signing models.SigningRequest
+			json.NewDecoder(r.Body).Decode(&signing)
+			keyURL := server.URL + "/dump.key"
+			if signing.ChecksumSHA256 == "" {
+				// new URLs for the key of a stored dump
+				keyURL = server.URL + "/fresh.key"
+			}
+			json.NewEncoder(w).Encode(models.SigningResponse{
+				URL:                server.URL + "/dump",
+				EncryptedAesKey:    signing.EncryptedAesKey,
+				EncryptedAesKeyURL: keyURL,
+			})
+		case r.Method == http.MethodPut && r.URL.Path == "/dump":
+			io.Copy(io.Discard, r.Body)
+			dumpUploads++
+		case r.Method == http.MethodPut && r.URL.Path == "/dump.key":
+			w.WriteHeader(keyReply)
+			if keyReply == http.StatusForbidden {
+				fmt.Fprint(w, "<Message>Request has expired</Message>")
+			}
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			uploaded[r.URL.Path] = string(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s, dir := newTestSidecar(t)
+	s.cfg.Middleware.Endpoint = server.URL + "/upload"
+	s.cfg.Retry.Attempts = 1
+	file := filepath.Join(dir, "java_pid1.hprof")
+	os.WriteFile(file, []byte("some heap dump"), 0o644)
+	info, _ := os.Stat(file)
+	s.fileSystem = fstest.MapFS{
+		"var/run/secrets/kubernetes.io/serviceaccount/token":     {Data: []byte("test_token")},
+		"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
+		strings.TrimPrefix(file, "/"):                            {Data: []byte("some heap dump"), ModTime: info.ModTime()},
+	}
+
+	job := uploadJob{path: file, rule: cfg.Rule{ArtifactType: "core"}}
+	if err := handleNewHeapDump(s.fileSystem, s.cfg, job, s.journal); err == nil {
+		t.Fatalf("Expected the key upload to fail")
+	}
+	if entry, found := s.journal.Get(file); !found || entry.State != journal.DumpUploaded {
+		t.Fatalf("the stored dump has to stay in the journal, got %+v (%v)", entry, found)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("the dump has to be kept until its key is stored: %v", err)
+	}
+
+	// the key URL expired by the time the sidecar is restarted
+	mu.Lock()
+	keyReply = http.StatusForbidden
+	mu.Unlock()
+	s.cfg.Retry.Attempts = 2
+	s.resume()
+
+	if dumpUploads != 1 {
+		t.Errorf("the dump must not be uploaded again, got %d uploads", dumpUploads)
+	}
+	if uploaded["/fresh.key"] != "cryptedTest" {
+		t.Errorf("the key has to be stored with a new URL, got %v", uploaded)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("the dump has to be removed once its key is stored")
+	}
+	if entries, _ := s.journal.Load(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestResumeStoredDump(t *testing.T) {
+	var mu sync.Mutex
+	var dumpPuts, heads int
+	stored := true
+	uploaded := map[string]string{}
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/upload":
+			json.NewEncoder(w).Encode(models.SigningResponse{
+				URL:                server.URL + "/dump",
+				EncryptedAesKeyURL: server.URL + "/dump.key",
+				HeadURL:            server.URL + "/dump",
+			})
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/abort":
+		case r.Method == http.MethodHead && r.URL.Path == "/dump":
+			heads++
+			if !stored {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Length", "42")
+		case r.Method == http.MethodHead:
+			// the journaled URL expired
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodPut && r.URL.Path == "/dump":
+			dumpPuts++
+		case r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			uploaded[r.URL.Path] = string(body)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		uploadID string
+		stored   bool
+	}{
+		{"single PUT stored", "", true},
+		{"multipart completed", "upload-1", true},
+		{"not stored", "upload-1", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, dir := newTestSidecar(t)
+			s.cfg.Middleware.Endpoint = server.URL + "/upload"
+			s.cfg.Retry.Attempts = 2
+			s.fileSystem = fstest.MapFS{
+				"var/run/secrets/kubernetes.io/serviceaccount/token":     {Data: []byte("test_token")},
+				"var/run/secrets/kubernetes.io/serviceaccount/namespace": {Data: []byte("platform")},
+			}
+			mu.Lock()
+			stored, dumpPuts, heads, uploaded = test.stored, 0, 0, map[string]string{}
+			mu.Unlock()
+			file := filepath.Join(dir, "java_pid1.hprof")
+			os.WriteFile(file, []byte("dump"), 0o644)
+			info, _ := os.Stat(file)
+			s.journal.Save(&journal.Entry{
+				File:               file,
+				Size:               info.Size(),
+				ModTime:            info.ModTime(),
+				State:              journal.Requested,
+				Payload:            models.Payload{FileName: "pod-java_pid1.hprof.crypted", Size: 42},
+				UploadID:           test.uploadID,
+				EncryptedAesKey:    "cryptedTest",
+				EncryptedAesKeyURL: server.URL + "/dump.key",
+				HeadURL:            server.URL + "/expired",
+			})
+
+			s.resume()
+			if heads != 1 {
+				t.Errorf("the dump has to be looked up with a new URL, got %d lookups", heads)
+			}
+			if dumpPuts != 0 {
+				t.Errorf("the dump must not be uploaded while resuming, got %d uploads", dumpPuts)
+			}
+			_, err := os.Stat(file)
+			if test.stored && (uploaded["/dump.key"] != "cryptedTest" || !os.IsNotExist(err)) {
+				t.Errorf("a stored dump only needs its key, got %v and %v", uploaded, err)
+			}
+			if !test.stored && (len(uploaded) != 0 || err != nil) {
+				t.Errorf("a dump that was not stored has to be uploaded again, got %v and %v", uploaded, err)
+			}
+			if entries, _ := s.journal.Load(); len(entries) != 0 {
+				t.Errorf("got %v", entries)
+			}
+		})
+	}
+}
+
+func TestWatchStopsOnCancel(t *testing.T) {
+	s, _ := newTestSidecar(t)
+	s.cfg.Watcher.Backend = "poll"
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.watch(ctx)
+	}()
+	cancel()
+	if !waitForDrain(done, 5*time.Second) {
+		t.Errorf("watch must return once cancelled")
+	}
+}
+
+func TestDrainHandler(t *testing.T) {
+	ctx, drain := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(done)
+	}()
+	rec := httptest.NewRecorder()
+	drainHandler(drain, done, time.Second).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/drain", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d", rec.Code)
+	}
+
+	busy := make(chan struct{})
+	rec = httptest.NewRecorder()
+	drainHandler(func() {}, busy, 10*time.Millisecond).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/drain", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("an upload outlasting the grace period must be reported, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package artifact
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// Artifact types, the names are used in the config, in the payload sent to
+// the heap dump service and as prefix of the object key.
+const (
+	Hprof        = "hprof"
+	HprofGzip    = "hprof.gz"
+	Pprof        = "pprof"
+	Gcdump       = "gcdump"
+	Heapsnapshot = "heapsnapshot"
+	Core         = "core"
+)
+
+// Types lists all artifact types.
+var Types = []string{Hprof, HprofGzip, Pprof, Gcdump, Heapsnapshot, Core}
+
+var extensions = map[string]string{
+	Hprof:        ".hprof",
+	HprofGzip:    ".hprof.gz",
+	Pprof:        ".pb.gz",
+	Gcdump:       ".gcdump",
+	Heapsnapshot: ".heapsnapshot",
+	Core:         ".core",
+}
+
+// sniffSize is the number of bytes Detect needs at most.
+const sniffSize = 4096
+
+var (
+	hprofMagic   = []byte("JAVA PROFILE 1.0.")
+	gzipMagic    = []byte{0x1f, 0x8b}
+	elfMagic     = []byte{0x7f, 'E', 'L', 'F'}
+	fastSerMagic = []byte("!FastSerialization.1")
+)
+
+// Extension returns the file extension of an artifact type.
+func Extension(artifactType string) string {
+	if ext, ok := extensions[artifactType]; ok {
+		return ext
+	}
+	return ""
+}
+
+// Compressed tells whether artifacts of the type are compressed already,
+// compressing them again only costs CPU.
+func Compressed(artifactType string) bool {
+	return artifactType == HprofGzip || artifactType == Pprof
+}
+
+// Sniff reads the start of r and detects its artifact type. It returns an
+// empty type if the content is not recognized.
+func Sniff(r io.ReaderAt) (string, error) {
+	header := make([]byte, sniffSize)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", errors.New(fmt.Sprintf("Error reading file header: %s", err.Error()))
+	}
+	return Detect(header[:n]), nil
+}
+
+// Detect returns the artifact type of a file starting with header, or an
+// empty type if the content is not recognized:
+//
+//   - hprof: "JAVA PROFILE 1.0.x", as written by the JVM
+//   - hprof.gz: a gzip stream holding an hprof, as written with -gz
+//   - pprof: a gzip stream holding a protobuf message, as written by Go
+//   - gcdump: a FastSerialization stream, as written by dotnet-gcdump
+//   - heapsnapshot: a JSON object starting with "snapshot", as written by V8
+//   - core: an ELF file of type ET_CORE
+func Detect(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, hprofMagic):
+		return Hprof
+	case bytes.HasPrefix(header, gzipMagic):
+		return detectGzip(header)
+	case bytes.HasPrefix(header, elfMagic):
+		if isCore(header) {
+			return Core
+		}
+	case len(header) >= 4+len(fastSerMagic) && bytes.Equal(header[4:4+len(fastSerMagic)], fastSerMagic):
+		return Gcdump
+	case isHeapsnapshot(header):
+		return Heapsnapshot
+	}
+	return ""
+}
+
+// detectGzip looks at the first decompressed bytes of a gzip stream.
+func detectGzip(header []byte) string {
+	gz, err := gzip.NewReader(bytes.NewReader(header))
+	if err != nil {
+		return ""
+	}
+	content := make([]byte, len(hprofMagic))
+	// the header may end in the middle of the stream
+	n, _ := io.ReadFull(gz, content)
+	content = content[:n]
+	switch {
+	case bytes.HasPrefix(content, hprofMagic):
+		return HprofGzip
+	// a profile.proto message starts with its repeated sample_type field
+	case n > 0 && content[0] == 0x0a:
+		return Pprof
+	}
+	return ""
+}
+
+// isCore checks e_type of an ELF header, which follows the 16 bytes of
+// e_ident in the byte order given by EI_DATA.
+func isCore(header []byte) bool {
+	const etCore = 4
+	if len(header) < 18 {
+		return false
+	}
+	switch header[5] {
+	case 1:
+		return binary.LittleEndian.Uint16(header[16:18]) == etCore
+	case 2:
+		return binary.BigEndian.Uint16(header[16:18]) == etCore
+	}
+	return false
+}
+
+func isHeapsnapshot(header []byte) bool {
+	trimmed := bytes.TrimLeft(header, " \t\r\n")
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		return false
+	}
+	trimmed = bytes.TrimLeft(trimmed[1:], " \t\r\n")
+	return bytes.HasPrefix(trimmed, []byte(`"snapshot"`))
+}
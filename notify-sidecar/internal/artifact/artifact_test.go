@@ -0,0 +1,93 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func gzipped(data []byte) []byte {
+	var out bytes.Buffer
+	w := gzip.NewWriter(&out)
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+func elf(byteOrder binary.ByteOrder, eiData byte, eType uint16) []byte {
+	header := make([]byte, 64)
+	copy(header, elfMagic)
+	header[4] = 2 // 64 bit
+	header[5] = eiData
+	byteOrder.PutUint16(header[16:18], eType)
+	return header
+}
+
+func TestDetect(t *testing.T) {
+	random := make([]byte, 1024)
+	rand.Read(random)
+	hprof := append([]byte("JAVA PROFILE 1.0.2\x00"), random...)
+
+	cases := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"hprof", hprof, Hprof},
+		{"hprof 1.0.1", []byte("JAVA PROFILE 1.0.1\x00\x00\x00\x00\x08"), Hprof},
+		{"gzipped hprof", gzipped(hprof), HprofGzip},
+		{"pprof", gzipped(append([]byte{0x0a, 0x0c, 0x08, 0x01}, random...)), Pprof},
+		{"other gzip", gzipped([]byte("just some text")), ""},
+		{"gcdump", append([]byte{20, 0, 0, 0}, "!FastSerialization.1"...), Gcdump},
+		{"heapsnapshot", []byte(`{"snapshot":{"meta":{"node_fields":["type","name"]}}}`), Heapsnapshot},
+		{"indented heapsnapshot", []byte("{\n  \"snapshot\": {}"), Heapsnapshot},
+		{"other json", []byte(`{"nodes":[]}`), ""},
+		{"little endian core", elf(binary.LittleEndian, 1, 4), Core},
+		{"big endian core", elf(binary.BigEndian, 2, 4), Core},
+		{"executable", elf(binary.LittleEndian, 1, 2), ""},
+		{"truncated elf", elfMagic, ""},
+		{"random", random, ""},
+		{"empty", nil, ""},
+	}
+	for _, tc := range cases {
+		if got := Detect(tc.header); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDetectLargeGzippedHprof(t *testing.T) {
+	// the sniffed header only holds the start of the gzip stream
+	hprof := make([]byte, 1024*1024)
+	copy(hprof, hprofMagic)
+	rand.Read(hprof[32:])
+	if got := Detect(gzipped(hprof)[:sniffSize]); got != HprofGzip {
+		t.Errorf("got %q, want %q", got, HprofGzip)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	got, err := Sniff(strings.NewReader("JAVA PROFILE 1.0.2"))
+	if err != nil || got != Hprof {
+		t.Errorf("got %q, %v", got, err)
+	}
+	got, err = Sniff(strings.NewReader(""))
+	if err != nil || got != "" {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestExtension(t *testing.T) {
+	for _, artifactType := range Types {
+		if !strings.HasPrefix(Extension(artifactType), ".") {
+			t.Errorf("%s has no extension", artifactType)
+		}
+	}
+	if Extension("unknown") != "" {
+		t.Errorf("unknown types have no extension")
+	}
+}
@@ -24,8 +24,57 @@ type AppConfig struct {
 	ServiceOwner struct {
 		Tenant string
 	}
+	Upload struct {
+		Concurrency int
+		Workers     int
+	}
+	Watcher struct {
+		Backend             string
+		PollIntervalSeconds int
+		SettleSeconds       int
+		StableChecks        int
+	}
+	Rules   []Rule
+	Cleanup struct {
+		FlagAfterSeconds       int
+		QuarantineAfterSeconds int
+	}
+	Quarantine struct {
+		Path          string
+		MaxBytes      int64
+		MaxAgeSeconds int
+	}
+	Journal struct {
+		Path string
+	}
+	Retry struct {
+		Attempts            int
+		InitialDelaySeconds int
+		MaxDelaySeconds     int
+	}
+	Shutdown struct {
+		GracePeriodSeconds int
+	}
+	Compression struct {
+		Algorithm   string
+		Level       int
+		StagingPath string
+	}
+	Validation struct {
+		Policy string
+	}
+	Manifest struct {
+		PodInfoPath string
+	}
 }
 
+// Policies for hprof heap dumps the validator finds truncated or corrupt.
+const (
+	ValidationUpload     = "upload"
+	ValidationQuarantine = "quarantine"
+	ValidationOff        = "off"
+)
+
 func LoadConfigFromEnvironment(envVarName string) (AppConfig, error) {
 	configFile, found := os.LookupEnv(envVarName)
 	var appConfig AppConfig
@@ -57,5 +106,68 @@ func LoadConfigFromFile(configFile string) (AppConfig, error) {
 		}).Warnf(fmt.Sprintf("Failed to parse json data of file '%v': %v", configFile, err))
 		return appConfig, errors.New(fmt.Sprintf("Failed to parse json data of file '%v': %v", configFile, err.Error()))
 	}
+	if err := validate(&appConfig); err != nil {
+		log.WithFields(log.Fields{
+			"caller": "LoadConfigFromEnvironment",
+		}).Warnf(fmt.Sprintf("Invalid config file '%v': %v", configFile, err))
+		return appConfig, errors.New(fmt.Sprintf("Invalid config file '%v': %v", configFile, err.Error()))
+	}
 	return appConfig, nil
 }
+
+// Validate checks the config and compiles its rules. Every config has to pass
+// it before its rules are matched, LoadConfigFromFile does so on its own.
+func (appConfig *AppConfig) Validate() error {
+	return validate(appConfig)
+}
+
+func validate(appConfig *AppConfig) error {
+	switch appConfig.Watcher.Backend {
+	case "", "inotify", "poll":
+	default:
+		return errors.New(fmt.Sprintf("Watcher.backend must be \"inotify\" or \"poll\", got \"%s\"", appConfig.Watcher.Backend))
+	}
+	if appConfig.Watcher.PollIntervalSeconds < 0 {
+		return errors.New("Watcher.pollIntervalSeconds must not be negative")
+	}
+	if appConfig.Watcher.SettleSeconds < 0 {
+		return errors.New("Watcher.settleSeconds must not be negative")
+	}
+	if appConfig.Watcher.StableChecks < 0 {
+		return errors.New("Watcher.stableChecks must not be negative")
+	}
+	if appConfig.Cleanup.FlagAfterSeconds < 0 || appConfig.Cleanup.QuarantineAfterSeconds < 0 {
+		return errors.New("Cleanup thresholds must not be negative")
+	}
+	if appConfig.Quarantine.MaxBytes < 0 || appConfig.Quarantine.MaxAgeSeconds < 0 {
+		return errors.New("Quarantine limits must not be negative")
+	}
+	if appConfig.Retry.Attempts < 0 || appConfig.Retry.InitialDelaySeconds < 0 || appConfig.Retry.MaxDelaySeconds < 0 {
+		return errors.New("Retry settings must not be negative")
+	}
+	if appConfig.Upload.Concurrency < 0 || appConfig.Upload.Workers < 0 {
+		return errors.New("Upload concurrency and workers must not be negative")
+	}
+	if appConfig.Shutdown.GracePeriodSeconds < 0 {
+		return errors.New("Shutdown.gracePeriodSeconds must not be negative")
+	}
+	switch appConfig.Compression.Algorithm {
+	case "", "none":
+	case "gzip":
+		if appConfig.Compression.Level < 0 || appConfig.Compression.Level > 9 {
+			return errors.New(fmt.Sprintf("Compression.level must be between 1 and 9 for gzip, got %d", appConfig.Compression.Level))
+		}
+	case "zstd":
+		if appConfig.Compression.Level < 0 || appConfig.Compression.Level > 22 {
+			return errors.New(fmt.Sprintf("Compression.level must be between 1 and 22 for zstd, got %d", appConfig.Compression.Level))
+		}
+	default:
+		return errors.New(fmt.Sprintf("Compression.algorithm must be \"none\", \"gzip\" or \"zstd\", got \"%s\"", appConfig.Compression.Algorithm))
+	}
+	switch appConfig.Validation.Policy {
+	case "", ValidationUpload, ValidationQuarantine, ValidationOff:
+	default:
+		return errors.New(fmt.Sprintf("Validation.policy must be \"upload\", \"quarantine\" or \"off\", got \"%s\"", appConfig.Validation.Policy))
+	}
+	return compileRules(appConfig.Rules)
+}
@@ -58,6 +58,54 @@ func TestFailLoadConfigFromFile(t *testing.T) {
 	}
 }
 
+func TestInvalidWatcherBackend(t *testing.T) {
+	want := errors.New(fmt.Sprintf("Invalid config file '%v': %v", "../../config/test/bad-watcher-config.json", "Watcher.backend must be \"inotify\" or \"poll\", got \"fanotify\""))
+	_, got := LoadConfigFromFile("../../config/test/bad-watcher-config.json")
+	if got == nil {
+		t.Errorf("This should produce an error!")
+	}
+	if !reflect.DeepEqual(got.Error(), want.Error()) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestInvalidCompression(t *testing.T) {
+	cases := []struct {
+		algorithm string
+		level     int
+		want      string
+	}{
+		{"lz4", 0, "Compression.algorithm must be \"none\", \"gzip\" or \"zstd\", got \"lz4\""},
+		{"gzip", 10, "Compression.level must be between 1 and 9 for gzip, got 10"},
+		{"zstd", 23, "Compression.level must be between 1 and 22 for zstd, got 23"},
+		{"zstd", -1, "Compression.level must be between 1 and 22 for zstd, got -1"},
+	}
+	for _, tc := range cases {
+		var appConfig AppConfig
+		appConfig.Compression.Algorithm = tc.algorithm
+		appConfig.Compression.Level = tc.level
+		err := validate(&appConfig)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("got %v, want %s", err, tc.want)
+		}
+	}
+	var appConfig AppConfig
+	appConfig.Compression.Algorithm = "zstd"
+	appConfig.Compression.Level = 19
+	if err := validate(&appConfig); err != nil {
+		t.Errorf("zstd level 19 is valid, got %v", err)
+	}
+}
+
+func TestInvalidValidationPolicy(t *testing.T) {
+	var appConfig AppConfig
+	appConfig.Validation.Policy = "delete"
+	want := "Validation.policy must be \"upload\", \"quarantine\" or \"off\", got \"delete\""
+	if err := validate(&appConfig); err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
 func TestLoadConfigFromEnv(t *testing.T) {
 	os.Setenv("TEST_APP_CONFIG_FILE", "../../config/test/test-config.json")
 	defer os.Unsetenv("TEST_APP_CONFIG_FILE")
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/artifact"
+)
+
+const (
+	ActionUpload = "upload"
+	ActionIgnore = "ignore"
+	ActionDelete = "delete"
+)
+
+// ArtifactTypes lists the artifact types a rule can assign to a file.
+var ArtifactTypes = artifact.Types
+
+// Rule decides what happens with a file in the watch path. A file matches
+// if its name matches one of the globs or regular expressions (or there are
+// none) and its size is within MinSizeBytes and MaxSizeBytes. A MaxSizeBytes
+// of 0 means unlimited, a SettleSeconds of 0 uses Watcher.SettleSeconds.
+type Rule struct {
+	Name          string
+	Globs         []string
+	Regex         []string
+	MinSizeBytes  int64
+	MaxSizeBytes  int64
+	SettleSeconds int
+	ArtifactType  string
+	Action        string
+
+	regexps []*regexp.Regexp
+}
+
+// defaultRules reflect the behavior before rules were configurable: every
+// file of at least 16 MiB is uploaded as a heap dump.
+var defaultRules = []Rule{
+	{
+		Name:         "heap-dumps",
+		Globs:        []string{"*"},
+		MinSizeBytes: 16 * 1024 * 1024,
+		ArtifactType: "hprof",
+		Action:       ActionUpload,
+	},
+}
+
+// MatchRule returns the first rule matching a file with the given name and
+// size. Without configured rules the default rules are used.
+func (appConfig AppConfig) MatchRule(name string, size int64) (Rule, bool) {
+	rules := appConfig.Rules
+	if len(rules) == 0 {
+		rules = defaultRules
+	}
+	for _, rule := range rules {
+		if rule.matches(name, size) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func (rule Rule) matches(name string, size int64) bool {
+	if size < rule.MinSizeBytes || (rule.MaxSizeBytes > 0 && size > rule.MaxSizeBytes) {
+		return false
+	}
+	if len(rule.Globs) == 0 && len(rule.Regex) == 0 {
+		return true
+	}
+	for _, glob := range rule.Globs {
+		if matched, _ := path.Match(glob, name); matched {
+			return true
+		}
+	}
+	// Regular expressions that were never compiled match nothing, a rule
+	// must not turn into a catch-all because its config skipped Validate.
+	if len(rule.regexps) != len(rule.Regex) {
+		return false
+	}
+	for _, re := range rule.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRules validates all rules and compiles their regular expressions.
+func compileRules(rules []Rule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = ActionUpload
+		case ActionUpload, ActionIgnore, ActionDelete:
+		default:
+			return errors.New(fmt.Sprintf("Rule %s: action must be one of upload, ignore or delete, got \"%s\"", rule.Name, rule.Action))
+		}
+		if rule.ArtifactType == "" {
+			rule.ArtifactType = "hprof"
+		}
+		if !knownArtifactType(rule.ArtifactType) {
+			return errors.New(fmt.Sprintf("Rule %s: unknown artifact type \"%s\"", rule.Name, rule.ArtifactType))
+		}
+		if rule.MinSizeBytes < 0 || rule.MaxSizeBytes < 0 || rule.SettleSeconds < 0 {
+			return errors.New(fmt.Sprintf("Rule %s: sizes and settle time must not be negative", rule.Name))
+		}
+		if rule.MaxSizeBytes > 0 && rule.MaxSizeBytes < rule.MinSizeBytes {
+			return errors.New(fmt.Sprintf("Rule %s: maxSizeBytes is smaller than minSizeBytes", rule.Name))
+		}
+		for _, glob := range rule.Globs {
+			if _, err := path.Match(glob, ""); err != nil {
+				return errors.New(fmt.Sprintf("Rule %s: invalid glob \"%s\": %s", rule.Name, glob, err.Error()))
+			}
+		}
+		rule.regexps = make([]*regexp.Regexp, 0, len(rule.Regex))
+		for _, expr := range rule.Regex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return errors.New(fmt.Sprintf("Rule %s: invalid regex \"%s\": %s", rule.Name, expr, err.Error()))
+			}
+			rule.regexps = append(rule.regexps, re)
+		}
+	}
+	return nil
+}
+
+func knownArtifactType(artifactType string) bool {
+	for _, known := range ArtifactTypes {
+		if known == artifactType {
+			return true
+		}
+	}
+	return false
+}
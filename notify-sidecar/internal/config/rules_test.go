@@ -0,0 +1,86 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	appConfig, err := LoadConfigFromFile("../../config/test/rules-config.json")
+	if err != nil {
+		t.Fatalf("Failed to construct config: %v", err)
+	}
+	cases := []struct {
+		name     string
+		size     int64
+		wantRule string
+	}{
+		{"java_pid1.hprof.tmp", 4096, "temporary"},
+		{"java_pid1.hprof", 4096, "heap-dumps"},
+		// too small and too large heap dumps fall through to the last rule
+		{"java_pid1.hprof", 10, "leftovers"},
+		{"java_pid1.hprof", 2 << 30, "leftovers"},
+		{"core.1", 4096, "leftovers"},
+	}
+	for _, tc := range cases {
+		rule, matched := appConfig.MatchRule(tc.name, tc.size)
+		if !matched || rule.Name != tc.wantRule {
+			t.Errorf("%s (%d bytes): got %s (%v), want %s", tc.name, tc.size, rule.Name, matched, tc.wantRule)
+		}
+	}
+	rule, _ := appConfig.MatchRule("java_pid1.hprof", 4096)
+	if rule.SettleSeconds != 30 || rule.ArtifactType != "hprof" || rule.Action != ActionUpload {
+		t.Errorf("got %+v", rule)
+	}
+}
+
+func TestDefaultRules(t *testing.T) {
+	var appConfig AppConfig
+	rule, matched := appConfig.MatchRule("java_pid1.hprof", 16*1024*1024)
+	if !matched || rule.Action != ActionUpload {
+		t.Errorf("heap dumps must be uploaded by default, got %+v", rule)
+	}
+	if _, matched := appConfig.MatchRule("java_pid1.hprof", 1024); matched {
+		t.Errorf("files smaller than 16 MiB must not match by default")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	cases := []struct {
+		rule Rule
+		want string
+	}{
+		{Rule{Name: "a", Action: "archive"}, "Rule a: action must be one of upload, ignore or delete"},
+		{Rule{Name: "b", ArtifactType: "zip"}, "Rule b: unknown artifact type"},
+		{Rule{Name: "c", Globs: []string{"[a-"}}, "Rule c: invalid glob"},
+		{Rule{Name: "d", Regex: []string{"(hprof"}}, "Rule d: invalid regex"},
+		{Rule{Name: "e", MinSizeBytes: 10, MaxSizeBytes: 5}, "Rule e: maxSizeBytes is smaller than minSizeBytes"},
+		{Rule{Name: "f", SettleSeconds: -1}, "Rule f: sizes and settle time must not be negative"},
+	}
+	for _, tc := range cases {
+		err := compileRules([]Rule{tc.rule})
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("got %v, want %s", err, tc.want)
+		}
+	}
+}
+
+func TestUncompiledRegexMatchesNothing(t *testing.T) {
+	appConfig := AppConfig{Rules: []Rule{{Name: "regex-only", Regex: []string{`\.hprof$`}, Action: ActionUpload}}}
+	if _, matched := appConfig.MatchRule("core.1", 4096); matched {
+		t.Errorf("an uncompiled regex must not match every file")
+	}
+	if _, matched := appConfig.MatchRule("java_pid1.hprof", 4096); matched {
+		t.Errorf("an uncompiled regex must not match before the config is validated")
+	}
+
+	if err := appConfig.Validate(); err != nil {
+		t.Fatalf("Failed to validate config: %v", err)
+	}
+	if _, matched := appConfig.MatchRule("core.1", 4096); matched {
+		t.Errorf("core.1 must not match \\.hprof$")
+	}
+	if rule, matched := appConfig.MatchRule("java_pid1.hprof", 4096); !matched || rule.Name != "regex-only" {
+		t.Errorf("got %+v (%v), want regex-only", rule, matched)
+	}
+}
@@ -0,0 +1,265 @@
+package hprof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// Status is the verdict of the validator.
+type Status string
+
+const (
+	Valid     Status = "valid"
+	Truncated Status = "truncated"
+	Corrupt   Status = "corrupt"
+)
+
+const (
+	magicPrefix   = "JAVA PROFILE 1.0."
+	maxHeaderSize = 32
+
+	tagHeapDump        = 0x0c
+	tagHeapDumpSegment = 0x1c
+	tagHeapDumpEnd     = 0x2c
+)
+
+// topLevelTags are the record tags allowed outside of heap dump segments.
+var topLevelTags = map[byte]bool{
+	0x01: true, // UTF8
+	0x02: true, // LOAD CLASS
+	0x03: true, // UNLOAD CLASS
+	0x04: true, // STACK FRAME
+	0x05: true, // STACK TRACE
+	0x06: true, // ALLOC SITES
+	0x07: true, // HEAP SUMMARY
+	0x0a: true, // START THREAD
+	0x0b: true, // END THREAD
+	0x0c: true, // HEAP DUMP
+	0x0d: true, // CPU SAMPLES
+	0x0e: true, // CONTROL SETTINGS
+	0x1c: true, // HEAP DUMP SEGMENT
+	0x2c: true, // HEAP DUMP END
+}
+
+// Verdict describes the outcome of a validation.
+type Verdict struct {
+	Status  Status
+	Reason  string
+	Version string
+	Records int64
+}
+
+func (v Verdict) Valid() bool {
+	return v.Status == Valid
+}
+
+func (v Verdict) String() string {
+	if v.Reason == "" {
+		return string(v.Status)
+	}
+	return fmt.Sprintf("%s: %s", v.Status, v.Reason)
+}
+
+// source abstracts how the records are read. A short read or skip past the
+// end of the dump returns io.ErrUnexpectedEOF.
+type source interface {
+	read(p []byte) error
+	skip(n int64) error
+	atEnd() (bool, error)
+}
+
+// ValidateFile validates an uncompressed hprof of the given size. Only the
+// record headers are read, the bodies are skipped.
+func ValidateFile(r io.ReaderAt, size int64) (Verdict, error) {
+	return validate(&fileSource{r: r, size: size})
+}
+
+// Validate validates an uncompressed hprof read from r.
+func Validate(r io.Reader) (Verdict, error) {
+	return validate(&streamSource{r: bufio.NewReaderSize(r, 64*1024)})
+}
+
+// ValidateGzip validates a gzip compressed hprof read from r. A damaged
+// gzip stream makes the dump corrupt.
+func ValidateGzip(r io.Reader) (Verdict, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Verdict{Status: Truncated, Reason: "gzip header is incomplete"}, nil
+		}
+		return Verdict{Status: Corrupt, Reason: fmt.Sprintf("invalid gzip stream: %s", err.Error())}, nil
+	}
+	defer gz.Close()
+	verdict, err := Validate(gz)
+	if err != nil {
+		return Verdict{Status: Corrupt, Reason: fmt.Sprintf("invalid gzip stream: %s", err.Error()), Version: verdict.Version, Records: verdict.Records}, nil
+	}
+	return verdict, nil
+}
+
+func validate(src source) (Verdict, error) {
+	verdict := Verdict{}
+	version, err := readHeader(src)
+	if err != nil {
+		return classify(verdict, "header is incomplete", err)
+	}
+	if !strings.HasPrefix(version, magicPrefix) {
+		return Verdict{Status: Corrupt, Reason: "not an hprof file"}, nil
+	}
+	verdict.Version = version
+
+	fields := make([]byte, 12)
+	if err := src.read(fields); err != nil {
+		return classify(verdict, "header is incomplete", err)
+	}
+	if idSize := binary.BigEndian.Uint32(fields[:4]); idSize != 4 && idSize != 8 {
+		verdict.Status, verdict.Reason = Corrupt, fmt.Sprintf("invalid identifier size %d", idSize)
+		return verdict, nil
+	}
+
+	record := make([]byte, 9)
+	heapDump, segmented, ended := false, false, false
+	for {
+		end, err := src.atEnd()
+		if err != nil {
+			return verdict, err
+		}
+		if end {
+			break
+		}
+		if err := src.read(record); err != nil {
+			return classify(verdict, fmt.Sprintf("record %d is incomplete", verdict.Records+1), err)
+		}
+		tag := record[0]
+		length := binary.BigEndian.Uint32(record[5:9])
+		if !topLevelTags[tag] {
+			verdict.Status, verdict.Reason = Corrupt, fmt.Sprintf("unknown tag 0x%02x of record %d", tag, verdict.Records+1)
+			return verdict, nil
+		}
+		if err := src.skip(int64(length)); err != nil {
+			return classify(verdict, fmt.Sprintf("record %d (tag 0x%02x, %d bytes) is incomplete", verdict.Records+1, tag, length), err)
+		}
+		verdict.Records++
+		switch tag {
+		case tagHeapDump:
+			heapDump = true
+		case tagHeapDumpSegment:
+			heapDump, segmented = true, true
+		case tagHeapDumpEnd:
+			ended = true
+		}
+	}
+
+	switch {
+	case !heapDump:
+		verdict.Status, verdict.Reason = Truncated, "no heap dump record"
+	case segmented && !ended:
+		verdict.Status, verdict.Reason = Truncated, "heap dump end record is missing"
+	default:
+		verdict.Status = Valid
+	}
+	return verdict, nil
+}
+
+// readHeader reads the null terminated format name. It stops early once
+// the name can not be an hprof format name anymore.
+func readHeader(src source) (string, error) {
+	var name []byte
+	b := make([]byte, 1)
+	for len(name) < maxHeaderSize {
+		if err := src.read(b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			break
+		}
+		name = append(name, b[0])
+		if len(name) <= len(magicPrefix) && name[len(name)-1] != magicPrefix[len(name)-1] {
+			break
+		}
+	}
+	return string(name), nil
+}
+
+// classify turns an unexpected end of the dump into a verdict, other errors
+// are returned as they are.
+func classify(verdict Verdict, reason string, err error) (Verdict, error) {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		verdict.Status, verdict.Reason = Truncated, reason
+		return verdict, nil
+	}
+	return verdict, err
+}
+
+type fileSource struct {
+	r      io.ReaderAt
+	size   int64
+	offset int64
+}
+
+func (s *fileSource) read(p []byte) error {
+	if s.offset+int64(len(p)) > s.size {
+		return io.ErrUnexpectedEOF
+	}
+	n, err := s.r.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	if n < len(p) {
+		if err == nil || err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
+	}
+	return nil
+}
+
+func (s *fileSource) skip(n int64) error {
+	if s.offset+n > s.size {
+		return io.ErrUnexpectedEOF
+	}
+	s.offset += n
+	return nil
+}
+
+func (s *fileSource) atEnd() (bool, error) {
+	return s.offset >= s.size, nil
+}
+
+type streamSource struct {
+	r *bufio.Reader
+}
+
+func (s *streamSource) read(p []byte) error {
+	if _, err := io.ReadFull(s.r, p); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *streamSource) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, s.r, n)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (s *streamSource) atEnd() (bool, error) {
+	_, err := s.r.Peek(1)
+	switch err {
+	case io.EOF:
+		return true, nil
+	case io.ErrUnexpectedEOF:
+		// the next read reports the truncation
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,121 @@
+package hprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+type record struct {
+	tag    byte
+	length int
+}
+
+func buildHprof(version string, idSize uint32, records ...record) []byte {
+	var out bytes.Buffer
+	out.WriteString(version)
+	out.WriteByte(0)
+	binary.Write(&out, binary.BigEndian, idSize)
+	binary.Write(&out, binary.BigEndian, uint64(1700000000000))
+	for _, r := range records {
+		out.WriteByte(r.tag)
+		binary.Write(&out, binary.BigEndian, uint32(0))
+		binary.Write(&out, binary.BigEndian, uint32(r.length))
+		out.Write(bytes.Repeat([]byte{0xab}, r.length))
+	}
+	return out.Bytes()
+}
+
+func gzipped(data []byte) []byte {
+	var out bytes.Buffer
+	w := gzip.NewWriter(&out)
+	w.Write(data)
+	w.Close()
+	return out.Bytes()
+}
+
+var segmented = buildHprof("JAVA PROFILE 1.0.2", 8, record{0x01, 12}, record{0x02, 24}, record{0x1c, 1000}, record{0x1c, 500}, record{0x2c, 0})
+
+// validateAll runs all validators on data and checks they agree.
+func validateAll(t *testing.T, data []byte) Verdict {
+	t.Helper()
+	fromFile, err := ValidateFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("ValidateFile failed: %v", err)
+	}
+	fromStream, err := Validate(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	fromGzip, err := ValidateGzip(bytes.NewReader(gzipped(data)))
+	if err != nil {
+		t.Fatalf("ValidateGzip failed: %v", err)
+	}
+	if fromFile != fromStream || fromFile != fromGzip {
+		t.Errorf("validators disagree: %+v, %+v, %+v", fromFile, fromStream, fromGzip)
+	}
+	return fromFile
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   []byte
+		status Status
+		reason string
+	}{
+		{"segmented", segmented, Valid, ""},
+		{"1.0.1", buildHprof("JAVA PROFILE 1.0.1", 4, record{0x01, 8}, record{0x0c, 100}), Valid, ""},
+		{"missing end", buildHprof("JAVA PROFILE 1.0.2", 8, record{0x1c, 100}), Truncated, "heap dump end record is missing"},
+		{"no heap dump", buildHprof("JAVA PROFILE 1.0.2", 8, record{0x01, 12}), Truncated, "no heap dump record"},
+		{"unknown tag", buildHprof("JAVA PROFILE 1.0.2", 8, record{0x01, 12}, record{0x42, 3}), Corrupt, "unknown tag 0x42 of record 2"},
+		{"identifier size", buildHprof("JAVA PROFILE 1.0.2", 3), Corrupt, "invalid identifier size 3"},
+		{"not hprof", []byte("PK\x03\x04 some zip file"), Corrupt, "not an hprof file"},
+		{"empty", nil, Truncated, "header is incomplete"},
+	}
+	for _, tc := range cases {
+		got := validateAll(t, tc.data)
+		if got.Status != tc.status || got.Reason != tc.reason {
+			t.Errorf("%s: got %s, want %s: %s", tc.name, got, tc.status, tc.reason)
+		}
+	}
+}
+
+func TestValidateTruncated(t *testing.T) {
+	// every cut must be detected, no matter where the dump ends
+	for size := 0; size < len(segmented); size++ {
+		got := validateAll(t, segmented[:size])
+		if got.Status != Truncated {
+			t.Errorf("cut at %d of %d: got %s", size, len(segmented), got)
+		}
+	}
+}
+
+func TestValidateRecords(t *testing.T) {
+	got := validateAll(t, segmented)
+	if got.Records != 5 || got.Version != "JAVA PROFILE 1.0.2" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestValidateGzipDamaged(t *testing.T) {
+	compressed := gzipped(segmented)
+	got, err := ValidateGzip(bytes.NewReader(compressed[:len(compressed)/2]))
+	if err != nil || got.Status != Truncated {
+		t.Errorf("truncated gzip: got %s, %v", got, err)
+	}
+
+	damaged := bytes.Clone(compressed)
+	damaged[len(damaged)-5] ^= 0xff // CRC32 of the trailer
+	got, err = ValidateGzip(bytes.NewReader(damaged))
+	if err != nil || got.Status != Corrupt {
+		t.Errorf("damaged gzip: got %s, %v", got, err)
+	}
+
+	got, err = ValidateGzip(bytes.NewReader(segmented))
+	if err != nil || got.Status != Corrupt {
+		t.Errorf("plain hprof: got %s, %v", got, err)
+	}
+}
@@ -0,0 +1,178 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+)
+
+const entrySuffix = ".json"
+
+// State of a dump in the journal. A dump without entry was never uploaded.
+type State string
+
+const (
+	// Requested means upload URLs were issued and the dump is being uploaded.
+	Requested State = "requested"
+	// DumpUploaded means the encrypted dump is stored, its key is not.
+	DumpUploaded State = "dump-uploaded"
+	// Completed means dump, key and manifest are stored, only the local file
+	// is left.
+	Completed State = "completed"
+)
+
+// Entry records the upload of a single dump. The plaintext key is never
+// written to disk, so an interrupted upload of the dump itself can not be
+// resumed, only restarted, and the uploaded parts are not recorded. HeadURL
+// tells whether the dump was stored before the upload was interrupted.
+// Everything needed to finish the remaining steps is recorded.
+type Entry struct {
+	File     string         `json:"file"`
+	Size     int64          `json:"size"`
+	ModTime  time.Time      `json:"mod-time"`
+	State    State          `json:"state"`
+	Updated  time.Time      `json:"updated"`
+	Payload  models.Payload `json:"payload"`
+	UploadID string         `json:"upload-id,omitempty"`
+	HeadURL  string         `json:"head-url,omitempty"`
+
+	EncryptedAesKey    string `json:"encrypted-aes-key"`
+	EncryptedAesKeyURL string `json:"encrypted-aes-key-url"`
+	Manifest           string `json:"manifest,omitempty"`
+	ManifestURL        string `json:"manifest-url,omitempty"`
+}
+
+// Matches tells whether the entry was written for the file as it is now. A
+// new dump with the name of an earlier one does not match.
+func (e Entry) Matches(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// Journal keeps one JSON file per dump in a directory, preferably on the
+// watched volume, so it survives restarts of the sidecar. A nil Journal
+// records nothing.
+type Journal struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not create journal directory %s: %s", dir, err.Error()))
+	}
+	return &Journal{dir: dir}, nil
+}
+
+func (j *Journal) entryPath(file string) string {
+	return filepath.Join(j.dir, filepath.Base(file)+entrySuffix)
+}
+
+// Save writes entry atomically, a crash leaves either the old or the new
+// version behind.
+func (j *Journal) Save(entry *Entry) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Updated = time.Now().UTC()
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error encoding journal entry for %s: %s", entry.File, err.Error()))
+	}
+	tmp, err := os.CreateTemp(j.dir, ".entry-*")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error writing journal entry for %s: %s", entry.File, err.Error()))
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.New(fmt.Sprintf("Error writing journal entry for %s: %s", entry.File, err.Error()))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.New(fmt.Sprintf("Error writing journal entry for %s: %s", entry.File, err.Error()))
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.New(fmt.Sprintf("Error writing journal entry for %s: %s", entry.File, err.Error()))
+	}
+	if err := os.Rename(tmp.Name(), j.entryPath(entry.File)); err != nil {
+		return errors.New(fmt.Sprintf("Error writing journal entry for %s: %s", entry.File, err.Error()))
+	}
+	return nil
+}
+
+// Get returns the entry of file, if there is a readable one.
+func (j *Journal) Get(file string) (Entry, bool) {
+	if j == nil {
+		return Entry{}, false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	var entry Entry
+	data, err := os.ReadFile(j.entryPath(file))
+	if err != nil || json.Unmarshal(data, &entry) != nil || entry.File != file {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Remove deletes the entry of file.
+func (j *Journal) Remove(file string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := os.Remove(j.entryPath(file)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"caller": "Journal.Remove",
+		}).Warn(fmt.Sprintf("Could not remove journal entry of %s: %s", file, err.Error()))
+	}
+}
+
+// Load returns all entries ordered by file. Unreadable entries are skipped.
+func (j *Journal) Load() ([]Entry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	dirEntries, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read journal directory: %s", err.Error()))
+	}
+	entries := []Entry{}
+	for _, dirEntry := range dirEntries {
+		if !strings.HasSuffix(dirEntry.Name(), entrySuffix) || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+		var entry Entry
+		data, err := os.ReadFile(filepath.Join(j.dir, dirEntry.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"caller": "Journal.Load",
+			}).Warn(fmt.Sprintf("Skipping journal entry %s: %s", dirEntry.Name(), err.Error()))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].File < entries[b].File })
+	return entries, nil
+}
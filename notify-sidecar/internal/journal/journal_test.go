@@ -0,0 +1,83 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+)
+
+func TestSaveLoadRemove(t *testing.T) {
+	j, err := Open(filepath.Join(t.TempDir(), ".journal"))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	entry := &Entry{
+		File:     "/heap-dumps/java_pid1.hprof",
+		Size:     42,
+		ModTime:  time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC),
+		State:    Requested,
+		Payload:  models.Payload{Tenant: "tenant", Namespace: "ns", FileName: "pod-java_pid1.hprof.crypted"},
+		UploadID: "upload-1",
+	}
+	if err := j.Save(entry); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	entry.HeadURL = "https://bucket/pod-java_pid1.hprof.crypted"
+	entry.State = DumpUploaded
+	if err := j.Save(entry); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	entries, err := j.Load()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %v, %v", entries, err)
+	}
+	got := entries[0]
+	got.Updated = entry.Updated
+	if !reflect.DeepEqual(got, *entry) {
+		t.Errorf("got %+v, want %+v", got, *entry)
+	}
+
+	if got, found := j.Get(entry.File); !found || got.State != DumpUploaded {
+		t.Errorf("got %+v (%v)", got, found)
+	}
+	if _, found := j.Get("/heap-dumps/other.hprof"); found {
+		t.Errorf("there is no entry of other.hprof")
+	}
+
+	j.Remove(entry.File)
+	if _, found := j.Get(entry.File); found {
+		t.Errorf("the entry was removed")
+	}
+	if entries, _ := j.Load(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestLoadSkipsBrokenEntries(t *testing.T) {
+	dir := t.TempDir()
+	j, _ := Open(dir)
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600)
+	os.WriteFile(filepath.Join(dir, ".entry-123"), []byte("{}"), 0o600)
+	j.Save(&Entry{File: "/heap-dumps/ok", State: Completed})
+
+	entries, err := j.Load()
+	if err != nil || len(entries) != 1 || entries[0].File != "/heap-dumps/ok" {
+		t.Errorf("got %v, %v", entries, err)
+	}
+}
+
+func TestNilJournal(t *testing.T) {
+	var j *Journal
+	if err := j.Save(&Entry{File: "dump"}); err != nil {
+		t.Errorf("got %v", err)
+	}
+	j.Remove("dump")
+	if entries, err := j.Load(); entries != nil || err != nil {
+		t.Errorf("got %v, %v", entries, err)
+	}
+}
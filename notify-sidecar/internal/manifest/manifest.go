@@ -0,0 +1,106 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Manifest describes an uploaded dump. It is stored unencrypted next to the
+// dump, so engineers can tell where a dump came from without decrypting it.
+type Manifest struct {
+	Pod              Pod       `json:"pod"`
+	FileName         string    `json:"file-name"`
+	Object           string    `json:"object"`
+	ArtifactType     string    `json:"artifact-type"`
+	Compression      string    `json:"compression"`
+	PlaintextSize    int64     `json:"plaintext-size"`
+	CiphertextSize   int64     `json:"ciphertext-size"`
+	SHA256           string    `json:"sha256"`
+	CiphertextSHA256 string    `json:"ciphertext-sha256,omitempty"`
+	DetectedAt       time.Time `json:"detected-at"`
+	SidecarVersion   string    `json:"sidecar-version"`
+}
+
+// Pod identifies the pod and container that wrote the dump.
+type Pod struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Node        string            `json:"node,omitempty"`
+	Container   string            `json:"container,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ReadPod collects what the Downward API exposes about the pod: its name,
+// node and container from the POD_NAME, NODE_NAME and CONTAINER_NAME
+// environment variables and its labels and annotations from the files
+// "labels" and "annotations" in podInfoPath. Missing information is left
+// empty, the namespace is set by the caller.
+func ReadPod(fileSystem fs.FS, podInfoPath string) Pod {
+	pod := Pod{
+		Name:      os.Getenv("POD_NAME"),
+		Node:      os.Getenv("NODE_NAME"),
+		Container: os.Getenv("CONTAINER_NAME"),
+	}
+	pod.Labels = readPodInfoFile(fileSystem, path.Join(podInfoPath, "labels"))
+	pod.Annotations = readPodInfoFile(fileSystem, path.Join(podInfoPath, "annotations"))
+	return pod
+}
+
+func readPodInfoFile(fileSystem fs.FS, file string) map[string]string {
+	data, err := fs.ReadFile(fileSystem, strings.TrimPrefix(file, "/"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "ReadPod",
+		}).Debug(fmt.Sprintf("No pod info in %s: %s", file, err.Error()))
+		return nil
+	}
+	values, err := ParsePodInfo(data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "ReadPod",
+		}).Warn(fmt.Sprintf("Invalid pod info in %s: %s", file, err.Error()))
+	}
+	return values
+}
+
+// ParsePodInfo parses a labels or annotations file of a Downward API
+// volume, which holds one key="value" pair per line with the value quoted
+// like a Go string. Invalid lines are skipped and reported in the error.
+func ParsePodInfo(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	var invalid []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	// annotations may hold large values, e.g. the last applied configuration
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, quoted, found := strings.Cut(line, "=")
+		value, err := strconv.Unquote(quoted)
+		if !found || key == "" || err != nil {
+			invalid = append(invalid, line)
+			continue
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return values, errors.New(fmt.Sprintf("Error reading pod info: %s", err.Error()))
+	}
+	if len(invalid) > 0 {
+		return values, errors.New(fmt.Sprintf("Skipped %d invalid lines: %s", len(invalid), strings.Join(invalid, ", ")))
+	}
+	return values, nil
+}
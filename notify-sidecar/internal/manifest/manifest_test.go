@@ -0,0 +1,54 @@
+package manifest
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParsePodInfo(t *testing.T) {
+	data := []byte("app.kubernetes.io/name=\"java-app\"\n" +
+		"kubectl.kubernetes.io/last-applied-configuration=\"{\\\"kind\\\":\\\"Pod\\\"}\\n\"\n" +
+		"\n" +
+		"empty=\"\"\n")
+	got, err := ParsePodInfo(data)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	want := map[string]string{
+		"app.kubernetes.io/name":                           "java-app",
+		"kubectl.kubernetes.io/last-applied-configuration": "{\"kind\":\"Pod\"}\n",
+		"empty": "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParsePodInfoInvalidLines(t *testing.T) {
+	got, err := ParsePodInfo([]byte("valid=\"yes\"\nunquoted=value\nno-separator\n=\"no key\"\n"))
+	if err == nil {
+		t.Errorf("invalid lines have to be reported")
+	}
+	if !reflect.DeepEqual(got, map[string]string{"valid": "yes"}) {
+		t.Errorf("valid lines have to be kept, got %v", got)
+	}
+}
+
+func TestReadPod(t *testing.T) {
+	t.Setenv("POD_NAME", "java-app-7d9f")
+	t.Setenv("NODE_NAME", "node-1")
+	t.Setenv("CONTAINER_NAME", "java-app")
+	fileSystem := fstest.MapFS{
+		"etc/podinfo/labels": {Data: []byte("app=\"java-app\"\n")},
+	}
+	want := Pod{
+		Name:      "java-app-7d9f",
+		Node:      "node-1",
+		Container: "java-app",
+		Labels:    map[string]string{"app": "java-app"},
+	}
+	if got := ReadPod(fileSystem, "/etc/podinfo"); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
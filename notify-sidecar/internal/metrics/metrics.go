@@ -28,16 +28,111 @@ var FailedDumps = prometheus.NewCounterVec(
 	[]string{"tenant"},
 )
 
+var UploadedBytes = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name:      "uploaded_bytes",
+		Namespace: "heap_dump_service",
+		Help:      "Number of bytes uploaded to S3",
+	},
+)
+
+var FileTransitions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "file_state_transitions",
+		Namespace: "heap_dump_service",
+		Help:      "Number of files that entered a state of the watcher lifecycle",
+	},
+	[]string{"tenant", "state"},
+)
+
+var TrackedFiles = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name:      "tracked_files",
+		Namespace: "heap_dump_service",
+		Help:      "Number of files currently tracked by the watcher, by state",
+	},
+	[]string{"tenant", "state"},
+)
+
+var QuarantinedFiles = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "quarantined_files",
+		Namespace: "heap_dump_service",
+		Help:      "Number of files moved to the quarantine directory",
+	},
+	[]string{"tenant"},
+)
+
+var OversizedFiles = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "oversized_files",
+		Namespace: "heap_dump_service",
+		Help:      "Number of files left in the watch path as they exceed the quarantine size limit",
+	},
+	[]string{"tenant"},
+)
+
+var FailedUploads = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "failed_uploads",
+		Namespace: "heap_dump_service",
+		Help:      "Number of uploads that failed after all retries, by failure class",
+	},
+	[]string{"tenant", "class"},
+)
+
+var QueuedUploads = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name:      "queued_uploads",
+		Namespace: "heap_dump_service",
+		Help:      "Number of stable heap dumps waiting for an upload worker",
+	},
+	[]string{"tenant"},
+)
+
+var ActiveUploads = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name:      "active_uploads",
+		Namespace: "heap_dump_service",
+		Help:      "Number of heap dumps being uploaded",
+	},
+	[]string{"tenant"},
+)
+
+var ValidatedDumps = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:      "validated_heap_dumps",
+		Namespace: "heap_dump_service",
+		Help:      "Number of hprof heap dumps checked before the upload, by verdict",
+	},
+	[]string{"tenant", "status"},
+)
+
 func init() {
 	prometheus.MustRegister(HeapDumpHandled)
 	prometheus.MustRegister(FailedDumps)
+	prometheus.MustRegister(UploadedBytes)
+	prometheus.MustRegister(FileTransitions)
+	prometheus.MustRegister(TrackedFiles)
+	prometheus.MustRegister(QuarantinedFiles)
+	prometheus.MustRegister(OversizedFiles)
+	prometheus.MustRegister(FailedUploads)
+	prometheus.MustRegister(QueuedUploads)
+	prometheus.MustRegister(ActiveUploads)
+	prometheus.MustRegister(ValidatedDumps)
 }
 
-func StartMetricServer(port int, path string) {
+// NewMetricServer registers the metrics handler and returns a server for
+// all handlers of the default mux, so it can be shut down gracefully.
+func NewMetricServer(port int, path string) *http.Server {
 	http.Handle(path, promhttp.Handler())
-	hostAddress := fmt.Sprintf(":%v", port)
+	return &http.Server{Addr: fmt.Sprintf(":%v", port)}
+}
+
+func StartMetricServer(port int, path string) {
+	server := NewMetricServer(port, path)
 	log.WithFields(log.Fields{
 		"caller": "StartMetricServer",
 	}).Info("Serving Metrics")
-	http.ListenAndServe(hostAddress, nil)
+	server.ListenAndServe()
 }
@@ -1,14 +1,81 @@
 package models
 
 type Payload struct {
+	Tenant       string      `json:"tenant"`
+	Namespace    string      `json:"namespace"`
+	FileName     string      `json:"filename"`
+	ArtifactType string      `json:"artifact-type,omitempty"`
+	Size         int64       `json:"size,omitempty"`
+	Validation   *Validation `json:"validation,omitempty"`
+}
+
+// SigningRequest is sent for upload URLs. Dumps encrypted with a key from
+// KeyResponse pass it back along with their checksums, which are signed
+// into the URLs. Only the payload identifies the upload later on.
+type SigningRequest struct {
+	Payload
+	EncryptedAesKey string   `json:"encrypted-aes-key,omitempty"`
+	ChecksumSHA256  string   `json:"checksum-sha256,omitempty"`
+	PartChecksums   []string `json:"part-checksums,omitempty"`
+}
+
+type KeyRequest struct {
 	Tenant    string `json:"tenant"`
 	Namespace string `json:"namespace"`
-	FileName  string `json:"filename"`
+	Size      int64  `json:"size,omitempty"`
 }
 
-type SigningResponse struct {
-	URL                string `json:"url"`
-	EncryptedAesKey    string `json:"encrypted-aes-key"`
-	EncryptedAesKeyURL string `json:"encrypted-aes-key-url"`
+// KeyResponse holds the key to encrypt a dump with before requesting its
+// upload URLs, or the public key to wrap a key of our own with if the heap
+// dump service does not hand out keys. PartSize is set if the dump is
+// uploaded in parts.
+type KeyResponse struct {
 	AesKey             string `json:"aes-key"`
+	EncryptedAesKey    string `json:"encrypted-aes-key"`
+	WrappingKey        string `json:"wrapping-key,omitempty"`
+	WrappingKeyVersion int    `json:"wrapping-key-version,omitempty"`
+	PartSize           int64  `json:"part-size,omitempty"`
+}
+
+// Validation is the verdict of the hprof validator.
+type Validation struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type SigningResponse struct {
+	URL                string   `json:"url"`
+	EncryptedAesKey    string   `json:"encrypted-aes-key"`
+	EncryptedAesKeyURL string   `json:"encrypted-aes-key-url"`
+	AesKey             string   `json:"aes-key"`
+	UploadID           string   `json:"upload-id,omitempty"`
+	PartSize           int64    `json:"part-size,omitempty"`
+	PartURLs           []string `json:"part-urls,omitempty"`
+	// Headers have to be sent along with the upload to URL, they are part
+	// of its signature.
+	Headers map[string]string `json:"headers,omitempty"`
+	// ManifestURL takes the manifest describing the dump, it is empty if
+	// the heap dump service does not store manifests.
+	ManifestURL string `json:"manifest-url,omitempty"`
+	// PartHeaders have to be sent along with the upload to the part URL at
+	// the same index.
+	PartHeaders []map[string]string `json:"part-headers,omitempty"`
+	// HeadURL tells whether the dump is stored, it is empty if the heap
+	// dump service does not hand it out.
+	HeadURL string `json:"head-url,omitempty"`
+}
+
+type CompletedPart struct {
+	PartNumber     int64  `json:"part-number"`
+	ETag           string `json:"etag"`
+	ChecksumSHA256 string `json:"checksum-sha256,omitempty"`
+}
+
+type MultipartRequest struct {
+	Tenant       string          `json:"tenant"`
+	Namespace    string          `json:"namespace"`
+	FileName     string          `json:"filename"`
+	ArtifactType string          `json:"artifact-type,omitempty"`
+	UploadID     string          `json:"upload-id"`
+	Parts        []CompletedPart `json:"parts,omitempty"`
 }
@@ -0,0 +1,66 @@
+package quarantine
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type retryResponse struct {
+	File       string `json:"file"`
+	RestoredTo string `json:"restored-to"`
+}
+
+// ListHandler serves the reasons of all quarantined files.
+func (q *Quarantine) ListHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "Only GET is allowed"})
+			return
+		}
+		entries, err := q.List()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+}
+
+// RetryHandler restores the quarantined file given in the file query
+// parameter, e.g. POST /quarantine/retry?file=java_pid1.hprof
+// Requests have to send the token as "Authorization: Bearer <token>". Without
+// a token retrying is disabled, the metrics port is not protected otherwise.
+func (q *Quarantine) RetryHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "Only POST is allowed"})
+			return
+		}
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, errorResponse{Error: "Retrying is disabled, no retry token is configured"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Error: "Missing or wrong retry token"})
+			return
+		}
+		name := r.URL.Query().Get("file")
+		restored, err := q.Retry(name)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, retryResponse{File: name, RestoredTo: restored})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
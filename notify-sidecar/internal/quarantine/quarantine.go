@@ -0,0 +1,251 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+)
+
+const (
+	reasonSuffix    = ".reason.json"
+	defaultMaxAge   = 24 * time.Hour
+	defaultMaxBytes = 5 * 1024 * 1024 * 1024
+)
+
+// ErrTooLarge is returned by Add for a file larger than the quarantine may
+// hold, the file is left where it is.
+var ErrTooLarge = errors.New("larger than the quarantine")
+
+// Reason is stored next to every quarantined file.
+type Reason struct {
+	File          string    `json:"file"`
+	OriginalPath  string    `json:"original-path"`
+	Reason        string    `json:"reason"`
+	Error         string    `json:"error,omitempty"`
+	Size          int64     `json:"size"`
+	QuarantinedAt time.Time `json:"quarantined-at"`
+}
+
+// Quarantine keeps files the sidecar could not handle instead of deleting
+// them. Files older than maxAge are removed, as are the oldest files to
+// make room for a new one once the quarantine would hold more than
+// maxBytes. A file is never removed to make room for itself, a file larger
+// than maxBytes is not quarantined at all. A maxBytes of 0 uses a default
+// of 5 GiB, the quarantine is never unlimited.
+type Quarantine struct {
+	dir      string
+	tenant   string
+	maxBytes int64
+	maxAge   time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+}
+
+func New(dir string, tenant string, maxBytes int64, maxAge time.Duration) (*Quarantine, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not create quarantine directory %s: %s", dir, err.Error()))
+	}
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	return &Quarantine{
+		dir:      dir,
+		tenant:   tenant,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		now:      time.Now,
+	}, nil
+}
+
+// Add moves file into the quarantine and records why. Older files are
+// removed first if the quarantine has no room for it, a file that does
+// not fit at all is left in place and ErrTooLarge returned.
+func (q *Quarantine) Add(file string, reason string, cause error) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not quarantine %s: %s", file, err.Error()))
+	}
+	if info.Size() > q.maxBytes {
+		return fmt.Errorf("Could not quarantine %s: %w, %d bytes exceed the limit of %d bytes", file, ErrTooLarge, info.Size(), q.maxBytes)
+	}
+	q.prune(info.Size())
+	name := filepath.Base(file)
+	if _, err := os.Stat(filepath.Join(q.dir, name)); err == nil {
+		name = fmt.Sprintf("%s-%d", name, q.now().UnixNano())
+	}
+	if err := moveFile(file, filepath.Join(q.dir, name)); err != nil {
+		return errors.New(fmt.Sprintf("Could not quarantine %s: %s", file, err.Error()))
+	}
+
+	entry := Reason{
+		File:          name,
+		OriginalPath:  file,
+		Reason:        reason,
+		Size:          info.Size(),
+		QuarantinedAt: q.now().UTC(),
+	}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	data, _ := json.MarshalIndent(entry, "", "  ")
+	if err := os.WriteFile(filepath.Join(q.dir, name+reasonSuffix), data, 0o600); err != nil {
+		return errors.New(fmt.Sprintf("Could not write quarantine reason for %s: %s", file, err.Error()))
+	}
+
+	log.WithFields(log.Fields{
+		"caller": "Quarantine.Add",
+	}).Warn(fmt.Sprintf("Quarantined %s: %s", file, reason))
+	metrics.QuarantinedFiles.WithLabelValues(q.tenant).Inc()
+	return nil
+}
+
+// List returns all quarantined files, oldest first.
+func (q *Quarantine) List() ([]Reason, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.list()
+}
+
+// Retry moves a quarantined file back to where it was found, so the
+// watcher picks it up again. It returns the restored path.
+func (q *Quarantine) Retry(name string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if name == "" || name != filepath.Base(name) || strings.HasSuffix(name, reasonSuffix) {
+		return "", errors.New(fmt.Sprintf("Invalid quarantined file name: %s", name))
+	}
+	entry, err := q.readReason(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(entry.OriginalPath); err == nil {
+		return "", errors.New(fmt.Sprintf("Can not restore %s: %s exists", name, entry.OriginalPath))
+	}
+	if err := moveFile(filepath.Join(q.dir, name), entry.OriginalPath); err != nil {
+		return "", errors.New(fmt.Sprintf("Could not restore %s: %s", name, err.Error()))
+	}
+	os.Remove(filepath.Join(q.dir, name+reasonSuffix))
+
+	log.WithFields(log.Fields{
+		"caller": "Quarantine.Retry",
+	}).Info(fmt.Sprintf("Restored %s to %s for another attempt", name, entry.OriginalPath))
+	return entry.OriginalPath, nil
+}
+
+// Prune enforces the age and size limits.
+func (q *Quarantine) Prune() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(0)
+}
+
+// prune removes expired files and the oldest files until incoming more
+// bytes fit. The newest file is only removed once it expired, even if the
+// limit was lowered since it was quarantined.
+func (q *Quarantine) prune(incoming int64) {
+	entries, err := q.list()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"caller": "Quarantine.Prune",
+		}).Error(err.Error())
+		return
+	}
+	total := incoming
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	for i, entry := range entries {
+		expired := q.now().Sub(entry.QuarantinedAt) > q.maxAge
+		full := total > q.maxBytes && (incoming > 0 || i < len(entries)-1)
+		if !expired && !full {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"caller": "Quarantine.Prune",
+		}).Info(fmt.Sprintf("Deleting quarantined file %s (%d bytes, quarantined at %v)", entry.File, entry.Size, entry.QuarantinedAt))
+		os.Remove(filepath.Join(q.dir, entry.File))
+		os.Remove(filepath.Join(q.dir, entry.File+reasonSuffix))
+		total -= entry.Size
+	}
+}
+
+func (q *Quarantine) list() ([]Reason, error) {
+	dirEntries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read quarantine directory: %s", err.Error()))
+	}
+	entries := []Reason{}
+	for _, dirEntry := range dirEntries {
+		if !strings.HasSuffix(dirEntry.Name(), reasonSuffix) {
+			continue
+		}
+		entry, err := q.readReason(strings.TrimSuffix(dirEntry.Name(), reasonSuffix))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"caller": "Quarantine.List",
+			}).Warn(err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].QuarantinedAt.Before(entries[j].QuarantinedAt) })
+	return entries, nil
+}
+
+func (q *Quarantine) readReason(name string) (Reason, error) {
+	var entry Reason
+	data, err := os.ReadFile(filepath.Join(q.dir, name+reasonSuffix))
+	if err != nil {
+		return entry, errors.New(fmt.Sprintf("Unknown quarantined file %s: %s", name, err.Error()))
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, errors.New(fmt.Sprintf("Invalid quarantine reason for %s: %s", name, err.Error()))
+	}
+	return entry, nil
+}
+
+// moveFile renames src to dst and falls back to copying if they are on
+// different file systems.
+func moveFile(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,185 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestQuarantine(t *testing.T, maxBytes int64, maxAge time.Duration) (*Quarantine, string) {
+	t.Helper()
+	watchDir := t.TempDir()
+	q, err := New(filepath.Join(watchDir, ".quarantine"), "test", maxBytes, maxAge)
+	if err != nil {
+		t.Fatalf("Failed to create quarantine: %v", err)
+	}
+	return q, watchDir
+}
+
+func writeFile(t *testing.T, dir string, name string, size int) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAddAndRetry(t *testing.T) {
+	q, watchDir := newTestQuarantine(t, 0, 0)
+	file := writeFile(t, watchDir, "java_pid1.hprof", 10)
+
+	if err := q.Add(file, "upload failed", errors.New("403 Forbidden")); err != nil {
+		t.Fatalf("Failed to quarantine: %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("quarantined file must be moved out of the watch path")
+	}
+	entries, err := q.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %v, %v", entries, err)
+	}
+	want := Reason{File: "java_pid1.hprof", OriginalPath: file, Reason: "upload failed", Error: "403 Forbidden", Size: 10}
+	got := entries[0]
+	got.QuarantinedAt = time.Time{}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	restored, err := q.Retry("java_pid1.hprof")
+	if err != nil || restored != file {
+		t.Fatalf("got %s, %v", restored, err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("retried file must be back in the watch path: %v", err)
+	}
+	if entries, _ := q.List(); len(entries) != 0 {
+		t.Errorf("got %v", entries)
+	}
+}
+
+func TestRetryRejectsPaths(t *testing.T) {
+	q, _ := newTestQuarantine(t, 0, 0)
+	for _, name := range []string{"", "../etc/passwd", "dump.reason.json", "unknown"} {
+		if _, err := q.Retry(name); err == nil {
+			t.Errorf("retrying %q must fail", name)
+		}
+	}
+}
+
+func TestDuplicateNames(t *testing.T) {
+	q, watchDir := newTestQuarantine(t, 0, 0)
+	q.Add(writeFile(t, watchDir, "dump", 1), "no rule matched", nil)
+	q.Add(writeFile(t, watchDir, "dump", 2), "no rule matched", nil)
+	entries, _ := q.List()
+	if len(entries) != 2 || entries[0].File == entries[1].File {
+		t.Errorf("both files must be kept, got %+v", entries)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	q, watchDir := newTestQuarantine(t, 25, time.Hour)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	q.now = func() time.Time { return now }
+
+	q.Add(writeFile(t, watchDir, "old", 10), "no rule matched", nil)
+	now = now.Add(2 * time.Hour)
+	q.Add(writeFile(t, watchDir, "a", 10), "no rule matched", nil)
+	now = now.Add(time.Minute)
+	q.Add(writeFile(t, watchDir, "b", 10), "no rule matched", nil)
+	now = now.Add(time.Minute)
+	// exceeds the size limit, so the oldest remaining file has to go
+	q.Add(writeFile(t, watchDir, "c", 10), "no rule matched", nil)
+
+	entries, _ := q.List()
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.File)
+	}
+	if len(names) != 2 || names[0] != "b" || names[1] != "c" {
+		t.Errorf("got %v, want [b c]", names)
+	}
+}
+
+func TestAddTooLarge(t *testing.T) {
+	q, watchDir := newTestQuarantine(t, 25, time.Hour)
+	q.Add(writeFile(t, watchDir, "a", 10), "no rule matched", nil)
+	file := writeFile(t, watchDir, "huge", 30)
+
+	if err := q.Add(file, "upload failed", nil); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, want ErrTooLarge", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("a file too large for the quarantine must be left in place: %v", err)
+	}
+	if entries, _ := q.List(); len(entries) != 1 || entries[0].File != "a" {
+		t.Errorf("no room must be made for a file that does not fit, got %+v", entries)
+	}
+
+	// a file that fits on its own replaces the older ones
+	q.Add(writeFile(t, watchDir, "b", 25), "upload failed", nil)
+	if entries, _ := q.List(); len(entries) != 1 || entries[0].File != "b" {
+		t.Errorf("got %+v, want [b]", entries)
+	}
+	q.maxBytes = 10
+	q.Prune()
+	if entries, _ := q.List(); len(entries) != 1 {
+		t.Errorf("the newest file must be kept until it expires, got %+v", entries)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	q, watchDir := newTestQuarantine(t, 0, 0)
+	q.Add(writeFile(t, watchDir, "java_pid1.hprof", 10), "upload failed", nil)
+
+	rec := httptest.NewRecorder()
+	q.ListHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quarantine", nil))
+	var entries []Reason
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || rec.Code != http.StatusOK || len(entries) != 1 {
+		t.Fatalf("got %d %s", rec.Code, rec.Body.String())
+	}
+
+	retry := func(method string, auth string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/quarantine/retry?file=java_pid1.hprof", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		q.RetryHandler("secret").ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := retry(http.MethodGet, "Bearer secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("got %d", rec.Code)
+	}
+	if rec := retry(http.MethodPost, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("retrying without a token must fail, got %d", rec.Code)
+	}
+	if rec := retry(http.MethodPost, "Bearer wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("retrying with a wrong token must fail, got %d", rec.Code)
+	}
+	if rec := retry(http.MethodPost, "Bearer secret"); rec.Code != http.StatusOK {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := retry(http.MethodPost, "Bearer secret"); rec.Code != http.StatusBadRequest {
+		t.Errorf("retrying twice must fail, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	q.RetryHandler("").ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/quarantine/retry?file=java_pid1.hprof", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("retrying must be disabled without a configured token, got %d", rec.Code)
+	}
+}
+
+func TestDefaultMaxBytes(t *testing.T) {
+	q, _ := newTestQuarantine(t, 0, 0)
+	if q.maxBytes != defaultMaxBytes {
+		t.Errorf("got %d, want the default limit of %d", q.maxBytes, defaultMaxBytes)
+	}
+}
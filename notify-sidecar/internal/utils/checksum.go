@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// checksumHeader carries the base64 encoded SHA-256 S3 verifies an upload
+// against.
+const checksumHeader = "X-Amz-Checksum-Sha256"
+
+// Checksums are the SHA-256 checksums of an envelope as a whole and of
+// every part it is uploaded in. PlainSHA256 is the checksum of the
+// plaintext the envelope was sealed from.
+type Checksums struct {
+	SHA256      []byte
+	Parts       [][]byte
+	PlainSHA256 []byte
+}
+
+// Checksums encrypts the whole envelope once to compute its checksums. They
+// have to be known before the upload URLs are requested, as S3 verifies the
+// upload against them, so this pass can not be folded into the upload. The
+// plaintext is hashed along the way, no other pass over it is needed. A
+// partSize of 0 computes no part checksums. The chunks are sealed on the
+// workers of the envelope like for the upload.
+func (e *Envelope) Checksums(partSize int64) (Checksums, error) {
+	var checksums Checksums
+	size := e.Size()
+	whole := sha256.New()
+	// chunks cut by a part boundary are sealed for both parts, they are
+	// hashed once
+	plain := sha256.New()
+	hashed := int64(0)
+	onChunk := func(index int64, chunk []byte) {
+		if index == hashed {
+			plain.Write(chunk)
+			hashed++
+		}
+	}
+	inParts := partSize > 0
+	if !inParts {
+		partSize = size
+	}
+
+	part := sha256.New()
+	for offset := int64(0); offset < size; offset += partSize {
+		part.Reset()
+		length := min(partSize, size-offset)
+		if err := copySection(io.MultiWriter(whole, part), e.newSectionReader(offset, length, onChunk)); err != nil {
+			if !inParts {
+				return checksums, fmt.Errorf("Error computing checksum: %w", err)
+			}
+			return checksums, fmt.Errorf("Error computing checksum of part %d: %w", len(checksums.Parts)+1, err)
+		}
+		if inParts {
+			checksums.Parts = append(checksums.Parts, part.Sum(nil))
+		}
+	}
+	if hashed != e.chunks {
+		return checksums, errors.New(fmt.Sprintf("Error computing checksum: hashed %d of %d chunks", hashed, e.chunks))
+	}
+	checksums.SHA256 = whole.Sum(nil)
+	checksums.PlainSHA256 = plain.Sum(nil)
+	return checksums, nil
+}
+
+// copySection copies a section to dst and stops its pipeline, even if dst
+// fails.
+func copySection(dst io.Writer, section *envelopeSectionReader) error {
+	defer section.Close()
+	_, err := io.Copy(dst, section)
+	return err
+}
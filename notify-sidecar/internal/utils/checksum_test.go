@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func TestEnvelopeChecksums(t *testing.T) {
+	plainText := make([]byte, 3*chunkSize+123)
+	rand.Read(plainText)
+	envelope, _ := NewEnvelope(bytes.NewReader(plainText), int64(len(plainText)), envelopeTestKey, CompressionNone)
+	whole, _ := io.ReadAll(envelope.NewSectionReader(0, envelope.Size()))
+	wholeSum := sha256.Sum256(whole)
+
+	checksums, err := envelope.Checksums(0)
+	if err != nil {
+		t.Fatalf("Failed to compute checksums: %v", err)
+	}
+	if !bytes.Equal(checksums.SHA256, wholeSum[:]) || checksums.Parts != nil {
+		t.Errorf("got %x with parts %x, want %x without parts", checksums.SHA256, checksums.Parts, wholeSum)
+	}
+	plainSum := sha256.Sum256(plainText)
+	if !bytes.Equal(checksums.PlainSHA256, plainSum[:]) {
+		t.Errorf("got plaintext checksum %x, want %x", checksums.PlainSHA256, plainSum)
+	}
+
+	partSize := int64(chunkSize + 7)
+	checksums, err = envelope.Checksums(partSize)
+	if err != nil {
+		t.Fatalf("Failed to compute checksums: %v", err)
+	}
+	if !bytes.Equal(checksums.SHA256, wholeSum[:]) {
+		t.Errorf("checksum of the whole envelope differs when computed in parts")
+	}
+	// chunks cut by a part boundary must be hashed once
+	if !bytes.Equal(checksums.PlainSHA256, plainSum[:]) {
+		t.Errorf("plaintext checksum differs when computed in parts")
+	}
+	if len(checksums.Parts) != 4 {
+		t.Fatalf("got %d part checksums, want 4", len(checksums.Parts))
+	}
+	for i, sum := range checksums.Parts {
+		end := min(int64(i+1)*partSize, int64(len(whole)))
+		want := sha256.Sum256(whole[int64(i)*partSize : end])
+		if !bytes.Equal(sum, want[:]) {
+			t.Errorf("part %d: got %x, want %x", i+1, sum, want)
+		}
+	}
+
+	// a part size beyond the envelope is still a single part
+	checksums, err = envelope.Checksums(2 * envelope.Size())
+	if err != nil || len(checksums.Parts) != 1 || !bytes.Equal(checksums.Parts[0], wholeSum[:]) {
+		t.Errorf("got %x, %v, want a single part", checksums.Parts, err)
+	}
+}
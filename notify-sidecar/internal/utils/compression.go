@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression applied to a dump before it is encrypted. The value is stored
+// in the flags byte of the envelope header, so the companion knows how to
+// decompress the dump.
+type Compression byte
+
+const (
+	CompressionNone Compression = 0
+	CompressionGzip Compression = 1
+	CompressionZstd Compression = 2
+)
+
+// ParseCompression maps the name used in the config file to a Compression.
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	}
+	return CompressionNone, errors.New(fmt.Sprintf("Unknown compression \"%s\"", name))
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// Compress writes src to dst compressed with compression. A level of 0
+// uses the default level of the algorithm, gzip levels range from 1 to 9
+// and zstd levels from 1 to 22.
+func Compress(dst io.Writer, src io.Reader, compression Compression, level int) error {
+	var w io.WriteCloser
+	switch compression {
+	case CompressionNone:
+		if _, err := io.Copy(dst, src); err != nil {
+			return errors.New(fmt.Sprintf("Error copying heap dump: %s", err.Error()))
+		}
+		return nil
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(dst, level)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error initializing gzip compression: %s", err.Error()))
+		}
+		w = gz
+	case CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(encoderLevel))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error initializing zstd compression: %s", err.Error()))
+		}
+		w = enc
+	default:
+		return errors.New(fmt.Sprintf("Unsupported compression %s", compression))
+	}
+
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return errors.New(fmt.Sprintf("Error compressing heap dump: %s", err.Error()))
+	}
+	if err := w.Close(); err != nil {
+		return errors.New(fmt.Sprintf("Error compressing heap dump: %s", err.Error()))
+	}
+	return nil
+}
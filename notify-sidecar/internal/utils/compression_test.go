@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompress(t *testing.T, data []byte, compression Compression) []byte {
+	t.Helper()
+	var r io.Reader
+	switch compression {
+	case CompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Invalid gzip stream: %v", err)
+		}
+		r = gz
+	case CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Invalid zstd stream: %v", err)
+		}
+		defer dec.Close()
+		r = dec
+	default:
+		r = bytes.NewReader(data)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to decompress: %v", err)
+	}
+	return plain
+}
+
+func TestCompress(t *testing.T) {
+	plainText := []byte(strings.Repeat("JAVA PROFILE 1.0.2", 10000))
+	for _, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		for _, level := range []int{0, 1, 9} {
+			var out bytes.Buffer
+			if err := Compress(&out, bytes.NewReader(plainText), compression, level); err != nil {
+				t.Fatalf("%s level %d: %v", compression, level, err)
+			}
+			if compression != CompressionNone && out.Len() >= len(plainText) {
+				t.Errorf("%s level %d: %d bytes are not smaller than %d", compression, level, out.Len(), len(plainText))
+			}
+			if !bytes.Equal(decompress(t, out.Bytes(), compression), plainText) {
+				t.Errorf("%s level %d: round trip does not match", compression, level)
+			}
+		}
+	}
+}
+
+func TestCompressEmpty(t *testing.T) {
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		var out bytes.Buffer
+		if err := Compress(&out, bytes.NewReader(nil), compression, 0); err != nil {
+			t.Fatalf("%s: %v", compression, err)
+		}
+		if got := decompress(t, out.Bytes(), compression); len(got) != 0 {
+			t.Errorf("%s: got %d bytes, want none", compression, len(got))
+		}
+	}
+}
+
+func TestCompressInvalid(t *testing.T) {
+	var out bytes.Buffer
+	if err := Compress(&out, bytes.NewReader(nil), CompressionGzip, 42); err == nil {
+		t.Errorf("gzip level 42 must be rejected")
+	}
+	if err := Compress(&out, bytes.NewReader(nil), Compression(7), 0); err == nil || err.Error() != "Unsupported compression compression(7)" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for name, want := range map[string]Compression{"": CompressionNone, "none": CompressionNone, "gzip": CompressionGzip, "zstd": CompressionZstd} {
+		got, err := ParseCompression(name)
+		if err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseCompression("lz4"); err == nil {
+		t.Errorf("lz4 must be rejected")
+	}
+}
+
+func TestEnvelopeRecordsCompression(t *testing.T) {
+	envelope, err := NewEnvelope(bytes.NewReader(nil), 0, envelopeTestKey, CompressionZstd)
+	if err != nil {
+		t.Fatalf("Failed to create envelope: %v", err)
+	}
+	header, _ := io.ReadAll(envelope.NewSectionReader(0, envelopeHeaderSize))
+	if header[8] != envelopeVersionCompressed || header[10] != byte(CompressionZstd) {
+		t.Errorf("version %d with flags %d, want version %d with %d", header[8], header[10], envelopeVersionCompressed, CompressionZstd)
+	}
+
+	envelope, _ = NewEnvelope(bytes.NewReader(nil), 0, envelopeTestKey, CompressionNone)
+	header, _ = io.ReadAll(envelope.NewSectionReader(0, envelopeHeaderSize))
+	if header[8] != envelopeVersion || header[10] != 0 {
+		t.Errorf("uncompressed dumps have to stay version %d without flags, got version %d with %d", envelopeVersion, header[8], header[10])
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,8 +11,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/artifact"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/config"
 	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
 )
@@ -24,58 +28,195 @@ func constructBearerAuth(fileSystem fs.FS, tokenLocation string) (string, error)
 	return fmt.Sprintf("Bearer %s", string(sAToken)), nil
 }
 
-func constructRequestBody(fileName string, tenant string, namespace string, podName string) (*bytes.Reader, error) {
+// maxUploadNameLength is the longest file name the heap dump service
+// accepts.
+const maxUploadNameLength = 255
+
+var invalidNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func constructPayload(fileName string, tenant string, namespace string, podName string, artifactType string, size int64) models.Payload {
 	t := time.Now()
-	data := models.Payload{
-		Tenant:    tenant,
-		Namespace: namespace,
-		FileName:  fmt.Sprintf("%s-%s-%s.hprof.crypted", podName, fileName, t.Format("2006-01-02-15-04-05")),
+	return models.Payload{
+		Tenant:       tenant,
+		Namespace:    namespace,
+		FileName:     uploadName(podName, fileName, t, artifactType),
+		ArtifactType: artifactType,
+		Size:         size,
 	}
+}
 
+// uploadName names the uploaded dump <pod>-<file>-<timestamp><extension>.crypted.
+// The heap dump service only accepts names of at most 255 letters, digits,
+// '.', '_' and '-' starting with a letter or digit, so any other character
+// is replaced with '_' and the pod and file name are shortened if need be.
+func uploadName(podName string, fileName string, t time.Time, artifactType string) string {
+	suffix := fmt.Sprintf("-%s%s.crypted", t.Format("2006-01-02-15-04-05"), artifact.Extension(artifactType))
+	name := invalidNameCharacters.ReplaceAllString(fmt.Sprintf("%s-%s", podName, fileName), "_")
+	name = strings.TrimLeft(name, "._-")
+	if name == "" {
+		name = "dump"
+	}
+	if len(name) > maxUploadNameLength-len(suffix) {
+		name = name[:maxUploadNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+func constructRequestBody(data interface{}) (*bytes.Reader, error) {
 	payloadBytes, err := json.Marshal(data)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error creating middleware request body: %s", err.Error()))
 	}
 	return bytes.NewReader(payloadBytes), nil
+}
 
+// postToMiddleware sends data to the heap dump service and decodes the reply
+// into target.
+func postToMiddleware(bearer string, endpoint string, data interface{}, target interface{}) error {
+	body, err := constructRequestBody(data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", endpoint, body)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error creating request to middleware: %s", err.Error()))
+	}
+	req.Header.Add("Authorization", bearer)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return networkError(fmt.Sprintf("Error sending request to middleware: %s", err.Error()))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return statusError(resp.StatusCode, fmt.Sprintf("Middleware replied with error code: %d: %s", resp.StatusCode, b))
+	}
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
 }
 
-func RequestUploadConfig(fileSystem fs.FS, cfg config.AppConfig, fileName string, target interface{}) error {
+// DumpInfo describes the dump upload URLs are requested for. Dumps
+// encrypted with a key from RequestKey carry its encrypted form and their
+// checksums.
+type DumpInfo struct {
+	File            string
+	ArtifactType    string
+	EncryptedSize   int64
+	Validation      *models.Validation
+	EncryptedAesKey string
+	Checksums       *Checksums
+}
 
+// RequestKey requests the key to encrypt a dump of encryptedSize bytes
+// with. Heap dump services that do not issue keys up front reply with 404.
+func RequestKey(fileSystem fs.FS, cfg config.AppConfig, encryptedSize int64) (models.KeyResponse, error) {
+	var response models.KeyResponse
 	bearer, err := constructBearerAuth(fileSystem, "var/run/secrets/kubernetes.io/serviceaccount/token")
 	if err != nil {
-		return err
+		return response, err
 	}
-
 	ns, err := GetCurrentNamespace(fileSystem)
+	if err != nil {
+		return response, err
+	}
+	request := models.KeyRequest{
+		Tenant:    cfg.ServiceOwner.Tenant,
+		Namespace: ns,
+		Size:      encryptedSize,
+	}
+	err = postToMiddleware(bearer, uploadEndpoint(cfg, "key"), request, &response)
+	return response, err
+}
 
-	CheckError(err)
-
+// RequestUploadConfig requests upload URLs and the encryption key for a
+// dump. It returns the payload that was sent, which identifies the upload
+// in follow-up requests.
+func RequestUploadConfig(fileSystem fs.FS, cfg config.AppConfig, dump DumpInfo, target *models.SigningResponse) (models.Payload, error) {
+	bearer, err := constructBearerAuth(fileSystem, "var/run/secrets/kubernetes.io/serviceaccount/token")
+	if err != nil {
+		return models.Payload{}, err
+	}
+	ns, err := GetCurrentNamespace(fileSystem)
+	if err != nil {
+		return models.Payload{}, err
+	}
 	podName := os.Getenv("POD_NAME")
+	payload := constructPayload(filepath.Base(dump.File), cfg.ServiceOwner.Tenant, ns, podName, dump.ArtifactType, dump.EncryptedSize)
+	payload.Validation = dump.Validation
+	request := models.SigningRequest{
+		Payload:         payload,
+		EncryptedAesKey: dump.EncryptedAesKey,
+	}
+	if dump.Checksums != nil {
+		request.ChecksumSHA256 = base64.StdEncoding.EncodeToString(dump.Checksums.SHA256)
+		for _, part := range dump.Checksums.Parts {
+			request.PartChecksums = append(request.PartChecksums, base64.StdEncoding.EncodeToString(part))
+		}
+	}
+	return payload, postToMiddleware(bearer, cfg.Middleware.Endpoint, request, target)
+}
 
-	body, err := constructRequestBody(filepath.Base(fileName), cfg.ServiceOwner.Tenant, ns, podName)
+func uploadEndpoint(cfg config.AppConfig, action string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(cfg.Middleware.Endpoint, "/"), action)
+}
+
+// RequestKeyURLs requests new URLs for the key and the manifest of a dump
+// that is stored already, after the first ones expired. The encrypted key
+// is passed back, so no new key is issued, and without a size no multipart
+// upload is created. The object name only depends on the payload.
+func RequestKeyURLs(fileSystem fs.FS, cfg config.AppConfig, payload models.Payload, encryptedAesKey string, target *models.SigningResponse) error {
+	bearer, err := constructBearerAuth(fileSystem, "var/run/secrets/kubernetes.io/serviceaccount/token")
 	if err != nil {
 		return err
 	}
+	payload.Size = 0
+	request := models.SigningRequest{
+		Payload:         payload,
+		EncryptedAesKey: encryptedAesKey,
+	}
+	return postToMiddleware(bearer, cfg.Middleware.Endpoint, request, target)
+}
 
-	req, err := http.NewRequest("POST", cfg.Middleware.Endpoint, body)
-	req.Header.Add("Authorization", bearer)
+// CompleteMultipartUpload reports the uploaded parts to the heap dump service
+// which assembles them into the final object.
+func CompleteMultipartUpload(fileSystem fs.FS, cfg config.AppConfig, payload models.Payload, uploadID string, parts []models.CompletedPart) error {
+	request := models.MultipartRequest{
+		Tenant:       payload.Tenant,
+		Namespace:    payload.Namespace,
+		FileName:     payload.FileName,
+		ArtifactType: payload.ArtifactType,
+		UploadID:     uploadID,
+		Parts:        parts,
+	}
+	bearer, err := constructBearerAuth(fileSystem, "var/run/secrets/kubernetes.io/serviceaccount/token")
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error creating request to middleware: %s", err.Error()))
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if err := postToMiddleware(bearer, uploadEndpoint(cfg, "complete"), request, nil); err != nil {
+		return fmt.Errorf("Error completing multipart upload: %w", err)
+	}
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// AbortMultipartUpload asks the heap dump service to discard all parts of an
+// upload that can not be finished.
+func AbortMultipartUpload(fileSystem fs.FS, cfg config.AppConfig, payload models.Payload, uploadID string) error {
+	request := models.MultipartRequest{
+		Tenant:       payload.Tenant,
+		Namespace:    payload.Namespace,
+		FileName:     payload.FileName,
+		ArtifactType: payload.ArtifactType,
+		UploadID:     uploadID,
+	}
+	bearer, err := constructBearerAuth(fileSystem, "var/run/secrets/kubernetes.io/serviceaccount/token")
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error sending request to middleware: %s", err.Error()))
+		return err
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		b, _ := io.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("Middleware replied with error code: %d: %s", resp.StatusCode, b))
+	if err := postToMiddleware(bearer, uploadEndpoint(cfg, "abort"), request, nil); err != nil {
+		return fmt.Errorf("Error aborting multipart upload: %w", err)
 	}
-
-	return json.NewDecoder(resp.Body).Decode(target)
+	return nil
 }
@@ -50,6 +50,14 @@ func setup(serverPointer *http.Server) {
 	http.HandleFunc("/request", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, string(returnGoodJson))
 	})
+	http.HandleFunc("/request/complete", func(w http.ResponseWriter, r *http.Request) {
+		var request models.MultipartRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.UploadID == "" || len(request.Parts) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		fmt.Fprintf(w, `{"status":"ok"}`)
+	})
 	go func() {
 		if err := serverPointer.ListenAndServe(); err != http.ErrServerClosed {
 			log.Fatalf("HTTP server ListenAndServe Error: %v", err)
@@ -84,14 +92,15 @@ func TestConstructRequestBody(t *testing.T) {
 	os.Setenv("POD_NAME", testPodName)
 
 	testData := models.Payload{
-		Tenant:    testSystem,
-		Namespace: testComponent,
-		FileName:  fmt.Sprintf("%s-%s-%s.hprof.crypted", testPodName, testFileName, now.Format("2006-01-02-15-04-05")),
+		Tenant:       testSystem,
+		Namespace:    testComponent,
+		FileName:     fmt.Sprintf("%s-%s-%s.hprof.crypted", testPodName, testFileName, now.Format("2006-01-02-15-04-05")),
+		ArtifactType: "hprof",
 	}
 
 	testBytes, _ := json.Marshal(testData)
 	want := bytes.NewReader(testBytes)
-	got, err := constructRequestBody(testFileName, testSystem, testComponent, testPodName)
+	got, err := constructRequestBody(constructPayload(testFileName, testSystem, testComponent, testPodName, "hprof", 0))
 	if err != nil {
 		t.Errorf("Failed to construct request body: %v", err)
 	}
@@ -100,6 +109,23 @@ func TestConstructRequestBody(t *testing.T) {
 	}
 }
 
+func TestPayloadArtifactType(t *testing.T) {
+	cases := map[string]string{
+		"hprof":        ".hprof.crypted",
+		"hprof.gz":     ".hprof.gz.crypted",
+		"pprof":        ".pb.gz.crypted",
+		"gcdump":       ".gcdump.crypted",
+		"heapsnapshot": ".heapsnapshot.crypted",
+		"core":         ".core.crypted",
+	}
+	for artifactType, want := range cases {
+		payload := constructPayload("dump", "devops", "platform", "pod", artifactType, 0)
+		if !strings.HasSuffix(payload.FileName, want) || payload.ArtifactType != artifactType {
+			t.Errorf("%s: got %s (%s), want suffix %s", artifactType, payload.FileName, payload.ArtifactType, want)
+		}
+	}
+}
+
 func TestRequestUploadConfig(t *testing.T) {
 	testConfig := config.AppConfig{
 		Metrics: struct {
@@ -128,7 +154,7 @@ func TestRequestUploadConfig(t *testing.T) {
 		mockMiddleware()
 	}()*/
 
-	err := RequestUploadConfig(ValidFs, testConfig, "test", got)
+	_, err := RequestUploadConfig(ValidFs, testConfig, DumpInfo{File: "test", ArtifactType: "hprof"}, got)
 
 	if err != nil {
 		t.Errorf("Error requesting upload config %v", err)
@@ -161,7 +187,7 @@ func TestBadRequestUploadConfig(t *testing.T) {
 	}
 	testResponseModel := new(models.SigningResponse)
 
-	got := RequestUploadConfig(InvalidFs, badTestConfig, "does not matter", testResponseModel)
+	_, got := RequestUploadConfig(InvalidFs, badTestConfig, DumpInfo{File: "does not matter", ArtifactType: "hprof"}, testResponseModel)
 	wantNoToken := errors.New(fmt.Sprintf("Error reading SA Token: %s", "open var/run/secrets/kubernetes.io/serviceaccount/token: file does not exist"))
 
 	if got == nil {
@@ -171,7 +197,7 @@ func TestBadRequestUploadConfig(t *testing.T) {
 		t.Errorf("got %+v, want %+v", got.Error(), wantNoToken.Error())
 	}
 
-	got = RequestUploadConfig(ValidFs, badTestConfig, "does not matter", testResponseModel)
+	_, got = RequestUploadConfig(ValidFs, badTestConfig, DumpInfo{File: "does not matter", ArtifactType: "hprof"}, testResponseModel)
 	wantNoNetwork := "Error sending request to middleware"
 
 	if got == nil {
@@ -182,3 +208,47 @@ func TestBadRequestUploadConfig(t *testing.T) {
 	}
 
 }
+
+func TestCompleteMultipartUpload(t *testing.T) {
+	testConfig := config.AppConfig{}
+	testConfig.Middleware.Endpoint = "http://localhost:21337/request/"
+	payload := models.Payload{Tenant: "testTenant", Namespace: "platform", FileName: "dump.hprof.crypted"}
+	parts := []models.CompletedPart{{PartNumber: 1, ETag: "\"etag\""}}
+
+	err := CompleteMultipartUpload(ValidFs, testConfig, payload, "upload-1", parts)
+	if err != nil {
+		t.Errorf("Error completing upload %v", err)
+	}
+	err = CompleteMultipartUpload(ValidFs, testConfig, payload, "upload-1", nil)
+	if err == nil || !strings.Contains(err.Error(), "Middleware replied with error code: 400") {
+		t.Errorf("got %v", err)
+	}
+	err = AbortMultipartUpload(InvalidFs, testConfig, payload, "upload-1")
+	if err == nil || !strings.Contains(err.Error(), "Error reading SA Token") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUploadName(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 5, 0, time.UTC)
+	cases := []struct {
+		podName  string
+		fileName string
+		want     string
+	}{
+		{"java-app-7d9f", "java_pid1.hprof", "java-app-7d9f-java_pid1.hprof-2024-01-01-12-00-05.hprof.crypted"},
+		{"java-app-7d9f", "heap dump (1).hprof", "java-app-7d9f-heap_dump__1_.hprof-2024-01-01-12-00-05.hprof.crypted"},
+		{"", "dump.hprof", "dump.hprof-2024-01-01-12-00-05.hprof.crypted"},
+		{"", "", "dump-2024-01-01-12-00-05.hprof.crypted"},
+	}
+	for _, tc := range cases {
+		if got := uploadName(tc.podName, tc.fileName, now, "hprof"); got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+
+	long := uploadName("java-app-7d9f", strings.Repeat("a", 300), now, "hprof")
+	if len(long) != 255 || !strings.HasSuffix(long, "-2024-01-01-12-00-05.hprof.crypted") {
+		t.Errorf("long names have to be shortened to 255 characters keeping the suffix, got %d: %s", len(long), long)
+	}
+}
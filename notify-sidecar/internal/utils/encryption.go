@@ -1,9 +1,6 @@
 package utils
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"errors"
 	"fmt"
 	"io"
@@ -20,45 +17,34 @@ func EncryptDump(fileSystem fs.FS, fileLocation string, key []byte) (string, err
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("Error reading heap dump %s: %s", fileLocation, err.Error()))
 	}
+	defer inputFile.Close()
 
-	// Creating block of algorithm
-	block, err := aes.NewCipher(key)
+	inputInfo, err := inputFile.Stat()
 	if err != nil {
-		return "", errors.New(fmt.Sprintf("Error initializing ARE Cipher: %s", err.Error()))
+		return "", errors.New(fmt.Sprintf("Error reading heap dump %s: %s", fileLocation, err.Error()))
 	}
-
-	// Creating GCM mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", errors.New(fmt.Sprintf("Error in GCM Cipher: %s", err.Error()))
+	plainText, ok := inputFile.(io.ReaderAt)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Error reading heap dump %s: random access is not supported", fileLocation))
 	}
-
-	// Generating random nonce
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", errors.New(fmt.Sprintf("Error generating random nonce: %s", err.Error()))
+	// Chunks are sealed on all cores by the envelope, see envelope.go for
+	// the layout.
+	envelope, err := NewEnvelope(plainText, inputInfo.Size(), key, CompressionNone)
+	if err != nil {
+		return "", err
 	}
+	envelope.SetSourceCheck(FileCheck(inputFile, inputInfo))
 
-	buffer := make([]byte, chunkSize)
-	outputFile, err := os.Create(fmt.Sprintf("/tmp/%s.%s", filepath.Base(fileLocation), "crypted"))
+	outputLocation := fmt.Sprintf("/tmp/%s.%s", filepath.Base(fileLocation), "crypted")
+	outputFile, err := os.Create(outputLocation)
 	if err != nil {
 		return "", errors.New(fmt.Sprintf("Error creating encrypted heap dump: %s", err.Error()))
 	}
+	defer outputFile.Close()
 
-	for {
-		n, err := inputFile.Read(buffer)
-		if err != nil && err != io.EOF {
-			return "", errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
-		}
-		if n == 0 {
-			break
-		}
-
-		encryptedChunk := gcm.Seal(nil, nonce, buffer[:n], nil)
-		if _, err := outputFile.Write(encryptedChunk); err != nil {
-			return "", errors.New(fmt.Sprintf("Error writing encrypted heap dump: %s", err.Error()))
-		}
+	if err := copySection(outputFile, envelope.newSectionReader(0, envelope.Size(), nil)); err != nil {
+		os.Remove(outputLocation)
+		return "", errors.New(fmt.Sprintf("Error writing encrypted heap dump: %s", err.Error()))
 	}
-
-	return fmt.Sprintf("/tmp/%s.%s", filepath.Base(fileLocation), "crypted"), nil
+	return outputLocation, nil
 }
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The envelope format is described in heap-dump-companion/docs/envelope-format.md.
+// Any change here has to be mirrored in the companion's decrypt package.
+const (
+	envelopeMagic   = "HDMCRYPT"
+	envelopeVersion = 1
+	// envelopeVersionCompressed names the compression in the flags, which
+	// are reserved in version 1
+	envelopeVersionCompressed = 2
+	envelopeHeaderSize        = 23
+	noncePrefixSize           = 7
+
+	AlgorithmAES256GCM = 1
+)
+
+type envelopeHeader struct {
+	Version     byte
+	Algorithm   byte
+	Flags       byte
+	ChunkSize   uint32
+	NoncePrefix [noncePrefixSize]byte
+}
+
+func newEnvelopeHeader() (envelopeHeader, error) {
+	header := envelopeHeader{
+		Version:   envelopeVersion,
+		Algorithm: AlgorithmAES256GCM,
+		ChunkSize: chunkSize,
+	}
+	if _, err := io.ReadFull(rand.Reader, header.NoncePrefix[:]); err != nil {
+		return header, errors.New(fmt.Sprintf("Error generating random nonce: %s", err.Error()))
+	}
+	return header, nil
+}
+
+func (h envelopeHeader) marshal() []byte {
+	b := make([]byte, envelopeHeaderSize)
+	copy(b, envelopeMagic)
+	b[8] = h.Version
+	b[9] = h.Algorithm
+	b[10] = h.Flags
+	b[11] = 0
+	binary.BigEndian.PutUint32(b[12:16], h.ChunkSize)
+	copy(b[16:], h.NoncePrefix[:])
+	return b
+}
+
+// chunkNonce derives the nonce of a single chunk: the random prefix of the
+// header, the big endian chunk counter and a trailing final-chunk marker.
+func chunkNonce(prefix [noncePrefixSize]byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptStream writes src to dst in the envelope format. Every chunk is
+// authenticated together with the header, the last one carries the final
+// marker so a truncated upload can not be mistaken for a complete one.
+func encryptStream(dst io.Writer, src io.Reader, key []byte) error {
+	header, err := newEnvelopeHeader()
+	if err != nil {
+		return err
+	}
+	return encryptStreamWithHeader(dst, src, key, header)
+}
+
+func encryptStreamWithHeader(dst io.Writer, src io.Reader, key []byte, header envelopeHeader) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error initializing ARE Cipher: %s", err.Error()))
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error in GCM Cipher: %s", err.Error()))
+	}
+
+	headerBytes := header.marshal()
+	if _, err := dst.Write(headerBytes); err != nil {
+		return errors.New(fmt.Sprintf("Error writing encrypted heap dump: %s", err.Error()))
+	}
+
+	current := make([]byte, chunkSize)
+	next := make([]byte, chunkSize)
+	sealed := make([]byte, 4, 4+chunkSize+gcm.Overhead())
+
+	n, readErr := io.ReadFull(src, current)
+	var counter uint32
+	for {
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return errors.New(fmt.Sprintf("Error reading heap dump: %s", readErr.Error()))
+		}
+		// A short read means there is nothing left, otherwise look ahead
+		// one chunk to find out whether the current one is the last.
+		final := readErr != nil
+		var m int
+		if !final {
+			m, readErr = io.ReadFull(src, next)
+			if m == 0 && readErr == io.EOF {
+				final = true
+			} else if m == 0 && readErr != nil {
+				return errors.New(fmt.Sprintf("Error reading heap dump: %s", readErr.Error()))
+			}
+		}
+
+		sealed = gcm.Seal(sealed[:4], chunkNonce(header.NoncePrefix, counter, final), current[:n], headerBytes)
+		binary.BigEndian.PutUint32(sealed[:4], uint32(len(sealed)-4))
+		if _, err := dst.Write(sealed); err != nil {
+			return errors.New(fmt.Sprintf("Error writing encrypted heap dump: %s", err.Error()))
+		}
+		if final {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return errors.New("Error encrypting heap dump: too many chunks")
+		}
+		counter++
+		current, next = next, current
+		n = m
+	}
+}
+
+// EncryptedSize returns the size of the envelope encryptStream produces for
+// a plaintext of the given size.
+func EncryptedSize(plainSize int64) int64 {
+	chunks := (plainSize + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return envelopeHeaderSize + chunks*(4+16) + plainSize
+}
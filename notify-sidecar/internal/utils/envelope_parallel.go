@@ -0,0 +1,67 @@
+package utils
+
+// sealJob is a single chunk travelling through the pipeline of sealChunks.
+// sealed is signalled once the chunk is sealed or failed.
+type sealJob struct {
+	index  int64
+	plain  []byte
+	out    []byte
+	err    error
+	sealed chan struct{}
+}
+
+func (e *Envelope) newSealJob() interface{} {
+	return &sealJob{
+		plain:  make([]byte, chunkSize),
+		out:    make([]byte, 0, sealedChunkSize),
+		sealed: make(chan struct{}, 1),
+	}
+}
+
+// sealChunks seals the chunks first to last on e.workers goroutines and
+// returns them in order: a producer hands out the chunk indexes, workers
+// read and seal them with their per-chunk nonce and the caller receives
+// them from the returned channel. At most 2*workers chunks are held in
+// memory. Closing stop ends the pipeline early, jobs received have to be
+// passed back with releaseJob.
+func (e *Envelope) sealChunks(first int64, last int64, stop <-chan struct{}) <-chan *sealJob {
+	workers := int64(max(e.workers, 1))
+	workers = min(workers, last-first+1)
+	// ordered carries the chunks in envelope order to the caller, its
+	// capacity bounds the number of chunks in flight
+	ordered := make(chan *sealJob, 2*workers)
+	toSeal := make(chan *sealJob, workers)
+
+	go func() {
+		defer close(ordered)
+		defer close(toSeal)
+		for index := first; index <= last; index++ {
+			job := e.jobs.Get().(*sealJob)
+			job.index = index
+			select {
+			case ordered <- job:
+			case <-stop:
+				return
+			}
+			toSeal <- job
+		}
+	}()
+
+	for i := int64(0); i < workers; i++ {
+		go func() {
+			for job := range toSeal {
+				// a cipher.AEAD from crypto/aes is safe for concurrent use,
+				// as is ReadAt of the plaintext
+				job.out, job.err = e.sealChunk(job.out, job.plain, job.index)
+				job.sealed <- struct{}{}
+			}
+		}()
+	}
+	return ordered
+}
+
+// releaseJob returns a job received from sealChunks to the pool.
+func (e *Envelope) releaseJob(job *sealJob) {
+	job.err = nil
+	e.jobs.Put(job)
+}
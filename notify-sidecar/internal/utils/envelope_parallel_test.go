@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeWorkersMatchSequential(t *testing.T) {
+	header, err := newEnvelopeHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 10*chunkSize + 3} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var sequential bytes.Buffer
+		if err := encryptStreamWithHeader(&sequential, bytes.NewReader(plain), envelopeTestKey, header); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		for _, workers := range []int{1, 3, 8} {
+			envelope, _ := newEnvelopeWithHeader(bytes.NewReader(plain), int64(size), envelopeTestKey, header)
+			envelope.workers = workers
+			got, err := io.ReadAll(envelope.NewSectionReader(0, envelope.Size()))
+			if err != nil {
+				t.Fatalf("size %d, %d workers: %v", size, workers, err)
+			}
+			if !bytes.Equal(got, sequential.Bytes()) {
+				t.Errorf("size %d, %d workers: output differs from the sequential encryption", size, workers)
+			}
+
+			// the checksums are computed by the same pipeline the upload
+			// reads from
+			checksums, err := envelope.Checksums(sealedChunkSize + 5)
+			want := sha256.Sum256(sequential.Bytes())
+			if err != nil || !bytes.Equal(checksums.SHA256, want[:]) {
+				t.Errorf("size %d, %d workers: checksum differs from the sequential encryption: %v", size, workers, err)
+			}
+		}
+	}
+}
+
+type failingReaderAt struct {
+	data  io.ReaderAt
+	after int64
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.after {
+		return 0, errors.New("disk on fire")
+	}
+	return r.data.ReadAt(p, offset)
+}
+
+func TestEnvelopeWorkersErrors(t *testing.T) {
+	plain := make([]byte, 20*chunkSize+7)
+	envelope, _ := NewEnvelope(&failingReaderAt{data: bytes.NewReader(plain), after: 5 * chunkSize}, int64(len(plain)), envelopeTestKey, CompressionNone)
+	envelope.workers = 4
+	reader := envelope.NewSectionReader(0, envelope.Size())
+	if _, err := io.ReadAll(reader); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("got %v", err)
+	}
+	// a failed reader stays failed
+	if _, err := reader.Read(make([]byte, 10)); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestEnvelopeSectionReaderClose(t *testing.T) {
+	plain := make([]byte, 200*chunkSize)
+	envelope, _ := NewEnvelope(bytes.NewReader(plain), int64(len(plain)), envelopeTestKey, CompressionNone)
+	envelope.workers = 4
+
+	before := runtime.NumGoroutine()
+	reader := envelope.NewSectionReader(0, envelope.Size())
+	if _, err := io.ReadFull(reader, make([]byte, 3*sealedChunkSize)); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	reader.(io.Closer).Close()
+
+	// the pipeline of an abandoned reader has to stop
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before {
+		t.Errorf("%d goroutines are left after closing the reader", got-before)
+	}
+}
+
+const benchmarkSize = 64 * 1024 * 1024
+
+func BenchmarkEncryptSequential(b *testing.B) {
+	plain := make([]byte, benchmarkSize)
+	rand.Read(plain)
+	header, _ := newEnvelopeHeader()
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encryptStreamWithHeader(io.Discard, bytes.NewReader(plain), envelopeTestKey, header); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEnvelope reads the envelope like the upload does, it scales with
+// the number of workers up to the number of cores, compare with
+// BenchmarkEncryptSequential.
+func BenchmarkEnvelope(b *testing.B) {
+	plain := make([]byte, benchmarkSize)
+	rand.Read(plain)
+	for _, workers := range []int{1, 2, 4, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			envelope, _ := NewEnvelope(bytes.NewReader(plain), benchmarkSize, envelopeTestKey, CompressionNone)
+			envelope.workers = workers
+			b.SetBytes(benchmarkSize)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.Copy(io.Discard, envelope.NewSectionReader(0, envelope.Size())); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime"
+	"sync"
+)
+
+// ErrSourceChanged is returned once the plaintext of an envelope changed
+// between or during passes over it.
+var ErrSourceChanged = errors.New("heap dump changed while encrypting")
+
+// Envelope encrypts a plaintext of known size on the fly. As the position
+// of every chunk in the envelope only depends on the plaintext size, any
+// byte range of the ciphertext can be produced directly from the plaintext
+// without writing the encrypted dump anywhere.
+//
+// Every pass over the plaintext, like computing the checksums, the upload and
+// retried parts, seals it with the same key and nonces. Sealing different
+// plaintext under the same nonce breaks GCM, so a source check set with
+// SetSourceCheck is run at the start and the end of every section read.
+type Envelope struct {
+	plain     io.ReaderAt
+	plainSize int64
+	gcm       cipher.AEAD
+	header    envelopeHeader
+	rawHeader []byte
+	chunks    int64
+	check     func() error
+	// workers seal the chunks of every section reader, jobs pools their
+	// buffers
+	workers int
+	jobs    sync.Pool
+}
+
+const sealedChunkSize = 4 + chunkSize + 16
+
+// NewEnvelope encrypts plain, which has already been compressed with
+// compression, the header tells the companion how to decompress it.
+// Compressed dumps are written as version 2, so companions that only know
+// version 1 reject them instead of ignoring the compression. Uncompressed
+// dumps stay version 1 and can be decrypted by any companion.
+func NewEnvelope(plain io.ReaderAt, plainSize int64, key []byte, compression Compression) (*Envelope, error) {
+	header, err := newEnvelopeHeader()
+	if err != nil {
+		return nil, err
+	}
+	if compression != CompressionNone {
+		header.Version = envelopeVersionCompressed
+		header.Flags = byte(compression)
+	}
+	return newEnvelopeWithHeader(plain, plainSize, key, header)
+}
+
+func newEnvelopeWithHeader(plain io.ReaderAt, plainSize int64, key []byte, header envelopeHeader) (*Envelope, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error initializing ARE Cipher: %s", err.Error()))
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error in GCM Cipher: %s", err.Error()))
+	}
+	chunks := (plainSize + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	if chunks > 1<<32 {
+		return nil, errors.New("Error encrypting heap dump: too many chunks")
+	}
+	e := &Envelope{
+		plain:     plain,
+		plainSize: plainSize,
+		gcm:       gcm,
+		header:    header,
+		rawHeader: header.marshal(),
+		chunks:    chunks,
+		workers:   runtime.GOMAXPROCS(0),
+	}
+	e.jobs.New = e.newSealJob
+	return e, nil
+}
+
+// SetSourceCheck sets the check telling whether the plaintext is still the
+// one the envelope was created for.
+func (e *Envelope) SetSourceCheck(check func() error) {
+	e.check = check
+}
+
+func (e *Envelope) checkSource() error {
+	if e.check == nil {
+		return nil
+	}
+	return e.check()
+}
+
+// FileCheck returns a source check failing with ErrSourceChanged once the
+// size or modification time of file differ from info. Growth counts as a
+// change, too, the envelope only covers the size it was created with.
+func FileCheck(file interface{ Stat() (fs.FileInfo, error) }, info fs.FileInfo) func() error {
+	return func() error {
+		current, err := file.Stat()
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
+		}
+		if current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+			return fmt.Errorf("%w: %d bytes modified at %v, was %d bytes modified at %v", ErrSourceChanged, current.Size(), current.ModTime(), info.Size(), info.ModTime())
+		}
+		return nil
+	}
+}
+
+// Size returns the size of the whole envelope.
+func (e *Envelope) Size() int64 {
+	return EncryptedSize(e.plainSize)
+}
+
+// NewSectionReader returns a reader for length bytes of the envelope
+// starting at offset. Readers are independent of each other and can be
+// used concurrently. Every reader seals its chunks on the workers of the
+// envelope, it is an io.ReadCloser and has to be closed if it is not read
+// to the end.
+func (e *Envelope) NewSectionReader(offset int64, length int64) io.Reader {
+	return e.newSectionReader(offset, length, nil)
+}
+
+// newSectionReader returns a section reader passing the plaintext of every
+// chunk it seals to onChunk, if set.
+func (e *Envelope) newSectionReader(offset int64, length int64, onChunk func(index int64, plain []byte)) *envelopeSectionReader {
+	return &envelopeSectionReader{
+		envelope: e,
+		offset:   offset,
+		end:      min(offset+length, e.Size()),
+		onChunk:  onChunk,
+	}
+}
+
+// chunkLength returns the plaintext length of chunk index.
+func (e *Envelope) chunkLength(index int64) int64 {
+	return min(chunkSize, e.plainSize-index*chunkSize)
+}
+
+// sealChunk appends the length prefixed, sealed chunk index to dst.
+func (e *Envelope) sealChunk(dst []byte, plain []byte, index int64) ([]byte, error) {
+	offset := index * chunkSize
+	length := e.chunkLength(index)
+	n, err := e.plain.ReadAt(plain[:length], offset)
+	if int64(n) < length {
+		if err == nil || err == io.EOF {
+			return nil, ErrSourceChanged
+		}
+		return nil, errors.New(fmt.Sprintf("Error reading heap dump: %s", err.Error()))
+	}
+	final := index == e.chunks-1
+	dst = append(dst[:0], 0, 0, 0, 0)
+	dst = e.gcm.Seal(dst, chunkNonce(e.header.NoncePrefix, uint32(index), final), plain[:length], e.rawHeader)
+	binary.BigEndian.PutUint32(dst[:4], uint32(len(dst)-4))
+	return dst, nil
+}
+
+type envelopeSectionReader struct {
+	envelope *Envelope
+	offset   int64
+	end      int64
+	// jobs delivers the sealed chunks of the section in order once the
+	// first chunk is read, job is the chunk being read
+	jobs    <-chan *sealJob
+	stop    chan struct{}
+	job     *sealJob
+	onChunk func(index int64, plain []byte)
+	err     error
+	started bool
+	checked bool
+}
+
+func (r *envelopeSectionReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.started {
+		r.started = true
+		if err := r.envelope.checkSource(); err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	if r.offset >= r.end {
+		// a change while the section was read went into it already
+		if !r.checked {
+			r.checked = true
+			if err := r.envelope.checkSource(); err != nil {
+				return 0, r.fail(err)
+			}
+		}
+		return 0, io.EOF
+	}
+	p = p[:min(int64(len(p)), r.end-r.offset)]
+
+	if r.offset < envelopeHeaderSize {
+		n := copy(p, r.envelope.rawHeader[r.offset:])
+		r.offset += int64(n)
+		return n, nil
+	}
+
+	index := (r.offset - envelopeHeaderSize) / sealedChunkSize
+	if r.job == nil || r.job.index != index {
+		if err := r.next(index); err != nil {
+			return 0, r.fail(err)
+		}
+	}
+	n := copy(p, r.job.out[r.offset-envelopeHeaderSize-index*sealedChunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// next moves on to the sealed chunk index, starting the pipeline for the
+// rest of the section with the first chunk.
+func (r *envelopeSectionReader) next(index int64) error {
+	if r.jobs == nil {
+		last := (r.end - 1 - envelopeHeaderSize) / sealedChunkSize
+		r.stop = make(chan struct{})
+		r.jobs = r.envelope.sealChunks(index, last, r.stop)
+	}
+	if r.job != nil {
+		r.envelope.releaseJob(r.job)
+		r.job = nil
+	}
+	job, ok := <-r.jobs
+	if !ok {
+		return errors.New("Error encrypting heap dump: section ended early")
+	}
+	<-job.sealed
+	if job.err != nil {
+		return job.err
+	}
+	if job.index != index {
+		return errors.New(fmt.Sprintf("Error encrypting heap dump: got chunk %d, want %d", job.index, index))
+	}
+	r.job = job
+	if r.onChunk != nil {
+		r.onChunk(job.index, job.plain[:r.envelope.chunkLength(job.index)])
+	}
+	return nil
+}
+
+func (r *envelopeSectionReader) fail(err error) error {
+	r.err = err
+	r.Close()
+	return err
+}
+
+// Close stops sealing the rest of the section. Readers that are not read to
+// the end have to be closed.
+func (r *envelopeSectionReader) Close() error {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvelopeMatchesStream(t *testing.T) {
+	header, _ := newEnvelopeHeader()
+	for _, size := range []int{0, 12, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		plainText := make([]byte, size)
+		rand.Read(plainText)
+
+		var want bytes.Buffer
+		if err := encryptStreamWithHeader(&want, bytes.NewReader(plainText), envelopeTestKey, header); err != nil {
+			t.Fatalf("Failed to encrypt: %v", err)
+		}
+		envelope, err := newEnvelopeWithHeader(bytes.NewReader(plainText), int64(size), envelopeTestKey, header)
+		if err != nil {
+			t.Fatalf("Failed to create envelope: %v", err)
+		}
+		if envelope.Size() != int64(want.Len()) {
+			t.Errorf("size %d: envelope has %d bytes, want %d", size, envelope.Size(), want.Len())
+		}
+		got, err := io.ReadAll(envelope.NewSectionReader(0, envelope.Size()))
+		if err != nil {
+			t.Fatalf("Failed to read envelope: %v", err)
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("size %d: envelope differs from the streamed encryption", size)
+		}
+	}
+}
+
+func TestEnvelopeSections(t *testing.T) {
+	plainText := make([]byte, 5*chunkSize+123)
+	rand.Read(plainText)
+	envelope, _ := NewEnvelope(bytes.NewReader(plainText), int64(len(plainText)), envelopeTestKey, CompressionNone)
+	whole, _ := io.ReadAll(envelope.NewSectionReader(0, envelope.Size()))
+
+	// odd part sizes that cut through header and chunk boundaries
+	for _, partSize := range []int64{4099, 1000, chunkSize, sealedChunkSize + 3, envelope.Size()} {
+		var joined []byte
+		for offset := int64(0); offset < envelope.Size(); offset += partSize {
+			part, err := io.ReadAll(envelope.NewSectionReader(offset, partSize))
+			if err != nil {
+				t.Fatalf("Failed to read section: %v", err)
+			}
+			joined = append(joined, part...)
+		}
+		if !bytes.Equal(joined, whole) {
+			t.Errorf("sections of %d bytes do not add up to the envelope", partSize)
+		}
+	}
+
+	plain, chunks := openEnvelope(t, whole, envelopeTestKey)
+	if !bytes.Equal(plain, plainText) || chunks != 6 {
+		t.Errorf("envelope does not decrypt to the dump")
+	}
+}
+
+func TestEnvelopeDumpChanged(t *testing.T) {
+	plainText := make([]byte, 2*chunkSize)
+	// claim more data than there is, as if the dump was truncated meanwhile
+	envelope, _ := NewEnvelope(bytes.NewReader(plainText), int64(len(plainText))+10, envelopeTestKey, CompressionNone)
+	_, err := io.ReadAll(envelope.NewSectionReader(0, envelope.Size()))
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestEnvelopeSourceCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "java_pid1.hprof")
+	os.WriteFile(file, make([]byte, 2*chunkSize), 0o644)
+	dump, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dump.Close()
+	info, _ := dump.Stat()
+	envelope, _ := NewEnvelope(dump, info.Size(), envelopeTestKey, CompressionNone)
+	envelope.SetSourceCheck(FileCheck(dump, info))
+
+	if _, err := envelope.Checksums(sealedChunkSize); err != nil {
+		t.Fatalf("Failed to compute checksums: %v", err)
+	}
+	// the dump grows after the checksums were computed, later passes and
+	// retried parts must not seal other data under the same nonces
+	appender, _ := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0)
+	appender.Write([]byte("more"))
+	appender.Close()
+	if _, err := io.ReadAll(envelope.NewSectionReader(sealedChunkSize, sealedChunkSize)); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := envelope.Checksums(0); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestEnvelopeSourceCheckAtEnd(t *testing.T) {
+	plainText := make([]byte, 2*chunkSize)
+	envelope, _ := NewEnvelope(bytes.NewReader(plainText), int64(len(plainText)), envelopeTestKey, CompressionNone)
+	checks := 0
+	envelope.SetSourceCheck(func() error {
+		checks++
+		if checks > 1 {
+			// changed while the section was read
+			return ErrSourceChanged
+		}
+		return nil
+	})
+	if _, err := io.ReadAll(envelope.NewSectionReader(0, envelope.Size())); !errors.Is(err, ErrSourceChanged) {
+		t.Errorf("a change during a pass has to fail it, got %v", err)
+	}
+}
+
+func TestEnvelopeBadKey(t *testing.T) {
+	_, err := NewEnvelope(bytes.NewReader(nil), 0, make([]byte, 8), CompressionNone)
+	if err == nil || err.Error() != "Error initializing ARE Cipher: crypto/aes: invalid key size 8" {
+		t.Errorf("got %v", err)
+	}
+}
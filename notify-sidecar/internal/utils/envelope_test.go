@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+var envelopeTestKey = []byte{52, 74, 93, 7, 97, 74, 50, 186, 172, 14, 125, 208, 130, 218, 177, 215, 219, 219, 247, 163, 81, 86, 105, 60, 22, 162, 54, 81, 19, 37, 212, 49}
+
+// openEnvelope is a minimal reader of the envelope format to verify what
+// encryptStream produces. It returns the plaintext and the number of chunks.
+func openEnvelope(t *testing.T, data []byte, key []byte) ([]byte, int) {
+	t.Helper()
+	if len(data) < envelopeHeaderSize || string(data[:8]) != envelopeMagic {
+		t.Fatalf("missing envelope header")
+	}
+	headerBytes := data[:envelopeHeaderSize]
+	if headerBytes[8] != envelopeVersion || headerBytes[9] != AlgorithmAES256GCM {
+		t.Fatalf("unexpected version or algorithm: %v", headerBytes[8:10])
+	}
+	if binary.BigEndian.Uint32(headerBytes[12:16]) != chunkSize {
+		t.Fatalf("unexpected chunk size in header")
+	}
+	var prefix [noncePrefixSize]byte
+	copy(prefix[:], headerBytes[16:])
+
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+
+	var plainText []byte
+	rest := data[envelopeHeaderSize:]
+	for counter := uint32(0); ; counter++ {
+		if len(rest) < 4 {
+			t.Fatalf("stream ended without final chunk")
+		}
+		length := binary.BigEndian.Uint32(rest[:4])
+		chunk := rest[4 : 4+length]
+		rest = rest[4+length:]
+		final := len(rest) == 0
+		plain, err := gcm.Open(nil, chunkNonce(prefix, counter, final), chunk, headerBytes)
+		if err != nil {
+			t.Fatalf("chunk %d (final=%v) does not authenticate: %v", counter, final, err)
+		}
+		plainText = append(plainText, plain...)
+		if final {
+			return plainText, int(counter) + 1
+		}
+	}
+}
+
+func TestEncryptStreamRoundTrip(t *testing.T) {
+	cases := map[string]struct {
+		size   int
+		chunks int
+	}{
+		"empty":               {size: 0, chunks: 1},
+		"small":               {size: 12, chunks: 1},
+		"exactly one chunk":   {size: chunkSize, chunks: 1},
+		"one chunk and a bit": {size: chunkSize + 1, chunks: 2},
+		"several chunks":      {size: 3*chunkSize + 100, chunks: 4},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			plainText := make([]byte, tc.size)
+			rand.Read(plainText)
+			var out bytes.Buffer
+			if err := encryptStream(&out, bytes.NewReader(plainText), envelopeTestKey); err != nil {
+				t.Fatalf("Failed to encrypt: %v", err)
+			}
+			got, chunks := openEnvelope(t, out.Bytes(), envelopeTestKey)
+			if !bytes.Equal(got, plainText) {
+				t.Errorf("decrypted data does not match the plaintext")
+			}
+			if chunks != tc.chunks {
+				t.Errorf("got %d chunks, want %d", chunks, tc.chunks)
+			}
+			if int64(out.Len()) != EncryptedSize(int64(tc.size)) {
+				t.Errorf("got %d bytes, EncryptedSize predicts %d", out.Len(), EncryptedSize(int64(tc.size)))
+			}
+		})
+	}
+}
+
+func TestEncryptStreamUniqueNonces(t *testing.T) {
+	var first, second bytes.Buffer
+	encryptStream(&first, bytes.NewReader([]byte("asdfasdfasdf")), envelopeTestKey)
+	encryptStream(&second, bytes.NewReader([]byte("asdfasdfasdf")), envelopeTestKey)
+	if bytes.Equal(first.Bytes()[16:envelopeHeaderSize], second.Bytes()[16:envelopeHeaderSize]) {
+		t.Errorf("nonce prefix must be random per envelope")
+	}
+	if bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Errorf("encrypting twice must not produce the same ciphertext")
+	}
+}
+
+func TestChunkNonce(t *testing.T) {
+	prefix := [noncePrefixSize]byte{1, 2, 3, 4, 5, 6, 7}
+	want := []byte{1, 2, 3, 4, 5, 6, 7, 0, 0, 1, 2, 1}
+	got := chunkNonce(prefix, 258, true)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FailureClass tells whether a failed request is worth retrying.
+type FailureClass int
+
+const (
+	// Permanent failures fail again on retry, e.g. a rejected service
+	// account token or an invalid encryption key.
+	Permanent FailureClass = iota
+	// Transient failures are network errors, throttling and 5xx replies.
+	Transient
+	// Expired failures need fresh presigned URLs from the heap dump service.
+	Expired
+)
+
+func (c FailureClass) String() string {
+	switch c {
+	case Permanent:
+		return "permanent"
+	case Transient:
+		return "transient"
+	case Expired:
+		return "expired"
+	}
+	return fmt.Sprintf("class(%d)", int(c))
+}
+
+// RequestError is returned for failed requests to the heap dump service and
+// to S3, it carries the classification of the failure.
+type RequestError struct {
+	Class      FailureClass
+	StatusCode int
+	Message    string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+// Classify returns the class of err. Errors that are not caused by a
+// request, like a missing service account token, are permanent.
+func Classify(err error) FailureClass {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.Class
+	}
+	return Permanent
+}
+
+func networkError(message string) error {
+	return &RequestError{Class: Transient, Message: message}
+}
+
+// statusError classifies an error reply of the heap dump service.
+func statusError(statusCode int, message string) error {
+	class := Permanent
+	switch {
+	case statusCode >= 500, statusCode == http.StatusTooManyRequests, statusCode == http.StatusRequestTimeout:
+		class = Transient
+	}
+	return &RequestError{Class: class, StatusCode: statusCode, Message: message}
+}
+
+// s3StatusError classifies an error reply of S3. Presigned URLs that are no
+// longer valid are rejected with 403 "Request has expired". Uploads that do
+// not match their checksum were corrupted on the way and are retried.
+func s3StatusError(statusCode int, body []byte, message string) error {
+	if statusCode == http.StatusForbidden && strings.Contains(string(body), "Request has expired") {
+		return &RequestError{Class: Expired, StatusCode: statusCode, Message: message}
+	}
+	if statusCode == http.StatusBadRequest && strings.Contains(string(body), "BadDigest") {
+		return &RequestError{Class: Transient, StatusCode: statusCode, Message: message}
+	}
+	return statusError(statusCode, message)
+}
+
+// Backoff retries operations with jittered exponential backoff. Attempts
+// of 1 or less disable retries. Once Cancel is closed no more retries are
+// made.
+type Backoff struct {
+	Attempts     int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Cancel       <-chan struct{}
+}
+
+// sleep waits for d and returns false if cancel was closed before.
+var sleep = func(d time.Duration, cancel <-chan struct{}) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// Delay returns the randomized delay before retry number attempt, starting
+// at 1. It is drawn from the upper half of the exponential delay, so
+// sidecars that failed at the same time do not retry at the same time.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.InitialDelay
+	for i := 1; i < attempt && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if b.MaxDelay > 0 && delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Retry calls fn until it succeeds, fails with a class not in retryOn or
+// the attempts are used up. It returns the last error.
+func (b Backoff) Retry(operation string, fn func() error, retryOn ...FailureClass) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		class := Classify(err)
+		if attempt >= b.Attempts || !containsClass(retryOn, class) {
+			return err
+		}
+		delay := b.Delay(attempt)
+		log.WithFields(log.Fields{
+			"caller": "Backoff.Retry",
+		}).Warn(fmt.Sprintf("%s failed (%s, attempt %d of %d), retrying in %v: %s", operation, class, attempt, b.Attempts, delay, err.Error()))
+		if !sleep(delay, b.Cancel) {
+			return err
+		}
+	}
+}
+
+func containsClass(classes []FailureClass, class FailureClass) bool {
+	for _, c := range classes {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
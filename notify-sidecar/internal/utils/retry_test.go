@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func noSleep(t *testing.T) *[]time.Duration {
+	var delays []time.Duration
+	original := sleep
+	sleep = func(d time.Duration, cancel <-chan struct{}) bool {
+		delays = append(delays, d)
+		select {
+		case <-cancel:
+			return false
+		default:
+			return true
+		}
+	}
+	t.Cleanup(func() { sleep = original })
+	return &delays
+}
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		err  error
+		want FailureClass
+	}{
+		{networkError("Error making request: connection refused"), Transient},
+		{statusError(503, "Middleware replied with error code: 503"), Transient},
+		{statusError(429, "Middleware replied with error code: 429"), Transient},
+		{statusError(403, "Middleware replied with error code: 403"), Permanent},
+		{s3StatusError(403, []byte("<Message>Request has expired</Message>"), "AWS Api responded with status 403"), Expired},
+		{s3StatusError(403, []byte("<Code>SignatureDoesNotMatch</Code>"), "AWS Api responded with status 403"), Permanent},
+		{s3StatusError(400, []byte("<Code>BadDigest</Code>"), "AWS Api responded with status 400"), Transient},
+		{fmt.Errorf("Error uploading part 2: %w", networkError("Error making request: EOF")), Transient},
+		{errors.New("Error decoding aes key"), Permanent},
+	}
+	for _, tc := range cases {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Attempts: 10, InitialDelay: time.Second, MaxDelay: 10 * time.Second}
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		delay := backoff.Delay(attempt + 1)
+		if delay < max/2 || delay > max {
+			t.Errorf("attempt %d: delay %v not in [%v, %v]", attempt+1, delay, max/2, max)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	delays := noSleep(t)
+	backoff := Backoff{Attempts: 3, InitialDelay: time.Second, MaxDelay: time.Minute}
+
+	calls := 0
+	err := backoff.Retry("test", func() error {
+		calls++
+		return networkError("connection refused")
+	}, Transient)
+	if err == nil || calls != 3 || len(*delays) != 2 {
+		t.Errorf("transient errors must be retried until the attempts are used up, got %d calls, %v", calls, err)
+	}
+
+	calls = 0
+	err = backoff.Retry("test", func() error {
+		calls++
+		return statusError(403, "forbidden")
+	}, Transient, Expired)
+	if err == nil || calls != 1 {
+		t.Errorf("permanent errors must not be retried, got %d calls", calls)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	cancelled := backoff
+	cancelled.Cancel = cancel
+	calls = 0
+	err = cancelled.Retry("test", func() error {
+		calls++
+		return networkError("connection refused")
+	}, Transient)
+	if err == nil || calls != 1 {
+		t.Errorf("cancelled retries must stop, got %d calls", calls)
+	}
+
+	calls = 0
+	err = backoff.Retry("test", func() error {
+		calls++
+		if calls < 2 {
+			return statusError(500, "internal error")
+		}
+		return nil
+	}, Transient)
+	if err != nil || calls != 2 {
+		t.Errorf("got %d calls, %v", calls, err)
+	}
+}
+
+func TestUploadMultipartRetriesParts(t *testing.T) {
+	noSleep(t)
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "2" && failures.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer server.Close()
+
+	data := make([]byte, 250)
+	partURLs := []string{server.URL + "/?partNumber=1", server.URL + "/?partNumber=2", server.URL + "/?partNumber=3"}
+	parts, err := UploadMultipart(partURLs, 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{Concurrency: 2, Backoff: Backoff{Attempts: 3}})
+	if err != nil || len(parts) != 3 {
+		t.Errorf("got %v, %v", parts, err)
+	}
+}
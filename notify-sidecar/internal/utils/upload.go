@@ -1,30 +1,254 @@
 package utils
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/models"
+	log "github.com/sirupsen/logrus"
 )
 
-func UploadToS3(url string, file io.Reader) error {
+const defaultUploadConcurrency = 4
+
+// uploadProgress tracks the bytes sent for one object, possibly from
+// several concurrent part uploads, and logs every 10 percent.
+type uploadProgress struct {
+	name     string
+	total    int64
+	sent     atomic.Int64
+	reported atomic.Int64
+}
+
+func newUploadProgress(name string, total int64) *uploadProgress {
+	return &uploadProgress{name: name, total: total}
+}
+
+func (p *uploadProgress) add(n int) {
+	sent := p.sent.Add(int64(n))
+	metrics.UploadedBytes.Add(float64(n))
+	if p.total <= 0 {
+		return
+	}
+	step := sent * 10 / p.total
+	// retried parts are sent again, do not report more than 100 percent
+	step = min(step, 10)
+	if reported := p.reported.Load(); step > reported && p.reported.CompareAndSwap(reported, step) {
+		log.WithFields(log.Fields{
+			"caller": "uploadProgress",
+		}).Info(fmt.Sprintf("Uploaded %d of %d bytes (%d%%) of %s", sent, p.total, step*10, p.name))
+	}
+}
+
+// objectName strips the presigning query from a URL for logging.
+func objectName(url string) string {
+	name, _, _ := strings.Cut(url, "?")
+	return path.Base(name)
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *uploadProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.progress.add(n)
+	return n, err
+}
+
+// Close is called by the HTTP client once the request is done, readers of
+// an envelope stop sealing then.
+func (r *progressReader) Close() error {
+	if closer, ok := r.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
 
-	buf := &bytes.Buffer{}
-	buf.ReadFrom(file)
+// UploadToS3 streams size bytes of file to a presigned PUT URL without
+// buffering them, so memory usage does not depend on the size of the dump.
+func UploadToS3(url string, file io.Reader, size int64, headers map[string]string) error {
+	progress := newUploadProgress(objectName(url), size)
+	return putObject(url, file, size, headers, progress)
+}
 
-	req, err := http.NewRequest("PUT", url, buf)
+// putObject uploads body to a presigned URL. headers are the signed headers
+// the URL was presigned with.
+func putObject(url string, body io.Reader, size int64, headers map[string]string, progress *uploadProgress) error {
+	req, err := http.NewRequest("PUT", url, &progressReader{reader: body, progress: progress})
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error creating request %s: %s", url, err.Error()))
 	}
-
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
 	resp, err := http.DefaultClient.Do(req)
+	if errors.Is(err, ErrSourceChanged) {
+		return fmt.Errorf("Error making request: %w", err)
+	}
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error making request: %s", err.Error()))
+		return networkError(fmt.Sprintf("Error making request: %s", err.Error()))
 	}
+	defer resp.Body.Close()
 	b, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode > 400 {
-		return errors.New(fmt.Sprintf("AWS Api responded with status %d : %s", resp.StatusCode, b))
+	if resp.StatusCode >= 300 {
+		return s3StatusError(resp.StatusCode, b, fmt.Sprintf("AWS Api responded with status %d : %s", resp.StatusCode, b))
 	}
 	return nil
 }
+
+// ObjectStored tells whether the object behind a presigned HEAD URL is
+// stored with size bytes. The reply to HEAD has no body, so an expired URL
+// can not be told from a denied request, both are Expired.
+func ObjectStored(url string, size int64) (bool, error) {
+	resp, err := http.Head(url)
+	if err != nil {
+		return false, networkError(fmt.Sprintf("Error making request: %s", err.Error()))
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return false, &RequestError{Class: Expired, StatusCode: resp.StatusCode, Message: fmt.Sprintf("AWS Api responded with status %d", resp.StatusCode)}
+	case resp.StatusCode >= 300:
+		return false, s3StatusError(resp.StatusCode, nil, fmt.Sprintf("AWS Api responded with status %d", resp.StatusCode))
+	}
+	return resp.ContentLength == size, nil
+}
+
+// SectionOpener returns a reader for length bytes of an object starting at
+// offset. Readers for different sections have to be usable concurrently.
+type SectionOpener func(offset int64, length int64) io.Reader
+
+// ReaderAtSections opens sections of r with io.NewSectionReader.
+func ReaderAtSections(r io.ReaderAt) SectionOpener {
+	return func(offset int64, length int64) io.Reader {
+		return io.NewSectionReader(r, offset, length)
+	}
+}
+
+// MultipartOptions tune UploadMultipart. PartHeaders, if set, are the
+// signed headers of the part URL at the same index.
+type MultipartOptions struct {
+	Concurrency int
+	Backoff     Backoff
+	PartHeaders []map[string]string
+}
+
+// UploadMultipart uploads size bytes of an object to the presigned part URLs
+// of a multipart upload, with at most opts.Concurrency parts in flight. Parts
+// failing with a transient error are retried on their own. It returns the
+// ETag of every part in part number order.
+func UploadMultipart(partURLs []string, partSize int64, open SectionOpener, size int64, opts MultipartOptions) ([]models.CompletedPart, error) {
+	if partSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid part size %d", partSize))
+	}
+	expectedParts := (size + partSize - 1) / partSize
+	if expectedParts == 0 {
+		expectedParts = 1
+	}
+	if int64(len(partURLs)) != expectedParts {
+		return nil, errors.New(fmt.Sprintf("Got %d part URLs for %d parts of %d bytes", len(partURLs), expectedParts, partSize))
+	}
+	if opts.PartHeaders != nil && len(opts.PartHeaders) != len(partURLs) {
+		return nil, errors.New(fmt.Sprintf("Got headers for %d of %d parts", len(opts.PartHeaders), len(partURLs)))
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+
+	progress := newUploadProgress(objectName(partURLs[0]), size)
+	parts := make([]models.CompletedPart, len(partURLs))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	for i, url := range partURLs {
+		slots <- struct{}{}
+		// no point in starting more parts once one has failed
+		if failed() {
+			<-slots
+			break
+		}
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			offset := int64(i) * partSize
+			length := min(partSize, size-offset)
+			var headers map[string]string
+			if opts.PartHeaders != nil {
+				headers = opts.PartHeaders[i]
+			}
+			var etag string
+			err := opts.Backoff.Retry(fmt.Sprintf("Upload of part %d", i+1), func() error {
+				var err error
+				etag, err = uploadPart(url, headers, open(offset, length), length, progress)
+				return err
+			}, Transient)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Error uploading part %d: %w", i+1, err)
+				}
+				return
+			}
+			// S3 verified the part against the signed checksum, completing
+			// the upload requires it again
+			parts[i] = models.CompletedPart{PartNumber: int64(i + 1), ETag: etag, ChecksumSHA256: headers[checksumHeader]}
+		}(i, url)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return parts, nil
+}
+
+func uploadPart(url string, headers map[string]string, body io.Reader, length int64, progress *uploadProgress) (string, error) {
+	req, err := http.NewRequest("PUT", url, &progressReader{reader: body, progress: progress})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error creating request %s: %s", url, err.Error()))
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.ContentLength = length
+	resp, err := http.DefaultClient.Do(req)
+	if errors.Is(err, ErrSourceChanged) {
+		return "", fmt.Errorf("Error making request: %w", err)
+	}
+	if err != nil {
+		return "", networkError(fmt.Sprintf("Error making request: %s", err.Error()))
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return "", s3StatusError(resp.StatusCode, b, fmt.Sprintf("AWS Api responded with status %d : %s", resp.StatusCode, b))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("AWS Api did not return an ETag")
+	}
+	return etag, nil
+}
@@ -1,17 +1,180 @@
 package utils
 
 import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestFailedUpload(t *testing.T) {
 	fileHandler, _ := os.Open("does_not_exist")
 	url := "http://localhost:1337"
-	got := UploadToS3(url, fileHandler)
+	got := UploadToS3(url, fileHandler, 0, nil)
 	wantNoNetwork := "Error making request:"
 	if !(strings.Contains(got.Error(), wantNoNetwork)) {
 		t.Errorf("got wrong error %+v, want %+v", got.Error(), wantNoNetwork)
 	}
 }
+
+func TestUploadMultipart(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	received := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		inFlight--
+		received[r.URL.Query().Get("partNumber")] = body
+		mu.Unlock()
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("part %s: content length %d, body %d", r.URL.Query().Get("partNumber"), r.ContentLength, len(body))
+		}
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%s\"", r.URL.Query().Get("partNumber")))
+	}))
+	defer server.Close()
+
+	data := make([]byte, 1050)
+	rand.Read(data)
+	var partURLs []string
+	for i := 1; i <= 11; i++ {
+		partURLs = append(partURLs, fmt.Sprintf("%s/?partNumber=%d", server.URL, i))
+	}
+	parts, err := UploadMultipart(partURLs, 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{Concurrency: 3})
+	if err != nil {
+		t.Fatalf("Failed to upload parts: %v", err)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("%d parts were uploaded concurrently, want at most 3", maxInFlight)
+	}
+	var reassembled []byte
+	for i, part := range parts {
+		if part.PartNumber != int64(i+1) || part.ETag != fmt.Sprintf("\"etag-%d\"", i+1) {
+			t.Errorf("unexpected part %+v", part)
+		}
+		reassembled = append(reassembled, received[fmt.Sprint(i+1)]...)
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Errorf("uploaded parts do not add up to the file")
+	}
+
+	_, err = UploadMultipart(partURLs[:10], 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{Concurrency: 3})
+	if err == nil {
+		t.Errorf("missing part URLs must be detected")
+	}
+}
+
+func TestFailedUploadMultipart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "2" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer server.Close()
+
+	data := make([]byte, 250)
+	partURLs := []string{server.URL + "/?partNumber=1", server.URL + "/?partNumber=2", server.URL + "/?partNumber=3"}
+	_, err := UploadMultipart(partURLs, 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{Concurrency: 1})
+	if err == nil || !strings.Contains(err.Error(), "Error uploading part 2") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestUploadMultipartPartHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "checksum-" + r.URL.Query().Get("partNumber")
+		if got := r.Header.Get("X-Amz-Checksum-Sha256"); got != want {
+			t.Errorf("got checksum %q, want %q", got, want)
+		}
+		w.Header().Set("ETag", "\"etag\"")
+	}))
+	defer server.Close()
+
+	data := make([]byte, 150)
+	partURLs := []string{server.URL + "/?partNumber=1", server.URL + "/?partNumber=2"}
+	headers := []map[string]string{
+		{"X-Amz-Checksum-Sha256": "checksum-1"},
+		{"X-Amz-Checksum-Sha256": "checksum-2"},
+	}
+	parts, err := UploadMultipart(partURLs, 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{PartHeaders: headers})
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	for i, part := range parts {
+		if part.ChecksumSHA256 != headers[i]["X-Amz-Checksum-Sha256"] {
+			t.Errorf("part %d has to report its checksum, got %+v", i+1, part)
+		}
+	}
+
+	_, err = UploadMultipart(partURLs, 100, ReaderAtSections(bytes.NewReader(data)), int64(len(data)), MultipartOptions{PartHeaders: headers[:1]})
+	if err == nil {
+		t.Errorf("every part needs its headers")
+	}
+}
+
+func TestUploadToS3Streams(t *testing.T) {
+	const size = 8 * 1024 * 1024
+	var received int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != size || len(r.TransferEncoding) != 0 {
+			t.Errorf("want a plain upload of %d bytes, got length %d and encoding %v", size, r.ContentLength, r.TransferEncoding)
+		}
+		received, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	// a reader that can only be consumed once, nothing to peek at for net/http
+	body := io.LimitReader(rand.Reader, size)
+	if err := UploadToS3(server.URL+"/dump.hprof.crypted?X-Amz-Signature=abc", body, size, nil); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	if received != size {
+		t.Errorf("got %d bytes, want %d", received, size)
+	}
+}
+
+func TestUploadToS3Headers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Amz-Meta-Hprof-Validation"); got != "truncated" {
+			t.Errorf("signed header is missing, got %q", got)
+		}
+	}))
+	defer server.Close()
+	err := UploadToS3(server.URL, strings.NewReader("test"), 4, map[string]string{"X-Amz-Meta-Hprof-Validation": "truncated"})
+	if err != nil {
+		t.Errorf("Failed to upload: %v", err)
+	}
+}
+
+func TestUploadToS3Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "ExpiredToken")
+	}))
+	defer server.Close()
+	err := UploadToS3(server.URL, strings.NewReader("test"), 4, nil)
+	if err == nil || !strings.Contains(err.Error(), "status 400 : ExpiredToken") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestObjectName(t *testing.T) {
+	got := objectName("https://bucket.s3.amazonaws.com/tenant/ns/dump.hprof.crypted?X-Amz-Signature=abc")
+	if got != "dump.hprof.crypted" {
+		t.Errorf("got %s", got)
+	}
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// WrapNewKey generates a new AES-256 key and wraps it with the PEM encoded
+// RSA public key of a Vault transit key, so the heap dump service never sees
+// it. It returns the key base64 encoded and the wrapped key as transit
+// ciphertext of the given key version. Vault stores the key base64 encoded
+// as it does for keys generated by the heap dump service, so the companion
+// decrypts both the same way.
+func WrapNewKey(publicKeyPEM string, version int) (string, string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return "", "", errors.New("Error parsing wrapping key: no PEM data found")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error parsing wrapping key: %s", err.Error()))
+	}
+	publicKey, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return "", "", errors.New(fmt.Sprintf("Error parsing wrapping key: expected an RSA key, got %T", parsed))
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error generating key: %s", err.Error()))
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, []byte(encodedKey), nil)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error wrapping key: %s", err.Error()))
+	}
+	return encodedKey, fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(wrapped)), nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestWrapNewKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate rsa key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	encodedKey, wrappedKey, err := WrapNewKey(publicKeyPEM, 3)
+	if err != nil {
+		t.Fatalf("Failed to wrap key: %v", err)
+	}
+	if key, err := base64.StdEncoding.DecodeString(encodedKey); err != nil || len(key) != 32 {
+		t.Errorf("Expected a base64 encoded 32 byte key, got %s", encodedKey)
+	}
+	if !strings.HasPrefix(wrappedKey, "vault:v3:") {
+		t.Fatalf("Expected transit ciphertext of version 3, got %s", wrappedKey)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(wrappedKey, "vault:v3:"))
+	if err != nil {
+		t.Fatalf("Wrapped key is not base64 encoded: %v", err)
+	}
+	unwrapped, err := rsa.DecryptOAEP(sha256.New(), nil, privateKey, wrapped, nil)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if string(unwrapped) != encodedKey {
+		t.Errorf("got %s, want %s", unwrapped, encodedKey)
+	}
+
+	if _, _, err := WrapNewKey("no key", 1); err == nil {
+		t.Errorf("Invalid wrapping keys have to be rejected")
+	}
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyWatcher reacts on IN_CLOSE_WRITE and IN_MOVED_TO, so a file is
+// reported as soon as its writer is done with it. Files already present
+// when the watch is set up, or after the kernel queue overflowed, are
+// reported as Found.
+type inotifyWatcher struct {
+	dir    string
+	file   *os.File
+	events chan Event
+	errors chan error
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newInotifyWatcher(dir string) (*inotifyWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not initialize inotify: %s", err.Error()))
+	}
+	_, err = unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_ONLYDIR)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.New(fmt.Sprintf("Could not watch %s: %s", dir, err.Error()))
+	}
+	w := &inotifyWatcher{
+		dir: dir,
+		// a non blocking descriptor is handled by the runtime poller, so
+		// closing the file interrupts a pending read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) run() {
+	if !w.rescan() {
+		return
+	}
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			case w.errors <- errors.New(fmt.Sprintf("Error reading inotify events: %s", err.Error())):
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(raw.Len)]
+			offset += unix.SizeofInotifyEvent + int(raw.Len)
+
+			switch {
+			case raw.Mask&unix.IN_Q_OVERFLOW != 0:
+				if !w.rescan() {
+					return
+				}
+			case raw.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0:
+				select {
+				case <-w.done:
+				case w.errors <- errors.New(fmt.Sprintf("Watched directory %s is gone", w.dir)):
+				}
+				return
+			case raw.Mask&unix.IN_ISDIR != 0:
+			case raw.Mask&(unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO) != 0:
+				name := string(nameBytes[:clen(nameBytes)])
+				if !w.send(Event{Path: filepath.Join(w.dir, name), Op: Written}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// rescan reports every file in the directory, for events that might have
+// been missed. It returns false once the watcher is closed.
+func (w *inotifyWatcher) rescan() bool {
+	files, err := listFiles(w.dir, os.ReadDir)
+	if err != nil {
+		select {
+		case w.errors <- err:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	for _, file := range files {
+		if !w.send(Event{Path: file, Op: Found}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *inotifyWatcher) send(event Event) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// clen returns the length of the NUL padded name of an inotify event.
+func clen(b []byte) int {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
+
+func (w *inotifyWatcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInotifyWatcher(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.hprof")
+	os.WriteFile(existing, []byte("test"), 0o644)
+
+	w, err := newInotifyWatcher(dir)
+	if err != nil {
+		t.Skipf("inotify not available: %v", err)
+	}
+	defer w.Close()
+
+	if got := nextEvent(t, w); got != (Event{Path: existing, Op: Found}) {
+		t.Errorf("existing files must be reported on start, got %+v", got)
+	}
+
+	written := filepath.Join(dir, "written.hprof")
+	f, err := os.Create(written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("heap"))
+	f.Close()
+	if got := nextEvent(t, w); got != (Event{Path: written, Op: Written}) {
+		t.Errorf("got %+v, want close-write of %s", got, written)
+	}
+
+	staging := filepath.Join(t.TempDir(), "moved.hprof")
+	os.WriteFile(staging, []byte("heap"), 0o644)
+	moved := filepath.Join(dir, "moved.hprof")
+	if err := os.Rename(staging, moved); err != nil {
+		t.Fatal(err)
+	}
+	if got := nextEvent(t, w); got != (Event{Path: moved, Op: Written}) {
+		t.Errorf("got %+v, want move of %s", got, moved)
+	}
+}
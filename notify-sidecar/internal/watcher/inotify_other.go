@@ -0,0 +1,9 @@
+//go:build !linux
+
+package watcher
+
+import "errors"
+
+func newInotifyWatcher(dir string) (Watcher, error) {
+	return nil, errors.New("inotify is only supported on Linux")
+}
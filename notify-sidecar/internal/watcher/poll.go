@@ -0,0 +1,83 @@
+package watcher
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// pollWatcher lists the directory at a fixed interval and reports every file
+// as Found. It works on any file system, including NFS and EFS volumes
+// which do not deliver inotify events.
+type pollWatcher struct {
+	dir      string
+	interval time.Duration
+	events   chan Event
+	errors   chan error
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newPollWatcher(dir string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		dir:      dir,
+		interval: interval,
+		events:   make(chan Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// run lists the directory right away, like the inotify backend rescans it
+// on start, and then once per interval.
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		if !w.list() {
+			return
+		}
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// list reports every file in the directory and returns false once the
+// watcher is closed.
+func (w *pollWatcher) list() bool {
+	files, err := listFiles(w.dir, os.ReadDir)
+	if err != nil {
+		select {
+		case w.errors <- err:
+			return true
+		case <-w.done:
+			return false
+		}
+	}
+	for _, file := range files {
+		select {
+		case w.events <- Event{Path: file, Op: Found}:
+		case <-w.done:
+			return false
+		}
+	}
+	return true
+}
+
+func (w *pollWatcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *pollWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.done) })
+	return nil
+}
@@ -0,0 +1,243 @@
+package watcher
+
+import (
+	"fmt"
+	"io/fs"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dbschenker/heap-dump-management/notify-sidecar/internal/metrics"
+)
+
+// State is the position of a file in the lifecycle
+// discovered -> growing -> stable -> processing -> uploaded/failed.
+type State string
+
+const (
+	Discovered State = "discovered"
+	Growing    State = "growing"
+	Stable     State = "stable"
+	Processing State = "processing"
+	Uploaded   State = "uploaded"
+	Failed     State = "failed"
+)
+
+const (
+	defaultSettleTime   = 15 * time.Second
+	defaultStableChecks = 1
+)
+
+type trackedFile struct {
+	state      State
+	size       int64
+	modTime    time.Time
+	unchanged  int
+	discovered time.Time
+	// written is when the watcher last reported the file as Written
+	written time.Time
+}
+
+// settleStart is when the settle time of the file started: its last
+// modification or, if later, the last time a writer closed it.
+func (f *trackedFile) settleStart() time.Time {
+	if f.written.After(f.modTime) {
+		return f.written
+	}
+	return f.modTime
+}
+
+// Tracker follows every file reported by a Watcher through its lifecycle.
+// A file is stable once its size and modification time did not change for
+// stableChecks observations and it was neither modified nor reported as
+// Written for the settle time. A writer closing the file does not mean it is
+// done, JVMs may reopen a dump to append to it and several processes may
+// write the same file.
+type Tracker struct {
+	tenant       string
+	settleTime   time.Duration
+	stableChecks int
+	now          func() time.Time
+
+	mu    sync.Mutex
+	files map[string]*trackedFile
+}
+
+func NewTracker(tenant string, settleTime time.Duration, stableChecks int) *Tracker {
+	if settleTime <= 0 {
+		settleTime = defaultSettleTime
+	}
+	if stableChecks <= 0 {
+		stableChecks = defaultStableChecks
+	}
+	return &Tracker{
+		tenant:       tenant,
+		settleTime:   settleTime,
+		stableChecks: stableChecks,
+		now:          time.Now,
+		files:        map[string]*trackedFile{},
+	}
+}
+
+// Observe records the current size and modification time of path and
+// returns its state afterwards. A settle time of 0 uses the default of the
+// tracker. Files being processed or already handled are not changed.
+func (t *Tracker) Observe(path string, info fs.FileInfo, op Op, settleTime time.Duration) State {
+	if settleTime <= 0 {
+		settleTime = t.settleTime
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, found := t.files[path]
+	if !found {
+		file = &trackedFile{size: info.Size(), modTime: info.ModTime(), discovered: t.now()}
+		if op == Written {
+			file.written = t.now()
+		}
+		t.files[path] = file
+		t.transition(path, file, Discovered)
+		return file.state
+	}
+	switch file.state {
+	case Processing, Uploaded, Failed:
+		return file.state
+	}
+	if op == Written {
+		file.written = t.now()
+	}
+
+	if info.Size() != file.size || !info.ModTime().Equal(file.modTime) {
+		file.size = info.Size()
+		file.modTime = info.ModTime()
+		file.unchanged = 0
+		t.transition(path, file, Growing)
+		return file.state
+	}
+
+	file.unchanged++
+	if file.unchanged >= t.stableChecks && t.now().Sub(file.settleStart()) >= settleTime {
+		t.transition(path, file, Stable)
+	} else if file.state == Stable {
+		// written again, it has to settle once more
+		t.transition(path, file, Growing)
+	}
+	return file.state
+}
+
+// Start moves a stable file to processing. It returns false if the file is
+// not stable, so a file is never processed twice.
+func (t *Tracker) Start(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, found := t.files[path]
+	if !found || file.state != Stable {
+		return false
+	}
+	t.transition(path, file, Processing)
+	return true
+}
+
+// Finish ends the processing of path. Uploaded files are forgotten, so a new
+// dump with the same name is picked up again. Failed files are kept until
+// they are removed from the directory.
+func (t *Tracker) Finish(path string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, found := t.files[path]
+	if !found || file.state != Processing {
+		return
+	}
+	if err != nil {
+		t.transition(path, file, Failed)
+		return
+	}
+	t.transition(path, file, Uploaded)
+	t.forget(path, file)
+}
+
+// Forget stops tracking a file, e.g. because it was removed.
+func (t *Tracker) Forget(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if file, found := t.files[path]; found {
+		t.forget(path, file)
+	}
+}
+
+// State returns the state of path and whether it is tracked at all.
+func (t *Tracker) State(path string) (State, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	file, found := t.files[path]
+	if !found {
+		return "", false
+	}
+	return file.state, true
+}
+
+// Discovered returns when path was first observed, or the zero time if it
+// is not tracked.
+func (t *Tracker) Discovered(path string) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if file, found := t.files[path]; found {
+		return file.discovered
+	}
+	return time.Time{}
+}
+
+// Pending returns the files that still wait to become stable or to be
+// processed. They have to be observed again even if the watcher does not
+// report them anymore.
+func (t *Tracker) Pending() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := make([]string, 0, len(t.files))
+	for path, file := range t.files {
+		switch file.state {
+		case Discovered, Growing, Stable:
+			pending = append(pending, path)
+		}
+	}
+	sort.Strings(pending)
+	return pending
+}
+
+func (t *Tracker) transition(path string, file *trackedFile, state State) {
+	if file.state == state {
+		return
+	}
+	from := file.state
+	file.state = state
+	if from != "" {
+		metrics.TrackedFiles.WithLabelValues(t.tenant, string(from)).Dec()
+	}
+	metrics.TrackedFiles.WithLabelValues(t.tenant, string(state)).Inc()
+	metrics.FileTransitions.WithLabelValues(t.tenant, string(state)).Inc()
+
+	entry := log.WithFields(log.Fields{
+		"caller": "Tracker",
+		"file":   path,
+		"state":  state,
+	})
+	if from == "" {
+		entry.Info(fmt.Sprintf("%s %s with size %d", path, state, file.size))
+	} else {
+		entry.Info(fmt.Sprintf("%s %s -> %s with size %d", path, from, state, file.size))
+	}
+}
+
+func (t *Tracker) forget(path string, file *trackedFile) {
+	metrics.TrackedFiles.WithLabelValues(t.tenant, string(file.state)).Dec()
+	delete(t.files, path)
+}
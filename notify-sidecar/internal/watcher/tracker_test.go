@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func fileInfo(t *testing.T, size int, modTime time.Time) fs.FileInfo {
+	t.Helper()
+	fsys := fstest.MapFS{"dump.hprof": &fstest.MapFile{Data: make([]byte, size), ModTime: modTime}}
+	info, err := fs.Stat(fsys, "dump.hprof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func newTestTracker(now time.Time) *Tracker {
+	tracker := NewTracker("test", 15*time.Second, 1)
+	tracker.now = func() time.Time { return now }
+	return tracker
+}
+
+func TestTrackerLifecycle(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newTestTracker(start.Add(20 * time.Second))
+
+	steps := []struct {
+		info fs.FileInfo
+		want State
+	}{
+		{fileInfo(t, 10, start), Discovered},
+		{fileInfo(t, 20, start.Add(time.Second)), Growing},
+		{fileInfo(t, 20, start.Add(time.Second)), Stable},
+	}
+	for i, step := range steps {
+		if got := tracker.Observe("/dumps/a", step.info, Found, 0); got != step.want {
+			t.Errorf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+
+	if got := tracker.Discovered("/dumps/a"); !got.Equal(start.Add(20 * time.Second)) {
+		t.Errorf("file was discovered at the first observation, got %v", got)
+	}
+	if !tracker.Start("/dumps/a") {
+		t.Fatalf("stable file must be processable")
+	}
+	if tracker.Start("/dumps/a") {
+		t.Errorf("file must not be processed twice")
+	}
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 30, start), Found, 0); got != Processing {
+		t.Errorf("observing a file in processing must not change it, got %s", got)
+	}
+	tracker.Finish("/dumps/a", nil)
+	if _, found := tracker.State("/dumps/a"); found {
+		t.Errorf("uploaded files must be forgotten")
+	}
+	if !tracker.Discovered("/dumps/a").IsZero() {
+		t.Errorf("forgotten files have no discovery time")
+	}
+}
+
+func TestTrackerFilesAreIndependent(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newTestTracker(start.Add(time.Minute))
+
+	// interleaved observations of two files with different sizes must not
+	// influence each other
+	tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0)
+	tracker.Observe("/dumps/b", fileInfo(t, 20, start), Found, 0)
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0); got != Stable {
+		t.Errorf("a: got %s, want %s", got, Stable)
+	}
+	if got := tracker.Observe("/dumps/b", fileInfo(t, 30, start.Add(time.Second)), Found, 0); got != Growing {
+		t.Errorf("b: got %s, want %s", got, Growing)
+	}
+}
+
+func TestTrackerSettleTime(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newTestTracker(start.Add(5 * time.Second))
+
+	tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0)
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0); got != Discovered {
+		t.Errorf("recently modified files must not be stable, got %s", got)
+	}
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 5*time.Second); got != Stable {
+		t.Errorf("a shorter settle time must be respected, got %s", got)
+	}
+	tracker.Forget("/dumps/a")
+	tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0)
+	tracker.now = func() time.Time { return start.Add(15 * time.Second) }
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0); got != Stable {
+		t.Errorf("got %s, want %s", got, Stable)
+	}
+}
+
+func TestTrackerWrittenSettles(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tracker := newTestTracker(start.Add(time.Minute))
+
+	// a closed file may be reopened to append to it, closing it only
+	// starts the settle time
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Written, 0); got != Discovered {
+		t.Errorf("closed files have to settle, got %s", got)
+	}
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0); got != Discovered {
+		t.Errorf("the settle time starts when the file was closed, got %s", got)
+	}
+	tracker.now = func() time.Time { return start.Add(time.Minute + 15*time.Second) }
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0); got != Stable {
+		t.Errorf("got %s, want %s", got, Stable)
+	}
+	if got := tracker.Observe("/dumps/a", fileInfo(t, 10, start), Written, 0); got != Growing {
+		t.Errorf("a file closed again has to settle again, got %s", got)
+	}
+
+	tracker.Forget("/dumps/a")
+	tracker.Observe("/dumps/a", fileInfo(t, 10, start), Written, 0)
+	tracker.now = func() time.Time { return start.Add(2 * time.Minute) }
+	tracker.Observe("/dumps/a", fileInfo(t, 10, start), Found, 0)
+	tracker.Start("/dumps/a")
+	tracker.Finish("/dumps/a", errors.New("upload failed"))
+	if got, _ := tracker.State("/dumps/a"); got != Failed {
+		t.Errorf("got %s, want %s", got, Failed)
+	}
+	if pending := tracker.Pending(); len(pending) != 0 {
+		t.Errorf("failed files must not be pending, got %v", pending)
+	}
+}
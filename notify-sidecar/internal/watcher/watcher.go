@@ -0,0 +1,89 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	BackendInotify = "inotify"
+	BackendPoll    = "poll"
+
+	defaultPollInterval = 10 * time.Second
+)
+
+type Op int
+
+const (
+	// Found is reported for files seen in a directory listing. The file may
+	// still be written to.
+	Found Op = iota
+	// Written is reported once a writer closed the file or it was moved into
+	// the directory.
+	Written
+)
+
+func (o Op) String() string {
+	switch o {
+	case Found:
+		return "found"
+	case Written:
+		return "written"
+	}
+	return fmt.Sprintf("op(%d)", int(o))
+}
+
+type Event struct {
+	Path string
+	Op   Op
+}
+
+// Watcher reports files in a single directory. Sub directories are ignored.
+type Watcher interface {
+	Events() <-chan Event
+	Errors() <-chan error
+	Close() error
+}
+
+// New creates a watcher for dir with the given backend. The inotify backend
+// is the default; if it is not available, e.g. outside of Linux, the
+// polling backend is used instead.
+func New(dir string, backend string, pollInterval time.Duration) (Watcher, error) {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+	switch backend {
+	case "", BackendInotify:
+		w, err := newInotifyWatcher(dir)
+		if err == nil {
+			return w, nil
+		}
+		log.WithFields(log.Fields{
+			"caller": "watcher.New",
+		}).Warn(fmt.Sprintf("inotify is not available for %s, falling back to polling: %s", dir, err.Error()))
+		return newPollWatcher(dir, pollInterval), nil
+	case BackendPoll:
+		return newPollWatcher(dir, pollInterval), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown watcher backend: %s", backend))
+}
+
+// listFiles returns the paths of all regular files in dir.
+func listFiles(dir string, readDir func(string) ([]fs.DirEntry, error)) ([]string, error) {
+	entries, err := readDir(dir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read files in dir: %s", err.Error()))
+	}
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,76 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, w Watcher) Event {
+	t.Helper()
+	select {
+	case event := <-w.Events():
+		return event
+	case err := <-w.Errors():
+		t.Fatalf("unexpected watcher error: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event within 5s")
+	}
+	return Event{}
+}
+
+func TestPollWatcher(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "subdir"), 0o755)
+	os.WriteFile(filepath.Join(dir, "dump.hprof"), []byte("test"), 0o644)
+
+	w, err := New(dir, BackendPoll, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	want := Event{Path: filepath.Join(dir, "dump.hprof"), Op: Found}
+	for i := 0; i < 2; i++ {
+		if got := nextEvent(t, w); got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestPollWatcherListsOnStart(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "dump.hprof"), []byte("test"), 0o644)
+
+	// files present on start must not wait for the first interval
+	w, err := New(dir, BackendPoll, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer w.Close()
+
+	want := Event{Path: filepath.Join(dir, "dump.hprof"), Op: Found}
+	if got := nextEvent(t, w); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	_, err := New(t.TempDir(), "fanotify", 0)
+	if err == nil || err.Error() != "Unknown watcher backend: fanotify" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestCloseStopsWatcher(t *testing.T) {
+	w, err := New(t.TempDir(), BackendPoll, time.Millisecond)
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	w.Close()
+	// closing twice must not panic
+	if err := w.Close(); err != nil {
+		t.Errorf("got %v", err)
+	}
+}